@@ -0,0 +1,236 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Recipient is a recipient of a batch with the values of the template's placeholders
+type Recipient struct {
+	Address mail.Address
+	Vars    map[string]string // the values of the {{name}} placeholders, a missing value is replaced with nothing
+}
+
+// batchSender is implemented by the drivers whose provider sends a message to many recipients
+// in a single request, every recipient seeing only their own address and their own values
+type batchSender interface {
+	// the most recipients of a request, zero when the driver can't send batches,
+	// like a wrapper of a driver without native batches
+	maxBatchSize() int
+	// send the message to the recipients and return the provider's id of the request, the
+	// driver writes the placeholders as the provider expects them with rewritePlaceholders
+	sendBatch(ctx context.Context, msg *Message, recipients []Recipient) (string, error)
+}
+
+// the {{name}} placeholders of the batch templates, the spaces around the name are allowed
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// SendBatch sends the template message to every recipient, each with their own values for
+// the {{name}} placeholders of the subject and the bodies, the values are html-escaped in the html
+// body and inserted as they are in the subject and the plain text body. The "to", "cc" and "bcc" of
+// the template are ignored, every recipient only sees their own address. SendGrid (personalizations,
+// with dynamic_template_data when SendGridConfig.DynamicTemplateID is set), MailGun (recipient-variables)
+// and SparkPost (substitution_data) send up to 1000 recipients per request,
+// the other drivers send a message per recipient, reusing the pooled smtp connections when PoolSize is set.
+// The result of every recipient is returned, in the order of the recipients, even when the sending fails
+func (m *Mailer) SendBatch(ctx context.Context, template *Message, recipients []Recipient) (*SendResult, error) {
+	// readers can only be read once, and the content is sent to every recipient
+	msg, err := template.bufferAttachments()
+	if err == nil {
+		err = checkHeaders(template.Headers)
+	}
+	if err != nil {
+		sendErr := &SendError{Stage: StageBuild, Err: err}
+		return batchResult(recipients, func(Recipient) RecipientResult {
+			return RecipientResult{Status: RecipientRejected, Driver: driverName(m.driver), Err: sendErr}
+		}), sendErr
+	}
+	msg = msg.Clone()
+	msg.To, msg.CC, msg.BCC = nil, nil, nil
+	// a recipient repeated in the list is sent the message once
+	var unique []Recipient
+	seen := make(map[string]bool)
+	for _, v := range recipients {
+		if !seen[strings.ToLower(v.Address.Address)] {
+			seen[strings.ToLower(v.Address.Address)] = true
+			unique = append(unique, v)
+		}
+	}
+	recipients = unique
+
+	results := make(map[string]RecipientResult)
+	if sender, ok := m.driver.(batchSender); ok && sender.maxBatchSize() > 0 {
+		m.sendNativeBatch(ctx, sender, msg, recipients, results)
+	} else {
+		for _, v := range recipients {
+			if ctx.Err() != nil {
+				results[strings.ToLower(v.Address.Address)] = RecipientResult{
+					Status: RecipientSkipped,
+					Driver: driverName(m.driver),
+					Err:    &SendError{Driver: driverName(m.driver), Stage: StageSend, Err: ctx.Err()},
+				}
+				continue
+			}
+			result, _ := m.send(ctx, personalize(msg, v))
+			results[strings.ToLower(v.Address.Address)] = result.Recipients[0]
+		}
+	}
+
+	result := batchResult(recipients, func(r Recipient) RecipientResult {
+		return results[strings.ToLower(r.Address.Address)]
+	})
+	var sent []string
+	var failed []RecipientError
+	for _, v := range result.Recipients {
+		if v.Status == RecipientAccepted {
+			sent = append(sent, v.Address)
+		} else {
+			failed = append(failed, RecipientError{Address: v.Address, Err: v.Err})
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return result, nil
+	case len(sent) > 0:
+		return result, &PartialFailureError{Sent: sent, Failed: failed}
+	}
+	return result, failed[0].Err
+}
+
+// send the batch in requests of the provider's size, a request that fails with an error that
+// isn't permanent stops the sending, the recipients of the next requests are skipped
+func (m *Mailer) sendNativeBatch(ctx context.Context, sender batchSender, msg *Message, recipients []Recipient, results map[string]RecipientResult) {
+	m.mu.Lock()
+	policy, limiter := m.retryPolicy, m.limiter
+	m.mu.Unlock()
+	name := driverName(m.driver)
+	var stopErr *SendError
+	for start := 0; start < len(recipients); {
+		// the requests stay within the recipients the daily cap allows today
+		size := sender.maxBatchSize()
+		if limiter != nil {
+			size = limiter.batchSize(size)
+		}
+		end := start + size
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		chunk := recipients[start:end]
+		start = end
+		if stopErr == nil && ctx.Err() != nil {
+			stopErr = &SendError{Driver: name, Stage: StageSend, Err: ctx.Err()}
+		}
+		result := RecipientResult{Status: RecipientSkipped, Driver: name, Err: stopErr}
+		if stopErr == nil {
+			var err error
+			if limiter != nil {
+				err = limiter.take(ctx, name, len(chunk))
+			}
+			if err == nil {
+				err = retry(ctx, policy, func() error {
+					id, err := sender.sendBatch(ctx, msg, chunk)
+					result.MessageID = id
+					return err
+				})
+			}
+			result.Status = RecipientAccepted
+			if err != nil {
+				result.Status, result.MessageID = RecipientRejected, ""
+				errors.As(asSendError(name, StageSend, err), &result.Err)
+				if !result.Err.Permanent() {
+					stopErr = result.Err
+				}
+			}
+		}
+		for _, v := range chunk {
+			result.Address = v.Address.Address
+			results[strings.ToLower(v.Address.Address)] = result
+		}
+	}
+}
+
+// the results of the recipients in their order
+func batchResult(recipients []Recipient, recipientResult func(Recipient) RecipientResult) *SendResult {
+	result := &SendResult{}
+	for _, v := range recipients {
+		r := recipientResult(v)
+		r.Address = v.Address.Address
+		result.Recipients = append(result.Recipients, r)
+	}
+	return result
+}
+
+// the message to the recipient with the placeholders replaced with their values,
+// the values are html-escaped in the html body and inserted as they are elsewhere
+func personalize(msg *Message, recipient Recipient) *Message {
+	replace := func(s string, escape func(string) string) string {
+		return placeholderPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+			return escape(recipient.Vars[placeholderPattern.FindStringSubmatch(placeholder)[1]])
+		})
+	}
+	raw := func(s string) string { return s }
+	c := msg.Clone()
+	c.To = []mail.Address{recipient.Address}
+	c.Subject = replace(c.Subject, raw)
+	c.HTMLBody = replace(c.HTMLBody, html.EscapeString)
+	c.PlainTextBody = replace(c.PlainTextBody, raw)
+	return c
+}
+
+// the message with the placeholders written as the provider expects, format is told whether the
+// placeholder is in the html body, and the names of the placeholders
+func rewritePlaceholders(msg *Message, format func(name string, html bool) string) (*Message, []string) {
+	var names []string
+	seen := make(map[string]bool)
+	replace := func(s string, html bool) string {
+		return placeholderPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+			name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return format(name, html)
+		})
+	}
+	c := msg.Clone()
+	c.Subject = replace(c.Subject, false)
+	c.HTMLBody = replace(c.HTMLBody, true)
+	c.PlainTextBody = replace(c.PlainTextBody, false)
+	return c, names
+}
+
+// the values of the placeholders for the recipient, the missing ones are empty
+func placeholderValues(names []string, recipient Recipient) map[string]string {
+	values := make(map[string]string, len(names))
+	for _, v := range names {
+		values[v] = recipient.Vars[v]
+	}
+	return values
+}
+
+// the key of a placeholder for the providers that replace the same keys in every part, the html
+// body has its own keys for the escaped values, the prefixes keep the keys of two names apart
+func placeholderKey(name string, html bool) string {
+	if html {
+		return "html_" + name
+	}
+	return "text_" + name
+}
+
+// the values of the placeholders for the recipient by placeholderKey, escaped for the html body
+func escapedPlaceholderValues(names []string, recipient Recipient) map[string]string {
+	values := make(map[string]string, 2*len(names))
+	for _, v := range names {
+		values[placeholderKey(v, false)] = recipient.Vars[v]
+		values[placeholderKey(v, true)] = html.EscapeString(recipient.Vars[v])
+	}
+	return values
+}
@@ -0,0 +1,207 @@
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+var batchTemplate = &Message{
+	From:          mail.Address{Address: "from@mail.com"},
+	To:            []mail.Address{{Address: "ignored@mail.com"}},
+	Subject:       "Hello {{ name }}",
+	PlainTextBody: "Dear {{name}}, your code is {{code}}",
+	HTMLBody:      "<p>Dear {{name}}</p>",
+}
+
+var batchRecipients = []Recipient{
+	{Address: mail.Address{Name: "Ali", Address: "ali@mail.com"}, Vars: map[string]string{"name": "Ali", "code": "A1"}},
+	{Address: mail.Address{Address: "unknown@mail.com"}, Vars: map[string]string{"name": "<b>Unknown</b>"}},
+	{Address: mail.Address{Address: "sara@mail.com"}, Vars: map[string]string{"name": "Sara", "code": "S2"}},
+	{Address: mail.Address{Address: "ALI@mail.com"}, Vars: map[string]string{"name": "Repeated"}},
+}
+
+func TestSendBatchSMTP(t *testing.T) {
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.rcptReply = func(rcpt string) string {
+			if rcpt == "unknown@mail.com" {
+				return "550 5.1.1 Recipient address rejected"
+			}
+			return ""
+		}
+	})
+	config := server.config(SMTPEncryptionNone)
+	config.PoolSize = 2
+	mailer := NewMailerWithSMTP(config)
+	defer mailer.Close()
+	result, err := mailer.SendBatch(context.Background(), batchTemplate, batchRecipients)
+	var partialErr *PartialFailureError
+	if !errors.As(err, &partialErr) || len(partialErr.Sent) != 2 || len(result.Recipients) != 3 {
+		t.Fatal("failed testing send batch smtp", err)
+	}
+	ali, unknown, sara := result.Recipients[0], result.Recipients[1], result.Recipients[2]
+	if ali.Status != RecipientAccepted || sara.Status != RecipientAccepted || unknown.Status != RecipientRejected || unknown.Err.SMTPCode != 550 {
+		t.Error("failed testing send batch smtp")
+	}
+	// the pooled connection is reused for every recipient
+	mails := server.sentMails()
+	if len(mails) != 2 || server.openedConnections() != 1 {
+		t.Fatal("failed testing send batch smtp", len(mails), server.openedConnections())
+	}
+	if len(mails[0].rcpts) != 1 || mails[0].rcpts[0] != "ali@mail.com" || !strings.Contains(mails[0].data, "Subject: Hello Ali") ||
+		!strings.Contains(mails[0].data, "Dear Ali, your code is A1") || !strings.Contains(mails[0].data, `To: "Ali" <ali@mail.com>`) {
+		t.Error("failed testing send batch smtp", mails[0].data)
+	}
+	if mails[1].rcpts[0] != "sara@mail.com" || !strings.Contains(mails[1].data, "Dear Sara, your code is S2") || strings.Contains(mails[1].data, "ignored@mail.com") {
+		t.Error("failed testing send batch smtp", mails[1].data)
+	}
+}
+
+func TestSendBatchSendGrid(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := map[string]interface{}{}
+		json.Unmarshal(body, &request)
+		requests = append(requests, request)
+		w.Header().Set("X-Message-Id", fmt.Sprintf("id-%d", len(requests)))
+		if len(requests) > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	mailer := NewMailer(initiateSendGrid(&SendGridConfig{Host: server.URL, Endpoint: "/v3/mail/send", ApiKey: "test-api-key"}))
+	result, err := mailer.SendBatch(context.Background(), batchTemplate, batchRecipients)
+	if err != nil || len(requests) != 1 || len(result.Recipients) != 3 || result.Recipients[2].MessageID != "id-1" {
+		t.Fatal("failed testing send batch sendgrid", err)
+	}
+	if requests[0]["subject"] != "Hello {{text_name}}" {
+		t.Error("failed testing send batch sendgrid", requests[0]["subject"])
+	}
+	personalizations := requests[0]["personalizations"].([]interface{})
+	if len(personalizations) != 3 {
+		t.Fatal("failed testing send batch sendgrid")
+	}
+	unknown := personalizations[1].(map[string]interface{})
+	to := unknown["to"].([]interface{})[0].(map[string]interface{})
+	substitutions := unknown["substitutions"].(map[string]interface{})
+	if len(unknown["to"].([]interface{})) != 1 || to["email"] != "unknown@mail.com" || substitutions["{{text_name}}"] != "<b>Unknown</b>" || substitutions["{{text_code}}"] != "" {
+		t.Error("failed testing send batch sendgrid", unknown)
+	}
+	// the html body has its own keys with the escaped values
+	content := requests[0]["content"].([]interface{})
+	if content[1].(map[string]interface{})["value"] != "<p>Dear {{html_name}}</p>" || substitutions["{{html_name}}"] != "&lt;b&gt;Unknown&lt;/b&gt;" {
+		t.Error("failed testing send batch sendgrid", unknown)
+	}
+
+	// 1000 recipients per request, the failure of a request skips the next ones
+	var many []Recipient
+	for i := 0; i < 2500; i++ {
+		many = append(many, Recipient{Address: mail.Address{Address: fmt.Sprintf("rcpt%d@mail.com", i)}})
+	}
+	result, err = mailer.SendBatch(context.Background(), batchTemplate, many)
+	var partialErr *PartialFailureError
+	if !errors.As(err, &partialErr) || len(partialErr.Sent) != 1000 || len(requests) != 3 {
+		t.Fatal("failed testing send batch sendgrid", err)
+	}
+	if result.Recipients[999].MessageID != "id-2" || result.Recipients[1000].Status != RecipientRejected || result.Recipients[1000].Err.StatusCode != 503 ||
+		result.Recipients[2000].Status != RecipientSkipped || result.Recipients[2000].Err != result.Recipients[1000].Err {
+		t.Error("failed testing send batch sendgrid")
+	}
+
+	// the dynamic template gets the values as dynamic_template_data, without the message's content
+	requests = nil
+	mailer = NewMailer(initiateSendGrid(&SendGridConfig{Host: server.URL, Endpoint: "/v3/mail/send", ApiKey: "test-api-key", DynamicTemplateID: "d-123"}))
+	_, err = mailer.SendBatch(context.Background(), batchTemplate, batchRecipients)
+	if err != nil || len(requests) != 1 || requests[0]["template_id"] != "d-123" || requests[0]["content"] != nil || requests[0]["subject"] != nil {
+		t.Fatal("failed testing send batch sendgrid", err)
+	}
+	personalizations = requests[0]["personalizations"].([]interface{})
+	data := personalizations[0].(map[string]interface{})["dynamic_template_data"].(map[string]interface{})
+	if len(personalizations) != 3 || data["name"] != "Ali" || data["code"] != "A1" || personalizations[0].(map[string]interface{})["substitutions"] != nil {
+		t.Error("failed testing send batch sendgrid", personalizations)
+	}
+}
+
+func TestSendBatchMailGun(t *testing.T) {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		form = r.MultipartForm.Value
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"<batch@mail.com>","message":"Queued. Thank you."}`))
+	}))
+	defer server.Close()
+	mailer := NewMailer(initiateMailGun(&MailGunConfig{Domain: "mail.com", APIKey: "test-api-key", APIBase: server.URL + "/v3"}))
+	result, err := mailer.SendBatch(context.Background(), batchTemplate, batchRecipients)
+	if err != nil || len(result.Accepted()) != 3 || result.Recipients[0].MessageID != "<batch@mail.com>" {
+		t.Fatal("failed testing send batch mailgun", err)
+	}
+	if len(form["to"]) != 3 || form["to"][0] != `"Ali" <ali@mail.com>` || form["subject"][0] != "Hello %recipient.text_name%" ||
+		form["text"][0] != "Dear %recipient.text_name%, your code is %recipient.text_code%" || form["html"][0] != "<p>Dear %recipient.html_name%</p>" {
+		t.Error("failed testing send batch mailgun", form)
+	}
+	var vars map[string]map[string]string
+	err = json.Unmarshal([]byte(form["recipient-variables"][0]), &vars)
+	unknownVars := vars["<unknown@mail.com>"]
+	if err != nil || vars[`"Ali" <ali@mail.com>`]["text_code"] != "A1" || unknownVars["text_code"] != "" || vars["<sara@mail.com>"]["text_name"] != "Sara" ||
+		unknownVars["text_name"] != "<b>Unknown</b>" || unknownVars["html_name"] != "&lt;b&gt;Unknown&lt;/b&gt;" {
+		t.Error("failed testing send batch mailgun", form["recipient-variables"], err)
+	}
+}
+
+func TestSendBatchSparkPost(t *testing.T) {
+	var transmission struct {
+		Recipients []struct {
+			Address          map[string]string `json:"address"`
+			SubstitutionData map[string]string `json:"substitution_data"`
+		} `json:"recipients"`
+		Content struct {
+			Subject string `json:"subject"`
+			Text    string `json:"text"`
+			HTML    string `json:"html"`
+		} `json:"content"`
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&transmission)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":{"id":"123","total_accepted_recipients":3,"total_rejected_recipients":0}}`))
+	}))
+	defer server.Close()
+	sDriver := initiateSparkPost(&SparkPostConfig{BaseUrl: server.URL, ApiKey: "test-api-key", ApiVersion: 1})
+	sDriver.httpClient = server.Client()
+	result, err := NewMailer(sDriver).SendBatch(context.Background(), batchTemplate, batchRecipients)
+	if err != nil || len(result.Accepted()) != 3 || result.Recipients[1].MessageID != "123" {
+		t.Fatal("failed testing send batch sparkpost", err)
+	}
+	// sparkpost escapes the values of the {{name}} placeholders in the html body
+	if transmission.Content.Subject != "Hello {{name}}" || transmission.Content.Text != "Dear {{name}}, your code is {{code}}" ||
+		transmission.Content.HTML != "<p>Dear {{name}}</p>" || len(transmission.Recipients) != 3 {
+		t.Fatal("failed testing send batch sparkpost", transmission)
+	}
+	ali := transmission.Recipients[0]
+	if ali.Address["email"] != "ali@mail.com" || ali.Address["name"] != "Ali" || ali.SubstitutionData["code"] != "A1" || transmission.Recipients[1].SubstitutionData["code"] != "" {
+		t.Error("failed testing send batch sparkpost", ali)
+	}
+}
+
+func TestPersonalize(t *testing.T) {
+	msg := personalize(&Message{
+		Subject:       "{{name}} {{ name }} {{missing}} {{not a placeholder}}",
+		HTMLBody:      "<p>{{name}}</p>",
+		PlainTextBody: "{{name}}",
+	}, Recipient{Address: mail.Address{Address: "to@mail.com"}, Vars: map[string]string{"name": "Ali <script>"}})
+	if msg.Subject != "Ali <script> Ali <script>  {{not a placeholder}}" || msg.HTMLBody != "<p>Ali &lt;script&gt;</p>" || msg.PlainTextBody != "Ali <script>" ||
+		len(msg.To) != 1 || msg.To[0].Address != "to@mail.com" {
+		t.Error("failed testing personalize", msg.Subject)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DKIMConfig signs the emails sent by the smtp driver with DKIM, the headers
+// and the body are canonicalized with relaxed/relaxed
+type DKIMConfig struct {
+	Domain     string   // the signing domain (d=), usually the domain of the sender
+	Selector   string   // the selector (s=) of the DNS record with the public key, <selector>._domainkey.<domain>
+	PrivateKey []byte   // the PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key
+	Headers    []string // the headers to sign, defaults to DefaultDKIMHeaders, From is always signed
+}
+
+// DefaultDKIMHeaders are the headers signed when DKIMConfig.Headers is empty, the
+// headers the email doesn't have are signed too, so they can't be added on the way
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"MIME-Version", "Content-Type", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// dkimSigner adds the DKIM-Signature header to the built messages
+type dkimSigner struct {
+	domain    string
+	selector  string
+	headers   []string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+func newDKIMSigner(conf *DKIMConfig) (*dkimSigner, error) {
+	if conf.Domain == "" || conf.Selector == "" {
+		return nil, errors.New("mailing: DKIM needs the domain and the selector")
+	}
+	key, algorithm, err := parseDKIMPrivateKey(conf.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	headers := conf.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	var hasFrom bool
+	for _, v := range headers {
+		hasFrom = hasFrom || strings.EqualFold(v, "From")
+	}
+	if !hasFrom {
+		headers = append([]string{"From"}, headers...)
+	}
+	return &dkimSigner{
+		domain:    conf.Domain,
+		selector:  conf.Selector,
+		headers:   headers,
+		key:       key,
+		algorithm: algorithm,
+		now:       time.Now,
+	}, nil
+}
+
+// parse the PEM encoded private key, it returns the key and the name of its DKIM algorithm
+func parseDKIMPrivateKey(privateKey []byte) (crypto.Signer, string, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, "", errors.New("mailing: the DKIM private key isn't PEM encoded")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("mailing: invalid DKIM private key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return k, "ed25519-sha256", nil
+	}
+	return nil, "", fmt.Errorf("mailing: unsupported DKIM private key type %T", key)
+}
+
+// sign the message and return it with the DKIM-Signature header first,
+// the line breaks are normalized to CRLF as they are sent
+func (s *dkimSigner) sign(message []byte) ([]byte, error) {
+	message = normalizeLineBreaks(message)
+	header, body, _ := bytes.Cut(message, []byte("\r\n\r\n"))
+	fields := splitHeaderFields(string(header))
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	var names []string
+	for _, v := range s.headers {
+		names = append(names, strings.ToLower(v))
+	}
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algorithm, s.domain, s.selector, s.now().Unix(), strings.Join(names, ": "), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// every listed header signs the next instance from the bottom, a header the message doesn't have signs nothing
+	var signed strings.Builder
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if !used[i] && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				used[i] = true
+				signed.WriteString(relaxedHeader(fields[i]))
+				break
+			}
+		}
+	}
+	signed.WriteString(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+value), "\r\n"))
+
+	hash := sha256.Sum256([]byte(signed.String()))
+	var signature []byte
+	var err error
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		// Ed25519 signs the hash itself, as RFC 8463 asks
+		signature, err = s.key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		signature, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	writeHeader(buf, "DKIM-Signature", value+base64.StdEncoding.EncodeToString(signature))
+	buf.Write(message)
+	return buf.Bytes(), nil
+}
+
+// the header fields of the header block, each with its folded lines
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// the relaxed canonical form of a header field: the name in lower case, the value
+// unfolded with its whitespace runs reduced to a single space and trimmed
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// the relaxed canonical form of the body: the whitespace runs of every line reduced to
+// a single space, the trailing whitespace and the empty lines at the end removed
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	var canonical strings.Builder
+	var emptyLines int
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			emptyLines++
+			continue
+		}
+		canonical.WriteString(strings.Repeat("\r\n", emptyLines))
+		emptyLines = 0
+		if isWSP(rune(line[0])) {
+			canonical.WriteString(" ")
+		}
+		canonical.WriteString(strings.Join(strings.FieldsFunc(line, isWSP), " "))
+		canonical.WriteString("\r\n")
+	}
+	return []byte(canonical.String())
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// replace the bare line feeds with CRLF
+func normalizeLineBreaks(message []byte) []byte {
+	if !bytes.Contains(message, []byte("\n")) {
+		return message
+	}
+	normalized := bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,225 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	// the example of RFC 6376 section 3.4.5
+	fields := splitHeaderFields("A: X\r\nB : Y\t\r\n\tZ  ")
+	if len(fields) != 2 || relaxedHeader(fields[0])+relaxedHeader(fields[1]) != "a:X\r\nb:Y Z\r\n" {
+		t.Error("failed testing dkim relaxed canonicalization")
+	}
+	if string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))) != " C\r\nD E\r\n" {
+		t.Error("failed testing dkim relaxed canonicalization")
+	}
+	if string(relaxedBody([]byte("\r\n\r\n"))) != "" || string(relaxedBody([]byte("no line break"))) != "no line break\r\n" {
+		t.Error("failed testing dkim relaxed canonicalization")
+	}
+}
+
+func TestDKIMVerifyRFC8463Example(t *testing.T) {
+	// the Ed25519 signed example of RFC 8463 appendix A
+	message := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+	publicKey, _ := base64.StdEncoding.DecodeString("11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=")
+	err := verifyTestDKIM([]byte(message), ed25519.PublicKey(publicKey))
+	if err != nil {
+		t.Error("failed testing dkim rfc 8463 example", err)
+	}
+	err = verifyTestDKIM([]byte(strings.Replace(message, "Is dinner ready?", "Is lunch ready?", 1)), ed25519.PublicKey(publicKey))
+	if err == nil {
+		t.Error("failed testing dkim rfc 8463 example")
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	tests := []struct {
+		pemType   string
+		der       []byte
+		publicKey interface{}
+		algorithm string
+	}{
+		{"RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), &rsaKey.PublicKey, "rsa-sha256"},
+		{"PRIVATE KEY", pkcs8RSA, &rsaKey.PublicKey, "rsa-sha256"},
+		{"PRIVATE KEY", pkcs8Ed, edPublic, "ed25519-sha256"},
+	}
+	message, err := buildMessage(&Message{
+		From:          mail.Address{Name: "from name", Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "the subject",
+		PlainTextBody: "this is plain text body\nwith a bare line feed  and   spaces  \n\n",
+	})
+	if err != nil {
+		t.Fatal("failed testing dkim sign", err)
+	}
+	for _, test := range tests {
+		signer, err := newDKIMSigner(&DKIMConfig{
+			Domain:     "mail.com",
+			Selector:   "default",
+			PrivateKey: pem.EncodeToMemory(&pem.Block{Type: test.pemType, Bytes: test.der}),
+			Headers:    []string{"Subject", "To"},
+		})
+		if err != nil {
+			t.Fatal("failed testing dkim sign", err)
+		}
+		signer.now = func() time.Time { return time.Unix(1682937000, 0) }
+		signed, err := signer.sign(message)
+		if err != nil {
+			t.Fatal("failed testing dkim sign", err)
+		}
+		header, _, _ := bytes.Cut(signed, []byte("\r\n\r\n"))
+		dkimHeader := splitHeaderFields(string(header))[0]
+		if !strings.HasPrefix(strings.ReplaceAll(dkimHeader, "\r\n", ""), "DKIM-Signature: v=1; a="+test.algorithm+"; c=relaxed/relaxed; d=mail.com; s=default; t=1682937000; h=from: subject: to; ") {
+			t.Errorf("failed testing dkim sign %s", test.algorithm)
+		}
+		for _, line := range strings.Split(dkimHeader, "\r\n") {
+			if len(line) > maxHeaderLineLength && !strings.HasPrefix(strings.TrimSpace(line), "b=") {
+				t.Errorf("failed testing dkim sign %s, line too long: %s", test.algorithm, line)
+			}
+		}
+		if bytes.Contains(bytes.ReplaceAll(signed, []byte("\r\n"), nil), []byte("\n")) {
+			t.Errorf("failed testing dkim sign %s, bare line feed", test.algorithm)
+		}
+		err = verifyTestDKIM(signed, test.publicKey)
+		if err != nil {
+			t.Errorf("failed testing dkim sign %s: %v", test.algorithm, err)
+		}
+		// headers that aren't signed can change, the signed ones can't
+		err = verifyTestDKIM(bytes.Replace(signed, []byte("Message-ID: <"), []byte("Message-ID: <changed"), 1), test.publicKey)
+		if err != nil {
+			t.Errorf("failed testing dkim sign %s: %v", test.algorithm, err)
+		}
+		err = verifyTestDKIM(bytes.Replace(signed, []byte("Subject: the subject"), []byte("Subject: another subject"), 1), test.publicKey)
+		if err == nil {
+			t.Errorf("failed testing dkim sign %s", test.algorithm)
+		}
+	}
+
+	_, err = newDKIMSigner(&DKIMConfig{Domain: "mail.com", Selector: "default", PrivateKey: []byte("not a pem key")})
+	if err == nil {
+		t.Error("failed testing dkim sign")
+	}
+	_, err = newDKIMSigner(&DKIMConfig{PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed})})
+	if err == nil {
+		t.Error("failed testing dkim sign")
+	}
+}
+
+func TestSMTPDriverDKIM(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	server := newTestSMTPServer(t, nil)
+	config := server.config(SMTPEncryptionNone)
+	config.DKIM = &DKIMConfig{
+		Domain:     "mail.com",
+		Selector:   "default",
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed}),
+	}
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "the subject",
+		PlainTextBody: "this is plain text body",
+	}
+	err := initiateSMTP(config).SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing smtp dkim", err)
+	}
+	mails := server.sentMails()
+	if len(mails) != 1 || !strings.HasPrefix(mails[0].data, "DKIM-Signature: v=1; a=ed25519-sha256;") {
+		t.Fatal("failed testing smtp dkim")
+	}
+	err = verifyTestDKIM(normalizeLineBreaks([]byte(mails[0].data)), edKey.Public())
+	if err != nil {
+		t.Error("failed testing smtp dkim", err)
+	}
+
+	// an invalid key fails every sending before connecting
+	config.DKIM = &DKIMConfig{Domain: "mail.com", Selector: "default", PrivateKey: []byte("not a pem key")}
+	err = initiateSMTP(config).SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageBuild || server.openedConnections() != 1 {
+		t.Error("failed testing smtp dkim")
+	}
+}
+
+// verify the first DKIM-Signature of the message with the public key, as a receiving server does
+func verifyTestDKIM(message []byte, publicKey interface{}) error {
+	header, body, _ := bytes.Cut(message, []byte("\r\n\r\n"))
+	fields := splitHeaderFields(string(header))
+	tags := map[string]string{}
+	_, value, _ := strings.Cut(fields[0], ":")
+	for _, v := range strings.Split(value, ";") {
+		name, tagValue, _ := strings.Cut(v, "=")
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(tagValue), "")
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("the body hash doesn't match")
+	}
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if !used[i] && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				used[i] = true
+				signed.WriteString(relaxedHeader(fields[i]))
+				break
+			}
+		}
+	}
+	withoutSignature := regexp.MustCompile(`(^|;)(\s*)b=[^;]*`).ReplaceAllString(fields[0], "$1${2}b=")
+	signed.WriteString(strings.TrimSuffix(relaxedHeader(withoutSignature), "\r\n"))
+	hash := sha256.Sum256([]byte(signed.String()))
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hash[:], signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	}
+	return errors.New("unsupported key")
+}
@@ -0,0 +1,248 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the names of the drivers as reported in the errors
+const (
+	DriverSMTP      = "smtp"
+	DriverSendGrid  = "sendgrid"
+	DriverMailGun   = "mailgun"
+	DriverSparkPost = "sparkpost"
+	DriverSES       = "ses"
+	DriverPostmark  = "postmark"
+)
+
+// SendStage is the step of the sending where an error happened
+type SendStage string
+
+const (
+	StageBuild     SendStage = "build"      // preparing the message, ex: reading the attachments
+	StageDial      SendStage = "dial"       // connecting to the server
+	StageTLS       SendStage = "tls"        // smtp STARTTLS upgrade
+	StageAuth      SendStage = "auth"       // smtp authentication
+	StageMail      SendStage = "mail"       // smtp MAIL FROM command
+	StageRcpt      SendStage = "rcpt"       // smtp RCPT TO command
+	StageData      SendStage = "data"       // smtp DATA command and the message transfer
+	StageHTTP      SendStage = "http"       // the request to the provider's api
+	StageSend      SendStage = "send"       // any other step
+	StageRateLimit SendStage = "rate limit" // waiting for the client-side rate limit
+)
+
+// SendError is returned by the drivers when sending fails,
+// the original error is kept so errors.Is and errors.As work on it
+type SendError struct {
+	Driver       string        // the name of the driver, ex: smtp, sendgrid, empty when the mailer failed before using the driver
+	Stage        SendStage     // where the sending failed
+	SMTPCode     int           // the smtp reply code, zero when there is no smtp reply
+	EnhancedCode string        // the smtp enhanced status code if the server sent one, ex: 5.1.1
+	StatusCode   int           // the http status code, zero when there is no http response
+	Body         string        // the error returned by the provider
+	RetryAfter   time.Duration // how long the provider asked to wait before trying again, zero when it didn't
+	Err          error         // the underlying error
+}
+
+func (e *SendError) Error() string {
+	var details []string
+	if e.SMTPCode != 0 {
+		details = append(details, fmt.Sprintf("smtp code %d", e.SMTPCode))
+	}
+	if e.StatusCode != 0 {
+		details = append(details, fmt.Sprintf("http status %d", e.StatusCode))
+	}
+	msg := fmt.Sprintf("%s driver failed at %s", e.Driver, e.Stage)
+	if e.Driver == "" {
+		msg = fmt.Sprintf("mailer failed at %s", e.Stage)
+	}
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+	switch {
+	case e.SMTPCode != 0 && e.Body != "":
+		msg += ": " + e.Body
+	case e.Err != nil:
+		msg += ": " + e.Err.Error()
+	case e.Body != "":
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the server asked to try again later,
+// like an smtp 4xx reply, an http 429 or 5xx status, or a network timeout
+func (e *SendError) Temporary() bool {
+	if e.SMTPCode != 0 {
+		return e.SMTPCode >= 400 && e.SMTPCode < 500
+	}
+	if e.StatusCode != 0 {
+		return e.StatusCode == 408 || e.StatusCode == 429 || e.StatusCode >= 500
+	}
+	if isContextError(e.Err) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// Retryable reports whether sending the same email again may succeed, it's true for temporary errors,
+// for network failures that happened before the server answered, and for the client-side rate limit
+func (e *SendError) Retryable() bool {
+	if e.Temporary() {
+		return true
+	}
+	if e.Stage == StageRateLimit {
+		return errors.Is(e.Err, ErrRateLimited)
+	}
+	if e.SMTPCode != 0 || e.StatusCode != 0 || isContextError(e.Err) {
+		return false
+	}
+	var netErr net.Error
+	return e.Stage == StageDial || errors.As(e.Err, &netErr)
+}
+
+// Permanent reports whether the email itself was rejected, like an invalid message or a rejected
+// recipient, so sending it again or with another driver would fail the same way
+func (e *SendError) Permanent() bool {
+	switch {
+	case e.Stage == StageBuild:
+		return true
+	case e.SMTPCode >= 500:
+		return e.Stage == StageMail || e.Stage == StageRcpt || e.Stage == StageData
+	case e.StatusCode != 0:
+		return e.StatusCode == 400 || e.StatusCode == 413 || e.StatusCode == 422
+	}
+	return false
+}
+
+// RecipientError is the failure of sending to a single recipient
+type RecipientError struct {
+	Address string
+	Err     *SendError
+}
+
+// PartialFailureError is returned when some of the recipients were refused,
+// the email was still sent to the other recipients
+type PartialFailureError struct {
+	Sent   []string         // the recipients who were sent the email
+	Failed []RecipientError // the refused recipients
+}
+
+func (e *PartialFailureError) Error() string {
+	var failures []string
+	for _, v := range e.Failed {
+		failures = append(failures, v.Address+": "+v.Err.Error())
+	}
+	return fmt.Sprintf("the email was sent to %d of %d recipients, %s", len(e.Sent), len(e.Sent)+len(e.Failed), strings.Join(failures, "; "))
+}
+
+func (e *PartialFailureError) Unwrap() []error {
+	var errs []error
+	for _, v := range e.Failed {
+		errs = append(errs, v.Err)
+	}
+	return errs
+}
+
+// whether the error only holds permanent failures
+func isPermanent(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && findSendError(err, func(e *SendError) bool { return !e.Permanent() }) == nil
+}
+
+// the first *SendError in the error's tree that matches, like errors.As but
+// looking further when the first one found doesn't match
+func findSendError(err error, match func(e *SendError) bool) *SendError {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *SendError:
+		if match(e) {
+			return e
+		}
+		return nil
+	case interface{ Unwrap() []error }:
+		for _, v := range e.Unwrap() {
+			if found := findSendError(v, match); found != nil {
+				return found
+			}
+		}
+		return nil
+	case interface{ Unwrap() error }:
+		return findSendError(e.Unwrap(), match)
+	}
+	return nil
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+var enhancedCodeRegexp = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// create the error of a failed smtp step, the reply code and the enhanced status code are
+// taken from the server's reply when there is one
+func newSMTPError(stage SendStage, err error) *SendError {
+	sendErr := &SendError{Driver: DriverSMTP, Stage: stage, Err: err}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		sendErr.SMTPCode = tpErr.Code
+		sendErr.EnhancedCode = enhancedCodeRegexp.FindString(tpErr.Msg)
+		sendErr.Body = tpErr.Msg
+	}
+	return sendErr
+}
+
+// create the error of a provider's api that responded with an unsuccessful status
+func newHTTPError(driver string, statusCode int, body string, err error) *SendError {
+	return &SendError{Driver: driver, Stage: StageHTTP, StatusCode: statusCode, Body: body, Err: err}
+}
+
+// make sure the error returned by a driver is a *SendError, errors from the
+// send hooks that are not are wrapped with the given stage
+func asSendError(driver string, stage SendStage, err error) error {
+	if err == nil {
+		return nil
+	}
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return err
+	}
+	return &SendError{Driver: driver, Stage: stage, Err: err}
+}
+
+// parse the value of the Retry-After header, it's either a number of seconds or an http date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
@@ -0,0 +1,100 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSendErrorClassification(t *testing.T) {
+	cases := []struct {
+		err       *SendError
+		temporary bool
+		retryable bool
+		permanent bool
+	}{
+		{&SendError{Driver: DriverSMTP, Stage: StageRcpt, SMTPCode: 450}, true, true, false},
+		{&SendError{Driver: DriverSMTP, Stage: StageRcpt, SMTPCode: 550}, false, false, true},
+		{&SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 429}, true, true, false},
+		{&SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 503}, true, true, false},
+		{&SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 400}, false, false, true},
+		{&SendError{Driver: DriverSMTP, Stage: StageDial, Err: errors.New("connection refused")}, false, true, false},
+		{&SendError{Driver: DriverSES, Stage: StageHTTP, Err: &net.OpError{Op: "read", Err: timeoutError{}}}, true, true, false},
+		{&SendError{Driver: DriverSES, Stage: StageHTTP, Err: context.Canceled}, false, false, false},
+		{&SendError{Driver: DriverSMTP, Stage: StageDial, Err: fmt.Errorf("%w: dial failed", context.DeadlineExceeded)}, false, false, false},
+		{&SendError{Driver: DriverSMTP, Stage: StageBuild, Err: errors.New("file not found")}, false, false, true},
+		{&SendError{Driver: DriverSMTP, Stage: StageAuth, SMTPCode: 535}, false, false, false},
+		{&SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 401}, false, false, false},
+	}
+	for i, c := range cases {
+		if c.err.Temporary() != c.temporary {
+			t.Errorf("failed testing send error classification, case %d temporary", i)
+		}
+		if c.err.Retryable() != c.retryable {
+			t.Errorf("failed testing send error classification, case %d retryable", i)
+		}
+		if c.err.Permanent() != c.permanent {
+			t.Errorf("failed testing send error classification, case %d permanent", i)
+		}
+	}
+}
+
+func TestNewSMTPError(t *testing.T) {
+	err := newSMTPError(StageRcpt, &textproto.Error{Code: 550, Msg: "5.1.1 <to@mail.com>: Recipient address rejected"})
+	if err.SMTPCode != 550 || err.EnhancedCode != "5.1.1" || err.Stage != StageRcpt || err.Driver != DriverSMTP {
+		t.Error("failed testing new smtp error")
+	}
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		t.Error("failed testing new smtp error")
+	}
+	if err.Error() != "smtp driver failed at rcpt (smtp code 550): 5.1.1 <to@mail.com>: Recipient address rejected" {
+		t.Error("failed testing new smtp error")
+	}
+	err = newSMTPError(StageData, &textproto.Error{Code: 451, Msg: "Requested action aborted"})
+	if err.SMTPCode != 451 || err.EnhancedCode != "" || !err.Temporary() {
+		t.Error("failed testing new smtp error")
+	}
+}
+
+func TestAsSendError(t *testing.T) {
+	if asSendError(DriverSMTP, StageSend, nil) != nil {
+		t.Error("failed testing as send error")
+	}
+	original := &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 500}
+	if asSendError(DriverSMTP, StageSend, original) != error(original) {
+		t.Error("failed testing as send error")
+	}
+	plain := errors.New("this is a test error")
+	var sendErr *SendError
+	err := asSendError(DriverSMTP, StageSend, plain)
+	if !errors.As(err, &sendErr) || sendErr.Driver != DriverSMTP || !errors.Is(err, plain) {
+		t.Error("failed testing as send error")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	if parseRetryAfter("120", now) != 2*time.Minute {
+		t.Error("failed testing parse retry after")
+	}
+	if parseRetryAfter("Mon, 01 May 2023 12:00:30 GMT", now) != 30*time.Second {
+		t.Error("failed testing parse retry after")
+	}
+	if parseRetryAfter("", now) != 0 || parseRetryAfter("-1", now) != 0 || parseRetryAfter("soon", now) != 0 {
+		t.Error("failed testing parse retry after")
+	}
+	if parseRetryAfter("Mon, 01 May 2023 11:00:00 GMT", now) != 0 {
+		t.Error("failed testing parse retry after")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoDriverAvailable is returned by the failover driver when the circuit breakers of all its drivers are open
+var ErrNoDriverAvailable = errors.New("mailing: no driver is available")
+
+const (
+	defaultFailureThreshold = 3
+	defaultCoolDown         = 30 * time.Second
+)
+
+// FailoverDriver sends the email with the first of its drivers that succeeds, every driver has a circuit
+// breaker that skips it for a cool-down period after a number of consecutive failures
+type FailoverDriver struct {
+	FailureThreshold int                                   // consecutive failures that open the driver's circuit, defaults to 3
+	CoolDown         time.Duration                         // how long a driver with an open circuit is skipped, defaults to 30s
+	OnDelivered      func(driverName string, msg *Message) // optional, called with the name of the driver that sent the email
+
+	drivers []*breakerDriver
+	now     func() time.Time
+}
+
+// a driver with the state of its circuit breaker
+type breakerDriver struct {
+	driver    Driver
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// FailoverError is returned by the failover driver when no driver could send the email,
+// it holds the error of every driver that was tried, in order
+type FailoverError struct {
+	Errors []error
+}
+
+func (e *FailoverError) Error() string {
+	var msgs []string
+	for _, v := range e.Errors {
+		msgs = append(msgs, v.Error())
+	}
+	return "all the drivers failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *FailoverError) Unwrap() []error {
+	return e.Errors
+}
+
+// Initiate the failover driver, the drivers are tried in the given order
+func NewFailoverDriver(drivers ...Driver) *FailoverDriver {
+	f := &FailoverDriver{now: time.Now}
+	for _, v := range drivers {
+		f.drivers = append(f.drivers, &breakerDriver{driver: v})
+	}
+	return f
+}
+
+// Name of the driver as reported in the errors
+func (f *FailoverDriver) Name() string {
+	return "failover"
+}
+
+// Close the drivers that hold resources, like the pooled smtp connections
+func (f *FailoverDriver) Close() error {
+	var errs []error
+	for _, v := range f.drivers {
+		if closer, ok := v.driver.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *FailoverDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// readers can only be read once and the recipients who got the email from
+	// a failing driver must not get it again from the next one
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Stage: StageBuild, Err: err}
+	}
+	if msg.results == nil {
+		msg = msg.Clone()
+		msg.results = &resultLog{}
+	}
+
+	var errs []error
+	for _, v := range f.drivers {
+		if !v.available(f.now()) {
+			continue
+		}
+		err = v.driver.SendMessage(ctx, msg)
+		if err == nil {
+			v.succeeded()
+			if f.OnDelivered != nil {
+				f.OnDelivered(driverName(v.driver), msg)
+			}
+			return nil
+		}
+		errs = append(errs, err)
+		if isContextError(err) || ctx.Err() != nil || isPermanent(err) {
+			// the email is rejected or the sending is cancelled, the next drivers would fail the same way
+			break
+		}
+		// a driver out of its client-side rate limit is busy, not failing
+		if findSendError(err, func(e *SendError) bool { return e.Stage == StageRateLimit }) == nil {
+			v.failed(f.now(), f.threshold(), f.coolDown())
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return ErrNoDriverAvailable
+	case 1:
+		return errs[0]
+	}
+	return &FailoverError{Errors: errs}
+}
+
+func (f *FailoverDriver) threshold() int {
+	if f.FailureThreshold <= 0 {
+		return defaultFailureThreshold
+	}
+	return f.FailureThreshold
+}
+
+func (f *FailoverDriver) coolDown() time.Duration {
+	if f.CoolDown <= 0 {
+		return defaultCoolDown
+	}
+	return f.CoolDown
+}
+
+// whether the driver's circuit is closed, or open with the cool-down over so the driver can be tried again
+func (b *breakerDriver) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.openUntil)
+}
+
+func (b *breakerDriver) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// count the failure, the circuit opens once the failures reach the threshold,
+// and opens again on the first failure after the cool-down
+func (b *breakerDriver) failed(now time.Time, threshold int, coolDown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = now.Add(coolDown)
+	}
+}
+
+// the name of the driver, taken from its Name() method when it has one
+func driverName(d Driver) string {
+	if named, ok := d.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", d)
+}
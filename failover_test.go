@@ -0,0 +1,128 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+type namedDriver struct {
+	name string
+	send func(ctx context.Context, msg *Message) error
+	sent int
+}
+
+func (d *namedDriver) Name() string {
+	return d.name
+}
+
+func (d *namedDriver) SendMessage(ctx context.Context, msg *Message) error {
+	d.sent++
+	return d.send(ctx, msg)
+}
+
+func TestFailoverDriver(t *testing.T) {
+	failing := &namedDriver{name: "first", send: func(ctx context.Context, msg *Message) error {
+		return &SendError{Driver: "first", Stage: StageHTTP, StatusCode: 503}
+	}}
+	working := &namedDriver{name: "second", send: func(ctx context.Context, msg *Message) error {
+		return nil
+	}}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	fDriver := NewFailoverDriver(failing, working)
+	fDriver.FailureThreshold = 2
+	fDriver.CoolDown = time.Minute
+	fDriver.now = func() time.Time { return now }
+	var deliveredBy []string
+	fDriver.OnDelivered = func(driverName string, msg *Message) {
+		deliveredBy = append(deliveredBy, driverName)
+	}
+	msg := &Message{From: mail.Address{Address: "from@mail.com"}, To: []mail.Address{{Address: "to@mail.com"}}}
+	for i := 0; i < 3; i++ {
+		err := fDriver.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatal("failed testing failover driver", err)
+		}
+	}
+	// the circuit of the failing driver opens after two failures
+	if failing.sent != 2 || working.sent != 3 || strings.Join(deliveredBy, ",") != "second,second,second" {
+		t.Error("failed testing failover driver")
+	}
+	// and closes again after the cool-down
+	now = now.Add(time.Minute)
+	fDriver.SendMessage(context.Background(), msg)
+	if failing.sent != 3 {
+		t.Error("failed testing failover driver")
+	}
+	fDriver.SendMessage(context.Background(), msg)
+	if failing.sent != 3 {
+		t.Error("failed testing failover driver")
+	}
+
+	// permanent errors don't fail over
+	rejecting := &namedDriver{name: "rejecting", send: func(ctx context.Context, msg *Message) error {
+		return &SendError{Driver: "rejecting", Stage: StageRcpt, SMTPCode: 550}
+	}}
+	working.sent = 0
+	err := NewFailoverDriver(rejecting, working).SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.SMTPCode != 550 || working.sent != 0 {
+		t.Error("failed testing failover driver")
+	}
+
+	// every error is reported when all the drivers fail
+	err = NewFailoverDriver(failing, failing).SendMessage(context.Background(), msg)
+	var failoverErr *FailoverError
+	if !errors.As(err, &failoverErr) || len(failoverErr.Errors) != 2 || !errors.As(err, &sendErr) || sendErr.StatusCode != 503 {
+		t.Error("failed testing failover driver")
+	}
+
+	fDriver = NewFailoverDriver(failing)
+	fDriver.FailureThreshold = 1
+	fDriver.SendMessage(context.Background(), msg)
+	err = fDriver.SendMessage(context.Background(), msg)
+	if !errors.Is(err, ErrNoDriverAvailable) {
+		t.Error("failed testing failover driver")
+	}
+}
+
+func TestFailoverDriverDelivered(t *testing.T) {
+	// the recipients who got the email from a failing driver don't get it again from the next one
+	first := initiateSendGrid(&SendGridConfig{})
+	var firstSent, secondSent []string
+	first.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		if rcpts[0].Address == "bcc2@mail.com" {
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 500}
+		}
+		firstSent = append(firstSent, rcpts[0].Address)
+		return "", nil
+	}
+	second := initiateMailGun(&MailGunConfig{})
+	second.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		secondSent = append(secondSent, rcpts[0].Address)
+		return "", nil
+	}
+	var deliveredBy string
+	fDriver := NewFailoverDriver(first, second)
+	fDriver.OnDelivered = func(driverName string, msg *Message) {
+		deliveredBy = driverName
+	}
+	mailer := NewMailer(fDriver)
+	err := mailer.SendMessage(context.Background(), &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}, {Address: "bcc3@mail.com"}},
+	})
+	if err != nil {
+		t.Fatal("failed testing failover driver", err)
+	}
+	if strings.Join(firstSent, ",") != "to@mail.com,bcc1@mail.com" || strings.Join(secondSent, ",") != "bcc2@mail.com,bcc3@mail.com" {
+		t.Error("failed testing failover driver")
+	}
+	if deliveredBy != DriverMailGun {
+		t.Error("failed testing failover driver")
+	}
+}
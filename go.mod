@@ -6,6 +6,7 @@ require (
 	github.com/SparkPost/gosparkpost v0.2.0
 	github.com/google/uuid v1.3.0
 	github.com/mailgun/mailgun-go/v4 v4.10.0
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/sendgrid/sendgrid-go v3.12.0+incompatible
 )
 
@@ -5,9 +5,11 @@
 package mailing
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"fmt"
+	"io"
+	"net/http"
 	"net/mail"
 	"time"
 
@@ -15,149 +17,165 @@ import (
 )
 
 type MailGunConfig struct {
-	Domain              string // your-domain.com
-	APIKey              string // your api key
-	SkipTLSVerification bool   // (set true for development only!) // true means accepts any tls certificate sent by the domain without verification
+	Domain              string        // your-domain.com
+	APIKey              string        // your api key
+	SkipTLSVerification bool          // (set true for development only!) // true means accepts any tls certificate sent by the domain without verification
+	APIBase             string        // optional, defaults to https://api.mailgun.net/v3, use https://api.eu.mailgun.net/v3 for the EU region
+	Timeout             time.Duration // optional, the longest a request may take, defaults to 30s, the context's deadline applies as well
 }
 
+// the requests of the mailgun client have no deadline of their own, so one is always set
+const defaultMailGunTimeout = 30 * time.Second
+
 type MailGunDriver struct {
-	config         *MailGunConfig
-	messageBuilder *messageBuilder
-	from           mail.Address
-	toList         []mail.Address
-	ccList         []mail.Address
-	bccList        []mail.Address
-	subject        string
-	htmlBody       string
-	plainTextBody  string
-	attachments    []Attachment
-	initiateSend   func(from string, rcpts []string, message []byte, conf Driver) error
+	config       *MailGunConfig
+	initiateSend func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error)
 }
 
-var initiateMailGunSend = func(from string, rcpts []string, message []byte, d Driver) error {
+var initiateMailGunSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
 	mgDriver := d.(*MailGunDriver)
-	mg := mailgun.NewMailgun(mgDriver.config.Domain, mgDriver.config.APIKey)
-	var m *mailgun.Message
-	if mgDriver.htmlBody != "" {
-		m = mg.NewMessage(
-			from,
-			mgDriver.subject,
-			"",
-			rcpts...,
-		)
-		m.SetHtml(mgDriver.htmlBody)
-	} else {
-		m = mg.NewMessage(
-			from,
-			mgDriver.subject,
-			mgDriver.plainTextBody,
-			rcpts...,
-		)
+	mg := mgDriver.client()
+	var to []string
+	for _, v := range rcpts {
+		to = append(to, v.String())
+	}
+	m, err := newMailGunMessage(mg, msg, to)
+	if err != nil {
+		return "", err
+	}
+	return mgDriver.send(ctx, mg, m)
+}
+
+// the api client of the driver's configuration
+func (m *MailGunDriver) client() *mailgun.MailgunImpl {
+	mg := mailgun.NewMailgun(m.config.Domain, m.config.APIKey)
+	timeout := m.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultMailGunTimeout
+	}
+	mg.SetClient(&http.Client{Timeout: timeout})
+	if m.config.APIBase != "" {
+		mg.SetAPIBase(m.config.APIBase)
+	}
+	return mg
+}
+
+// the mailgun message of the message to the given recipients
+func newMailGunMessage(mg *mailgun.MailgunImpl, msg *Message, to []string) (*mailgun.Message, error) {
+	m := mg.NewMessage(
+		msg.From.String(),
+		msg.Subject,
+		msg.PlainTextBody,
+		to...,
+	)
+	if msg.HTMLBody != "" {
+		m.SetHtml(msg.HTMLBody)
 	}
-	if len(mgDriver.attachments) != 0 {
-		for _, v := range mgDriver.attachments {
-			m.AddAttachment(v.Path)
+	for _, v := range msg.Attachments {
+		content, err := v.readAll()
+		if err != nil {
+			return nil, &SendError{Driver: DriverMailGun, Stage: StageBuild, Err: err}
+		}
+		if v.ContentID != "" {
+			// mailgun references inline files by their file name
+			m.AddReaderInline(v.ContentID, io.NopCloser(bytes.NewReader(content)))
+		} else {
+			m.AddBufferAttachment(v.Name, content)
 		}
 	}
-	m.SetRequireTLS(true)
-	m.SetSkipVerification(mgDriver.config.SkipTLSVerification)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
-	_, _, err := mg.Send(ctx, m)
+	if len(msg.ReplyTo) > 0 {
+		m.SetReplyTo(formatAddressList(msg.ReplyTo))
+	}
+	for k, v := range msg.Headers {
+		m.AddHeader(k, v)
+	}
+	if msg.schedule != nil {
+		m.SetDeliveryTime(msg.schedule.at)
+	}
+	return m, nil
+}
+
+// send the message and return its id
+func (m *MailGunDriver) send(ctx context.Context, mg *mailgun.MailgunImpl, message *mailgun.Message) (string, error) {
+	message.SetRequireTLS(true)
+	message.SetSkipVerification(m.config.SkipTLSVerification)
+	_, id, err := mg.Send(ctx, message)
 	if err != nil {
-		return errors.New(fmt.Sprintf(" error calling mg.Send(): %v", err.Error()))
+		var resErr *mailgun.UnexpectedResponseError
+		if errors.As(err, &resErr) {
+			return "", newHTTPError(DriverMailGun, resErr.Actual, string(resErr.Data), err)
+		}
+		return "", &SendError{Driver: DriverMailGun, Stage: StageHTTP, Err: err}
 	}
-	return nil
+	return id, nil
 }
 
 func initiateMailGun(config *MailGunConfig) *MailGunDriver {
 	s := &MailGunDriver{
-		config:         config,
-		messageBuilder: newMessageBuilder(),
-		htmlBody:       "",
-		plainTextBody:  "",
-		initiateSend:   initiateMailGunSend,
+		config:       config,
+		initiateSend: initiateMailGunSend,
 	}
 
 	return s
 }
 
-func (m *MailGunDriver) SetFrom(from mail.Address) error {
-	m.from = from
-	return nil
+// Name of the driver as reported in the errors
+func (m *MailGunDriver) Name() string {
+	return DriverMailGun
 }
 
-func (m *MailGunDriver) SetTo(toList []mail.Address) error {
-	m.toList = toList
-	return nil
+func (m *MailGunDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// the message is sent once for "to" and "cc" and once for every bcc
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Driver: DriverMailGun, Stage: StageBuild, Err: err}
+	}
+	return sendPerBCC(ctx, DriverMailGun, msg, func(rcpts []mail.Address) (string, error) {
+		return m.initiateSend(ctx, msg, rcpts, m)
+	})
 }
 
-func (m *MailGunDriver) SetCC(ccList []mail.Address) error {
-	m.ccList = ccList
-	return nil
+// mailgun holds the messages up to 3 days
+func (m *MailGunDriver) maxScheduleDelay() time.Duration {
+	return 72 * time.Hour
 }
-func (m *MailGunDriver) SetBCC(bccList []mail.Address) error {
-	m.bccList = bccList
-	return nil
-}
-func (m *MailGunDriver) SetSubject(Subject string) error {
-	m.subject = Subject
-	return nil
-}
-func (m *MailGunDriver) SetHTMLBody(body string) error {
-	m.htmlBody = body
-	return nil
+
+// the message is sent with the o:deliverytime option
+func (m *MailGunDriver) schedule(ctx context.Context, msg *Message, at time.Time) (*Message, error) {
+	msg = msg.Clone()
+	msg.schedule = &messageSchedule{at: at}
+	return msg, nil
 }
-func (m *MailGunDriver) SetPlainTextBody(body string) error {
-	m.plainTextBody = body
-	return nil
+
+// mailgun can't cancel a single scheduled message
+func (m *MailGunDriver) cancelSchedule(ctx context.Context, msg *Message, result *SendResult) error {
+	return ErrScheduleNotCancellable
 }
-func (m *MailGunDriver) SetAttachments(attachments []Attachment) error {
-	m.attachments = attachments
-	return nil
+
+// mailgun takes up to 1000 recipients per message
+func (m *MailGunDriver) maxBatchSize() int {
+	return 1000
 }
 
-func (m *MailGunDriver) Send() error {
-	// prepare the message
-	m.messageBuilder.setSubject(m.subject)
-	if m.htmlBody != "" {
-		m.messageBuilder.setHTMLBody(m.htmlBody)
-	} else {
-		m.messageBuilder.setPlainTextBody(m.plainTextBody)
-	}
-	m.messageBuilder.setFrom(m.from)
-	m.messageBuilder.setToList(m.toList)
-	m.messageBuilder.setCCList(m.ccList)
-	m.messageBuilder.setAttachments(m.attachments)
-	message := m.messageBuilder.build()
-
-	// "to" and "cc" message sending
-	var rcpts []string
-	for _, v := range m.toList {
-		rcpts = append(rcpts, v.String())
-	}
-	for _, v := range m.ccList {
-		rcpts = append(rcpts, v.String())
-	}
-	from := m.from.String()
-	err := m.initiateSend(from, rcpts, message, m)
+// send a message with the recipient variables, mailgun sends every recipient their own message with
+// the %recipient.key% placeholders replaced with their values, the variables apply to every part, so
+// the html body has its own keys with the escaped values
+func (m *MailGunDriver) sendBatch(ctx context.Context, msg *Message, recipients []Recipient) (string, error) {
+	msg, names := rewritePlaceholders(msg, func(name string, html bool) string { return "%recipient." + placeholderKey(name, html) + "%" })
+	mg := m.client()
+	message, err := newMailGunMessage(mg, msg, nil)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling m.initiateSend(): %v", err.Error()))
+		return "", err
 	}
-
-	// send to bcc
-	for _, v := range m.bccList {
-		err = m.initiateSend(from, []string{v.String()}, message, m)
+	for _, v := range recipients {
+		vars := make(map[string]interface{})
+		for key, value := range escapedPlaceholderValues(names, v) {
+			vars[key] = value
+		}
+		err = message.AddRecipientAndVariables(v.Address.String(), vars)
 		if err != nil {
-			return errors.New(fmt.Sprintf("error calling m.initiateSend(): %v", err.Error()))
+			return "", &SendError{Driver: DriverMailGun, Stage: StageBuild, Err: err}
 		}
 	}
-	m.resetDriverProps()
-	return nil
-}
-
-func (m *MailGunDriver) resetDriverProps() {
-	m.subject = ""
-	m.htmlBody = ""
-	m.plainTextBody = ""
+	return m.send(ctx, mg, message)
 }
@@ -1,15 +1,15 @@
 package mailing
 
 import (
+	"context"
 	"errors"
-	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strings"
 	"testing"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 func TestMailGunDriverSend(t *testing.T) {
@@ -17,108 +17,157 @@ func TestMailGunDriverSend(t *testing.T) {
 		Domain: "localhost",    // your-domain.com
 		APIKey: "TEST-API-KEY", // your api key
 	})
-	tmpFilePath := filepath.Join(t.TempDir(), uuid.NewString())
-	mDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		file, err := os.Create(tmpFilePath)
-		if err != nil {
-			t.Error("faild test send")
-		}
-		file.Write(message)
-		file.Close()
-		return nil
+	var sentMessages []*Message
+	var sentRcpts [][]mail.Address
+	mDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		sentMessages = append(sentMessages, msg)
+		sentRcpts = append(sentRcpts, rcpts)
+		return "", nil
 	}
 
-	mDriver.SetFrom(mail.Address{
-		Name:    "test from name",
-		Address: "from@mail.com",
-	})
-	mDriver.SetTo([]mail.Address{
-		{Name: "test from name1", Address: "from1@mail.com"},
-		{Name: "test from name2", Address: "from2@mail.com"},
-	})
-	mDriver.SetCC([]mail.Address{
-		{Name: "test cc name1", Address: "cc1@mail.com"},
-		{Name: "test cc name2", Address: "cc2@mail.com"},
-	})
-	mDriver.SetBCC([]mail.Address{
-		{Name: "test bcc name1", Address: "bcc1@mail.com"},
-		{Name: "test bcc name2", Address: "bcc2@mail.com"},
-	})
-	mDriver.SetSubject("this is the subject")
-	mDriver.SetPlainTextBody("this is plain text body")
-	mDriver.SetHTMLBody("this is html body")
-	mDriver.SetAttachments([]Attachment{
-		{
-			Name: "attachment name1",
-			Path: "./testingdata/attachment1.md",
+	msg := &Message{
+		From: mail.Address{
+			Name:    "test from name",
+			Address: "from@mail.com",
 		},
-		{
-			Name: "attachment name2",
-			Path: "./testingdata/attachment2.md",
+		To: []mail.Address{
+			{Name: "test from name1", Address: "from1@mail.com"},
+			{Name: "test from name2", Address: "from2@mail.com"},
 		},
-	})
-	err := mDriver.Send()
+		CC: []mail.Address{
+			{Name: "test cc name1", Address: "cc1@mail.com"},
+			{Name: "test cc name2", Address: "cc2@mail.com"},
+		},
+		BCC: []mail.Address{
+			{Name: "test bcc name1", Address: "bcc1@mail.com"},
+			{Name: "test bcc name2", Address: "bcc2@mail.com"},
+		},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name: "attachment name2",
+				Path: "./testingdata/attachment2.md",
+			},
+		},
+	}
+	err := mDriver.SendMessage(context.Background(), msg)
 	if err != nil {
 		t.Error("failed testing send")
 	}
-	file, _ := os.Open(tmpFilePath)
-	mBytes, _ := ioutil.ReadAll(file)
-	file.Close()
-	os.Truncate(tmpFilePath, 0)
-	m := string(mBytes)
-
-	if !strings.Contains(m, `From: "test from name" <from@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts) != 3 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `To: "test from name1" <from1@mail.com>;"test from name2" <from2@mail.com>`) {
-		t.Error("Failed test send")
-	}
-	if !strings.Contains(m, `Cc: "test cc name1" <cc1@mail.com>;"test cc name2" <cc2@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[0]) != 4 || sentRcpts[0][0].Address != "from1@mail.com" || sentRcpts[0][3].Address != "cc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Subject: this is the subject`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[1]) != 1 || sentRcpts[1][0].Address != "bcc1@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Type: text/html; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[2]) != 1 || sentRcpts[2][0].Address != "bcc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `this is html body`) {
-		t.Error("Failed test send")
+	for _, v := range sentMessages {
+		if v != msg {
+			t.Error("failed testing send")
+		}
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name1"`) {
-		t.Error("Failed test send")
+
+	mDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		return "", errors.New("this is a test error")
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAx`) {
-		t.Error("Failed test send")
+	err = mDriver.SendMessage(context.Background(), msg)
+	if err == nil {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name2"`) {
-		t.Error("Failed test send")
+}
+
+func TestMailGunDriverSendContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	}
+	mDriver := initiateMailGun(&MailGunConfig{Domain: "localhost", APIKey: "TEST-API-KEY", APIBase: server.URL + "/v3"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := mDriver.SendMessage(ctx, msg)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 2*time.Second {
+		t.Error("failed testing send context", err)
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAy`) {
-		t.Error("Failed test send")
+
+	// without a deadline the driver's timeout stops the request
+	mDriver = initiateMailGun(&MailGunConfig{Domain: "localhost", APIKey: "TEST-API-KEY", APIBase: server.URL + "/v3", Timeout: 100 * time.Millisecond})
+	start = time.Now()
+	err = mDriver.SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageHTTP || time.Since(start) > 2*time.Second {
+		t.Error("failed testing send context", err)
 	}
+}
 
-	mDriver.SetHTMLBody("")
-	mDriver.SetPlainTextBody("this is plain text body")
-	err = mDriver.Send()
+func TestMailGunDriverSendToServer(t *testing.T) {
+	var forms []url.Values
+	var inlines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/localhost/messages" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		forms = append(forms, r.MultipartForm.Value)
+		for _, v := range r.MultipartForm.File["inline"] {
+			inlines = append(inlines, v.Filename)
+		}
+		w.Write([]byte(`{"id":"<20230729.1@localhost>","message":"Queued. Thank you."}`))
+	}))
+	defer server.Close()
+	mDriver := initiateMailGun(&MailGunConfig{
+		Domain:  "localhost",
+		APIKey:  "TEST-API-KEY",
+		APIBase: server.URL + "/v3",
+	})
+	err := mDriver.SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		ReplyTo:       []mail.Address{{Name: "support", Address: "support@mail.com"}, {Address: "help@mail.com"}},
+		Headers:       map[string]string{"List-Unsubscribe": "<https://mail.com/unsubscribe>"},
+		Attachments: []Attachment{
+			{Name: "logo.png", Path: "./testingdata/logo.png", ContentID: "logo"},
+		},
+	})
 	if err != nil {
-		t.Error("failed testing send")
+		t.Fatal("failed testing send", err)
 	}
-	file, _ = os.Open(tmpFilePath)
-	mBytes, _ = ioutil.ReadAll(file)
-	m = string(mBytes)
-	if !strings.Contains(m, `Content-Type: text/plain; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	if len(forms) != 1 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `this is plain text body`) {
-		t.Error("Failed test send")
+	if forms[0].Get("h:Reply-To") != `"support" <support@mail.com>, <help@mail.com>` || forms[0].Get("h:List-Unsubscribe") != "<https://mail.com/unsubscribe>" {
+		t.Error("failed testing send")
 	}
-
-	mDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		return errors.New("this is a test error")
+	if strings.Join(inlines, ",") != "logo" {
+		t.Error("failed testing send")
 	}
-	err = mDriver.Send()
-	if err == nil {
+	if forms[0].Get("text") != "this is plain text body" || forms[0].Get("html") != "this is html body" {
 		t.Error("failed testing send")
 	}
 }
@@ -5,31 +5,29 @@
 package mailing
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/mail"
+	"strings"
+	"sync"
 )
 
 type Driver interface {
-	Send() error
-	SetFrom(from mail.Address) error
-	SetTo(toList []mail.Address) error
-	SetCC(ccList []mail.Address) error
-	SetBCC(bccList []mail.Address) error
-	SetSubject(subject string) error
-	SetHTMLBody(body string) error
-	SetPlainTextBody(body string) error
-	SetAttachments(attachments []Attachment) error
+	SendMessage(ctx context.Context, msg *Message) error
 }
 
 type Mailer struct {
-	driver     Driver
-	sender     mail.Address
-	receiver   mail.Address
-	cc         []mail.Address
-	bcc        []mail.Address
-	subject    string
-	htmlBody   string
-	plainText  string
-	attachment string
+	driver      Driver
+	mu          sync.Mutex
+	message     *Message
+	buildErr    error // why building the message through the setters failed, returned by the next sending
+	retryPolicy RetryPolicy
+	templates   *Templates
+	limiter     *rateLimiter
+
+	schedules              map[string]*scheduledSend // the scheduled messages by id
+	scheduledResultHandler func(ScheduledResult)
 }
 
 type EmailAddress struct {
@@ -37,104 +35,334 @@ type EmailAddress struct {
 	Address string // ex: john@example.com
 }
 type Attachment struct {
-	Name string // name of the file
-	Path string // full path to the file
+	Name        string    // name of the file
+	Path        string    // full path to the file
+	Content     []byte    // the content of a file in memory, used instead of Path
+	Reader      io.Reader // the content is read from it, used instead of Path and Content, streamed by SMTP without DKIM, read into memory otherwise
+	ContentType string    // optional, detected from the content when empty
+	ContentID   string    // optional, embeds the file inline so the html body can show it with <img src="cid:ContentID">
+}
+
+// Initiate the mailer with a custom driver
+func NewMailer(driver Driver) *Mailer {
+	return &Mailer{driver: driver, message: &Message{}}
+}
+
+// Initiate the mailer with a chain of drivers, the email is sent with the first one and every
+// following driver is tried in turn when the previous one fails with an error that isn't permanent
+func NewMailerWithFailover(drivers ...Driver) *Mailer {
+	return NewMailer(NewFailoverDriver(drivers...))
 }
 
 // Initiate the mailer with SMTP driver
 func NewMailerWithSMTP(config *SMTPConfig) *Mailer {
 	smtpDriver := initiateSMTP(config)
-	return &Mailer{driver: smtpDriver}
+	return NewMailer(smtpDriver)
 }
 
 // Initiate the mailer with SparkPost driver
 func NewMailerWithSparkPost(config *SparkPostConfig) *Mailer {
 	sparkPostDriver := initiateSparkPost(config)
-	return &Mailer{driver: sparkPostDriver}
+	return NewMailer(sparkPostDriver)
 }
 
 // Initiate the mailer with SendGrid driver
 func NewMailerWithSendGrid(config *SendGridConfig) *Mailer {
 	sendGridDriver := initiateSendGrid(config)
-	return &Mailer{driver: sendGridDriver}
+	return NewMailer(sendGridDriver)
 }
 
 // Initiate the mailer with MailGun driver
 func NewMailerWithMailGun(config *MailGunConfig) *Mailer {
 	mailGunDriver := initiateMailGun(config)
-	return &Mailer{driver: mailGunDriver}
+	return NewMailer(mailGunDriver)
+}
+
+// Initiate the mailer with Amazon SES driver
+func NewMailerWithSES(config *SESConfig) *Mailer {
+	sesDriver := initiateSES(config)
+	return NewMailer(sesDriver)
+}
+
+// Initiate the mailer with Postmark driver
+func NewMailerWithPostmark(config *PostmarkConfig) *Mailer {
+	postmarkDriver := initiatePostmark(config)
+	return NewMailer(postmarkDriver)
+}
+
+// Initiate the SMTP driver, to use with NewMailer or NewMailerWithFailover
+func NewSMTPDriver(config *SMTPConfig) *SMTPDriver {
+	return initiateSMTP(config)
+}
+
+// Initiate the SparkPost driver, to use with NewMailer or NewMailerWithFailover
+func NewSparkPostDriver(config *SparkPostConfig) *SparkPostDriver {
+	return initiateSparkPost(config)
+}
+
+// Initiate the SendGrid driver, to use with NewMailer or NewMailerWithFailover
+func NewSendGridDriver(config *SendGridConfig) *SendGridDriver {
+	return initiateSendGrid(config)
+}
+
+// Initiate the MailGun driver, to use with NewMailer or NewMailerWithFailover
+func NewMailGunDriver(config *MailGunConfig) *MailGunDriver {
+	return initiateMailGun(config)
+}
+
+// Initiate the Amazon SES driver, to use with NewMailer or NewMailerWithFailover
+func NewSESDriver(config *SESConfig) *SESDriver {
+	return initiateSES(config)
+}
+
+// Initiate the Postmark driver, to use with NewMailer or NewMailerWithFailover
+func NewPostmarkDriver(config *PostmarkConfig) *PostmarkDriver {
+	return initiatePostmark(config)
 }
 
 // Sender of the email
 func (m *Mailer) SetFrom(emailAddress EmailAddress) *Mailer {
-	m.driver.SetFrom(mail.Address{Name: emailAddress.Name, Address: emailAddress.Address})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.From = mail.Address{Name: emailAddress.Name, Address: emailAddress.Address}
 	return m
 }
 
 // List of receivers of the email
 func (m *Mailer) SetTo(emailAddresses []EmailAddress) *Mailer {
-	var addressesList []mail.Address
-	for _, v := range emailAddresses {
-		addressesList = append(addressesList, mail.Address{Name: v.Name, Address: v.Address})
-	}
-
-	m.driver.SetTo(addressesList)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.To = toMailAddresses(emailAddresses)
 	return m
 }
 
 // List of cc of the email
 func (m *Mailer) SetCC(emailAddresses []EmailAddress) *Mailer {
-	var addressesList []mail.Address
-	for _, v := range emailAddresses {
-		addressesList = append(addressesList, mail.Address{Name: v.Name, Address: v.Address})
-	}
-
-	m.driver.SetCC(addressesList)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.CC = toMailAddresses(emailAddresses)
 	return m
 }
 
 // List of bcc of the email
 func (m *Mailer) SetBCC(emailAddresses []EmailAddress) *Mailer {
-	var addressesList []mail.Address
-	for _, v := range emailAddresses {
-		addressesList = append(addressesList, mail.Address{Name: v.Name, Address: v.Address})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.BCC = toMailAddresses(emailAddresses)
+	return m
+}
+
+// List of addresses the replies to the email go to, by default the replies go to the sender
+func (m *Mailer) SetReplyTo(emailAddresses []EmailAddress) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.ReplyTo = toMailAddresses(emailAddresses)
+	return m
+}
+
+// The envelope sender the bounces go to (the Return-Path), by default the bounces go to the sender,
+// it's supported by the SMTP and SparkPost drivers, the other providers use the bounce address of the
+// sending domain. Amazon SES forwards the bounce and complaint notifications to it instead, the envelope
+// sender stays the MAIL FROM domain of the identity
+func (m *Mailer) SetReturnPath(emailAddress string) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.ReturnPath = emailAddress
+	return m
+}
+
+// Replace the extra headers of the email, ex: List-Unsubscribe or X-Entity-Ref-ID, the headers
+// built from the fields of the email, like To or Content-Type, can't be set and a name that isn't
+// a valid field name makes the next sending fail with ErrInvalidHeader
+func (m *Mailer) SetHeaders(headers map[string]string) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.Headers = make(map[string]string, len(headers))
+	for k, v := range headers {
+		m.message.Headers[k] = v
 	}
+	return m
+}
 
-	m.driver.SetBCC(addressesList)
+// Add an extra header to the email, it replaces the header with the same name,
+// the names allowed are the same as SetHeaders
+func (m *Mailer) AddHeader(name string, value string) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.message.Headers == nil {
+		m.message.Headers = make(map[string]string)
+	}
+	for k := range m.message.Headers {
+		if strings.EqualFold(k, name) {
+			delete(m.message.Headers, k)
+		}
+	}
+	m.message.Headers[name] = value
 	return m
 }
 
 // Title of the email
 func (m *Mailer) SetSubject(subject string) *Mailer {
-	m.driver.SetSubject(subject)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.Subject = subject
 	return m
 }
 
 // Set the body of the email in html format
-// make sure to use only one version of the email body, either the html or the plain text
-// to use the html, call the function SetHTMLBody(body string)
-// and if you want to use the text, call the function SetPlainTextBody(body string)
+// it's recommended to set the plain text version as well by calling SetPlainTextBody(body string),
+// when both are set the email carries both versions and the email client picks the one it can show
 func (m *Mailer) SetHTMLBody(body string) *Mailer {
-	m.driver.SetHTMLBody(body)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.HTMLBody = body
 	return m
 }
 
 // Set the body of the email in plain text format
-// make sure to use only one version of the email body, either the html or the plain text
-// to use the html, call the function SetHTMLBody(body string)
-// and if you want to use the text, call the function SetPlainTextBody(body string)
+// it's recommended to set the html version as well by calling SetHTMLBody(body string),
+// when both are set the email carries both versions and the email client picks the one it can show
 func (m *Mailer) SetPlainTextBody(body string) *Mailer {
-	m.driver.SetPlainTextBody(body)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.PlainTextBody = body
+	return m
+}
+
+// Set the templates registry SetTemplate renders the emails from
+func (m *Mailer) SetTemplates(templates *Templates) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.templates = templates
+	return m
+}
+
+// Set the subject and the bodies of the email by rendering the named template of the
+// registry given to SetTemplates with the data, the subject is kept when the template has none,
+// when the rendering fails the next call to Send returns the error
+func (m *Mailer) SetTemplate(name string, data interface{}) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.templates == nil {
+		m.buildErr = errors.New("mailing: SetTemplate needs the templates given to SetTemplates")
+		return m
+	}
+	rendered, err := m.templates.Render(name, data)
+	if err != nil {
+		m.buildErr = err
+		return m
+	}
+	if rendered.Subject != "" {
+		m.message.Subject = rendered.Subject
+	}
+	m.message.HTMLBody = rendered.HTMLBody
+	m.message.PlainTextBody = rendered.PlainTextBody
 	return m
 }
 
 // Add attachments to the email
 func (m *Mailer) SetAttachments(attachments []Attachment) *Mailer {
-	m.driver.SetAttachments(attachments)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.message.Attachments = attachments
+	return m
+}
+
+// Set how sending is tried again when it fails with a transient error,
+// by default the mailer doesn't retry
+func (m *Mailer) SetRetryPolicy(policy RetryPolicy) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retryPolicy = policy
 	return m
 }
 
-// Send the email
+// Set the rate limit of the mailer, it's shared by all the goroutines sending with the mailer,
+// to share a limit between mailers wrap their driver with NewRateLimitedDriver instead
+func (m *Mailer) SetRateLimit(limit RateLimit) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limiter = newRateLimiter(limit)
+	return m
+}
+
+// Send the email built through the setters, the mailer starts a fresh message afterwards
 func (m *Mailer) Send() error {
-	return m.driver.Send()
+	return m.SendContext(context.Background())
+}
+
+// Send the email built through the setters, cancelling the context or reaching
+// its deadline stops the sending, the mailer starts a fresh message afterwards
+func (m *Mailer) SendContext(ctx context.Context) error {
+	_, err := m.SendWithResult(ctx)
+	return err
+}
+
+// Send the email built through the setters and return the result of every recipient,
+// the result is returned even when the sending fails, the mailer starts a fresh message afterwards
+func (m *Mailer) SendWithResult(ctx context.Context) (*SendResult, error) {
+	m.mu.Lock()
+	msg, buildErr := m.message, m.buildErr
+	m.message, m.buildErr = &Message{}, nil
+	m.mu.Unlock()
+	if buildErr != nil {
+		err := &SendError{Stage: StageBuild, Err: buildErr}
+		return (*resultLog)(nil).sendResult(msg, driverName(m.driver), err), err
+	}
+	return m.send(ctx, msg)
+}
+
+// Send a ready message without touching the message built through the setters,
+// it's safe to call from multiple goroutines sharing the same mailer
+func (m *Mailer) SendMessage(ctx context.Context, msg *Message) error {
+	_, err := m.send(ctx, msg.Clone())
+	return err
+}
+
+// Send a ready message like SendMessage and return the result of every recipient,
+// the result is returned even when the sending fails
+func (m *Mailer) SendMessageWithResult(ctx context.Context, msg *Message) (*SendResult, error) {
+	return m.send(ctx, msg.Clone())
+}
+
+// send a message the mailer owns and collect the result of every recipient
+func (m *Mailer) send(ctx context.Context, msg *Message) (*SendResult, error) {
+	return m.sendWithLog(ctx, msg, &resultLog{})
+}
+
+// send a message the mailer owns, the recipients the log has as accepted are skipped
+func (m *Mailer) sendWithLog(ctx context.Context, msg *Message, log *resultLog) (*SendResult, error) {
+	m.mu.Lock()
+	policy, limiter := m.retryPolicy, m.limiter
+	m.mu.Unlock()
+	msg.results = log
+	if err := checkHeaders(msg.Headers); err != nil {
+		err := &SendError{Stage: StageBuild, Err: err}
+		return msg.results.sendResult(msg, driverName(m.driver), err), err
+	}
+	driver := m.driver
+	if limiter != nil {
+		// the limit is taken on every attempt, so the retries wait for the bucket to refill
+		driver = &RateLimitedDriver{driver: m.driver, limiter: limiter}
+	}
+	err := sendWithRetry(ctx, driver, policy, msg)
+	return msg.results.sendResult(msg, driverName(m.driver), err), err
+}
+
+// Close releases what the driver holds, like the pooled smtp connections, the messages
+// the mailer scheduled itself are not sent, the ones the provider holds still are
+func (m *Mailer) Close() error {
+	m.stopScheduled()
+	if closer, ok := m.driver.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func toMailAddresses(emailAddresses []EmailAddress) []mail.Address {
+	var addressesList []mail.Address
+	for _, v := range emailAddresses {
+		addressesList = append(addressesList, mail.Address{Name: v.Name, Address: v.Address})
+	}
+	return addressesList
 }
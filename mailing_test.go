@@ -1,8 +1,12 @@
 package mailing
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/mail"
+	"sync"
 	"testing"
 )
 
@@ -70,34 +74,191 @@ func TestMailingParamSetters(t *testing.T) {
 			},
 		})
 
-	dr := mailer.driver.(*smtpDriver)
-	if !(dr.from.Name == "from name" && dr.from.Address == "from@mail.com") {
+	msg := mailer.message
+	if !(msg.From.Name == "from name" && msg.From.Address == "from@mail.com") {
 		panic("failed testing mailing parameters setting")
 	}
-	if len(dr.toList) != 2 {
+	if len(msg.To) != 2 {
 		panic("failed testing mailing parameters setting")
 	}
-	if len(dr.ccList) != 2 {
+	if len(msg.CC) != 2 {
 		panic("failed testing mailing parameters setting")
 	}
-	if len(dr.bccList) != 1 {
+	if len(msg.BCC) != 1 {
 		panic("failed testing mailing parameters setting")
 	}
-	if dr.subject != "This is the subject" {
+	if msg.Subject != "This is the subject" {
 		panic("failed testing mailing parameters setting")
 	}
-	if dr.htmlBody != "this is the body" {
+	if msg.HTMLBody != "this is the body" {
 		panic("failed testing mailing parameters setting")
 	}
-	if len(dr.attachments) != 2 {
+	if len(msg.Attachments) != 2 {
 		panic("failed testing mailing parameters setting")
 	}
 	mailer.SetHTMLBody("")
 	mailer.SetPlainTextBody("this is plain text body")
-	if dr.htmlBody != "" {
+	if msg.HTMLBody != "" {
 		panic("failed testing mailing parameters setting")
 	}
-	if dr.plainTextBody != "this is plain text body" {
+	if msg.PlainTextBody != "this is plain text body" {
 		panic("failed testing mailing parameters setting")
 	}
 }
+
+func TestMailingHeaderSetters(t *testing.T) {
+	mailer := NewMailer(&testDriver{})
+	headers := map[string]string{"X-Entity-Ref-ID": "123"}
+	mailer.
+		SetReplyTo([]EmailAddress{{Name: "support", Address: "support@mail.com"}}).
+		SetReturnPath("bounces@mail.com").
+		SetHeaders(headers).
+		AddHeader("List-Unsubscribe", "<https://mail.com/unsubscribe>").
+		AddHeader("x-entity-ref-id", "456")
+	msg := mailer.message
+	if len(msg.ReplyTo) != 1 || msg.ReplyTo[0].Name != "support" || msg.ReplyTo[0].Address != "support@mail.com" {
+		t.Error("failed testing header setters")
+	}
+	if msg.ReturnPath != "bounces@mail.com" {
+		t.Error("failed testing header setters")
+	}
+	// the header with the same name is replaced whatever its case, the given map isn't modified
+	if len(msg.Headers) != 2 || msg.Headers["x-entity-ref-id"] != "456" || msg.Headers["List-Unsubscribe"] != "<https://mail.com/unsubscribe>" {
+		t.Error("failed testing header setters")
+	}
+	if len(headers) != 1 || headers["X-Entity-Ref-ID"] != "123" {
+		t.Error("failed testing header setters")
+	}
+}
+
+func TestMailerInvalidHeaders(t *testing.T) {
+	driver := &testDriver{}
+	mailer := NewMailer(driver)
+	for _, name := range []string{"X-Test\r\nBcc", "X Test", "X-Test:", "", "to", "Content-Type", "mime-version"} {
+		err := mailer.
+			SetFrom(EmailAddress{Address: "from@mail.com"}).
+			SetTo([]EmailAddress{{Address: "to@mail.com"}}).
+			AddHeader(name, "leak@mail.com").
+			Send()
+		var sendErr *SendError
+		if !errors.Is(err, ErrInvalidHeader) || !errors.As(err, &sendErr) || sendErr.Stage != StageBuild {
+			t.Error("failed testing invalid headers", name, err)
+		}
+		// the raw message isn't built either
+		_, err = buildMessage(&Message{From: mail.Address{Address: "from@mail.com"}, Headers: map[string]string{name: "leak@mail.com"}})
+		if !errors.Is(err, ErrInvalidHeader) {
+			t.Error("failed testing invalid headers", name, err)
+		}
+	}
+	if len(driver.messages) != 0 {
+		t.Error("failed testing invalid headers")
+	}
+}
+
+type testDriver struct {
+	mu       sync.Mutex
+	messages []*Message
+	err      error
+}
+
+func (d *testDriver) SendMessage(ctx context.Context, msg *Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = append(d.messages, msg)
+	return d.err
+}
+
+func TestMailerSend(t *testing.T) {
+	driver := &testDriver{}
+	mailer := NewMailer(driver)
+	mailer.
+		SetFrom(EmailAddress{Name: "from name", Address: "from@mail.com"}).
+		SetTo([]EmailAddress{{Name: "to name", Address: "to@mail.com"}}).
+		SetSubject("the first subject")
+	err := mailer.Send()
+	if err != nil {
+		t.Error("failed testing mailer send")
+	}
+	mailer.SetSubject("the second subject")
+	err = mailer.Send()
+	if err != nil {
+		t.Error("failed testing mailer send")
+	}
+	if len(driver.messages) != 2 {
+		t.Fatal("failed testing mailer send")
+	}
+	if driver.messages[0].Subject != "the first subject" || len(driver.messages[0].To) != 1 {
+		t.Error("failed testing mailer send")
+	}
+	if driver.messages[1].Subject != "the second subject" || len(driver.messages[1].To) != 0 {
+		t.Error("failed testing mailer send")
+	}
+
+	driver.err = errors.New("this is a test error")
+	err = mailer.Send()
+	if err == nil {
+		t.Error("failed testing mailer send")
+	}
+}
+
+func TestMailerSendMessage(t *testing.T) {
+	driver := &testDriver{}
+	mailer := NewMailer(driver)
+	msg := &Message{
+		From:    mail.Address{Name: "from name", Address: "from@mail.com"},
+		To:      []mail.Address{{Name: "to name", Address: "to@mail.com"}},
+		Subject: "the subject",
+		Headers: map[string]string{"X-Test": "test"},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailer.SendMessage(context.Background(), msg)
+		}()
+	}
+	wg.Wait()
+	if len(driver.messages) != 10 {
+		t.Fatal("failed testing mailer send message")
+	}
+	sent := driver.messages[0]
+	if sent == msg {
+		t.Error("failed testing mailer send message")
+	}
+	msg.To[0].Address = "changed@mail.com"
+	msg.Headers["X-Test"] = "changed"
+	if sent.To[0].Address != "to@mail.com" || sent.Headers["X-Test"] != "test" {
+		t.Error("failed testing mailer send message")
+	}
+}
+
+type ctxKey struct{}
+
+func TestMailerSendContext(t *testing.T) {
+	var received context.Context
+	mailer := NewMailer(driverFunc(func(ctx context.Context, msg *Message) error {
+		received = ctx
+		return ctx.Err()
+	}))
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	err := mailer.SetSubject("the subject").SendContext(ctx)
+	if err != nil {
+		t.Error("failed testing mailer send context")
+	}
+	if received.Value(ctxKey{}) != "value" {
+		t.Error("failed testing mailer send context")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = mailer.SendContext(ctx)
+	if err == nil {
+		t.Error("failed testing mailer send context")
+	}
+}
+
+type driverFunc func(ctx context.Context, msg *Message) error
+
+func (f driverFunc) SendMessage(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
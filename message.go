@@ -1,25 +1,89 @@
 package mailing
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/http"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
+// ErrInvalidHeader is returned when an extra header has a name that isn't a valid field name,
+// or is one of the headers built from the message fields, like To or Content-Type
+var ErrInvalidHeader = errors.New("mailing: invalid header")
+
+// Message is a single email with everything a driver needs to send it,
+// drivers never modify the message they are given
+type Message struct {
+	From          mail.Address
+	To            []mail.Address
+	CC            []mail.Address
+	BCC           []mail.Address
+	ReplyTo       []mail.Address // where the replies go, defaults to From
+	Subject       string
+	HTMLBody      string
+	PlainTextBody string
+	Attachments   []Attachment
+	Headers       map[string]string // extra headers added to the email, ex: List-Unsubscribe, not the ones built from the fields, like To
+	// the envelope sender (MAIL FROM) the bounces go to, the receiving server writes it in
+	// the Return-Path header, defaults to From, see the README for the drivers that support it
+	ReturnPath string
+
+	// the result of every recipient, set by the mailer so the drivers record
+	// the results and skip the recipients who were already sent the email
+	results *resultLog
+	// when the provider sends the message, set for the drivers that schedule it natively
+	schedule *messageSchedule
+	// takes the rate limit of a request to the provider, set by the rate limited drivers
+	limit func(rcpts int) error
+}
+
+// Clone returns a deep copy of the message, attachments given as readers share the same reader
+func (m *Message) Clone() *Message {
+	c := *m
+	c.To = append([]mail.Address(nil), m.To...)
+	c.CC = append([]mail.Address(nil), m.CC...)
+	c.BCC = append([]mail.Address(nil), m.BCC...)
+	c.ReplyTo = append([]mail.Address(nil), m.ReplyTo...)
+	c.Attachments = append([]Attachment(nil), m.Attachments...)
+	if m.Headers != nil {
+		c.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
 type messageBuilder struct {
 	subject       string
 	htmlBody      string
 	plainTextBody string
-	from          string
-	toList        []string
-	ccList        []string
+	from          mail.Address
+	toList        []mail.Address
+	ccList        []mail.Address
+	replyToList   []mail.Address
 	attachments   []Attachment
+	headers       map[string]string
+
+	// the Date and Message-ID headers and the multipart boundaries,
+	// generated when not set, tests set them to get the same message every time
+	date      time.Time
+	messageID string
+	boundary  func() string
 }
 
 func newMessageBuilder() *messageBuilder {
@@ -27,9 +91,29 @@ func newMessageBuilder() *messageBuilder {
 		subject:       "",
 		htmlBody:      "",
 		plainTextBody: "",
+		boundary:      randomBoundary,
 	}
 }
 
+// build the mime message of the given message
+func buildMessage(msg *Message) ([]byte, error) {
+	return messageBuilderOf(msg).build()
+}
+
+// the builder of the mime message of the given message
+func messageBuilderOf(msg *Message) *messageBuilder {
+	return newMessageBuilder().
+		setSubject(msg.Subject).
+		setHTMLBody(msg.HTMLBody).
+		setPlainTextBody(msg.PlainTextBody).
+		setFrom(msg.From).
+		setToList(msg.To).
+		setCCList(msg.CC).
+		setReplyToList(msg.ReplyTo).
+		setAttachments(msg.Attachments).
+		setHeaders(msg.Headers)
+}
+
 func (m *messageBuilder) setSubject(subject string) *messageBuilder {
 	m.subject = subject
 	return m
@@ -46,25 +130,22 @@ func (m *messageBuilder) setPlainTextBody(body string) *messageBuilder {
 }
 
 func (m *messageBuilder) setFrom(from mail.Address) *messageBuilder {
-	m.from = from.String()
+	m.from = from
 	return m
 }
 
 func (m *messageBuilder) setToList(toList []mail.Address) *messageBuilder {
-	var toListStr []string
-	for _, v := range toList {
-		toListStr = append(toListStr, v.String())
-	}
-	m.toList = toListStr
+	m.toList = toList
 	return m
 }
 
 func (m *messageBuilder) setCCList(ccList []mail.Address) *messageBuilder {
-	var ccListStr []string
-	for _, v := range ccList {
-		ccListStr = append(ccListStr, v.String())
-	}
-	m.ccList = ccListStr
+	m.ccList = ccList
+	return m
+}
+
+func (m *messageBuilder) setReplyToList(replyToList []mail.Address) *messageBuilder {
+	m.replyToList = replyToList
 	return m
 }
 
@@ -73,49 +154,385 @@ func (m *messageBuilder) setAttachments(attachments []Attachment) *messageBuilde
 	return m
 }
 
-func (m *messageBuilder) build() []byte {
+func (m *messageBuilder) setHeaders(headers map[string]string) *messageBuilder {
+	m.headers = headers
+	return m
+}
+
+func (m *messageBuilder) build() ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	buf.WriteString(fmt.Sprintf("From: %s\r\n", m.from))
-	buf.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(m.toList, ";")))
-	buf.WriteString(fmt.Sprintf("Cc: %s\r\n", strings.Join(m.ccList, ";")))
-	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", m.subject))
-	writer := multipart.NewWriter(buf)
-	boundary := writer.Boundary()
+	err := m.writeTo(buf)
+	if err != nil {
+		return nil, err
+	}
+	m.resetMessageProps()
+	return buf.Bytes(), nil
+}
+
+// write the mime message to w, the attachments are read while they are written, so the message can
+// be streamed without holding them in memory, the error of the first failed write is returned
+func (m *messageBuilder) writeTo(w io.Writer) error {
+	err := checkHeaders(m.headers)
+	if err != nil {
+		return err
+	}
+	buf := &errWriter{w: w}
+	writeHeader(buf, "From", m.from.String())
+	if len(m.toList) > 0 {
+		writeHeader(buf, "To", formatAddressList(m.toList))
+	}
+	if len(m.ccList) > 0 {
+		writeHeader(buf, "Cc", formatAddressList(m.ccList))
+	}
+	if len(m.replyToList) > 0 {
+		writeHeader(buf, "Reply-To", formatAddressList(m.replyToList))
+	}
+	writeHeader(buf, "Subject", encodeHeader(m.subject))
+
+	// the extra headers can replace the generated Date and Message-ID
+	headers := make(map[string]string, len(m.headers))
+	for k, v := range m.headers {
+		headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	if _, ok := headers["Date"]; !ok {
+		date := m.date
+		if date.IsZero() {
+			date = time.Now()
+		}
+		writeHeader(buf, "Date", date.Format(time.RFC1123Z))
+	}
+	if _, ok := headers["Message-Id"]; !ok {
+		messageID := m.messageID
+		if messageID == "" {
+			messageID, err = newMessageID(m.from.Address)
+			if err != nil {
+				return err
+			}
+		}
+		writeHeader(buf, "Message-ID", messageID)
+	}
+	var headerKeys []string
+	for k := range m.headers {
+		headerKeys = append(headerKeys, k)
+	}
+	sort.Strings(headerKeys)
+	for _, k := range headerKeys {
+		writeHeader(buf, k, encodeHeader(m.headers[k]))
+	}
+	boundary := m.boundary()
 	buf.WriteString("MIME-Version: 1.0\r\n")
 	buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
-	if m.htmlBody != "" {
-		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
-		buf.WriteString("Content-Type: text/html; charset=\"UTF-8\"\r\n")
-		buf.WriteString(m.htmlBody)
-	} else {
-		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
-		buf.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
-		buf.WriteString(m.plainTextBody)
+	buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
+	var inlines, attachments []Attachment
+	for _, attachment := range m.attachments {
+		if attachment.ContentID != "" {
+			inlines = append(inlines, attachment)
+		} else {
+			attachments = append(attachments, attachment)
+		}
 	}
-	if len(m.attachments) > 0 {
-		for _, attachment := range m.attachments {
-			file, err := os.Open(attachment.Path)
-			fileContent, err := io.ReadAll(file)
+	if len(inlines) > 0 {
+		// the body and the inline files it references are grouped in a multipart/related part
+		relatedBoundary := m.boundary()
+		buf.WriteString(fmt.Sprintf("Content-Type: multipart/related; boundary=\"%s\"\r\n", relatedBoundary))
+		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", relatedBoundary))
+		m.writeBody(buf)
+		for _, attachment := range inlines {
+			buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", relatedBoundary))
+			err := writeAttachment(buf, attachment)
 			if err != nil {
-				panic(err.Error())
+				return err
 			}
+		}
+		buf.WriteString(fmt.Sprintf("\r\n--%s--\r\n", relatedBoundary))
+	} else {
+		m.writeBody(buf)
+	}
+	for _, attachment := range attachments {
+		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
+		err := writeAttachment(buf, attachment)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary))
+	return buf.err
+}
+
+// whether the message is written in ascii, the bodies and the headers are always encoded
+// in ascii but the addresses and the attachments' content type and id are written as they are
+func (m *messageBuilder) isASCII() bool {
+	addresses := append([]mail.Address{m.from}, m.toList...)
+	addresses = append(addresses, m.ccList...)
+	addresses = append(addresses, m.replyToList...)
+	if !isASCII(formatAddressList(addresses)) {
+		return false
+	}
+	for _, v := range m.attachments {
+		if !isASCII(v.ContentType) || !isASCII(v.ContentID) {
+			return false
+		}
+	}
+	return true
+}
+
+// mimeWriter is what the parts of the message are written to
+type mimeWriter interface {
+	io.Writer
+	io.StringWriter
+}
+
+// errWriter keeps the error of the first failed write and skips the next writes
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+func (e *errWriter) WriteString(s string) (int, error) {
+	return e.Write([]byte(s))
+}
+
+// write the body part, when both the html and the plain text are set they are
+// nested in a multipart/alternative part with the plain text first
+func (m *messageBuilder) writeBody(buf mimeWriter) {
+	if m.htmlBody != "" && m.plainTextBody != "" {
+		boundary := m.boundary()
+		buf.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n", boundary))
+		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
+		writeTextPart(buf, "text/plain", m.plainTextBody)
+		buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
+		writeTextPart(buf, "text/html", m.htmlBody)
+		buf.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary))
+		return
+	}
+	if m.htmlBody != "" {
+		writeTextPart(buf, "text/html", m.htmlBody)
+	} else {
+		writeTextPart(buf, "text/plain", m.plainTextBody)
+	}
+}
+
+// write the text part with the transfer encoding that suits its content
+func writeTextPart(buf mimeWriter, contentType string, body string) {
+	encoding := textTransferEncoding(body)
+	buf.WriteString(fmt.Sprintf("Content-Type: %s; charset=\"UTF-8\"\r\n", contentType))
+	buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", encoding))
+	buf.WriteString("\r\n")
+	switch encoding {
+	case "quoted-printable":
+		writer := quotedprintable.NewWriter(buf)
+		writer.Write([]byte(body))
+		writer.Close()
+	case "base64":
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: buf})
+		encoder.Write([]byte(body))
+		encoder.Close()
+	default:
+		buf.WriteString(body)
+	}
+}
+
+// the longest line of a 7bit part, as RFC 5322 allows
+const maxBodyLineLength = 998
+
+// 7bit when the body is ascii with short lines, otherwise quoted-printable
+// or base64, whichever makes the body smaller: quoted-printable triples
+// every non-ascii byte while base64 grows the whole body by a third
+func textTransferEncoding(body string) string {
+	var nonASCII, lineLength int
+	var longLines bool
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\n':
+			lineLength = 0
+			continue
+		case c >= 0x80 || c == 0 || (c == '\r' && (i+1 == len(body) || body[i+1] != '\n')):
+			nonASCII++
+		}
+		lineLength++
+		if lineLength > maxBodyLineLength {
+			longLines = true
+		}
+	}
+	switch {
+	case nonASCII == 0 && !longLines:
+		return "7bit"
+	case len(body)+2*nonASCII <= len(body)*4/3:
+		return "quoted-printable"
+	}
+	return "base64"
+}
+
+// the length of the base64 lines, as RFC 2045 requires
+const base64LineLength = 76
+
+// lineWrapper breaks what's written to it into lines of base64LineLength
+type lineWrapper struct {
+	w          io.Writer
+	lineLength int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.lineLength == base64LineLength {
+			_, err := io.WriteString(l.w, "\r\n")
 			if err != nil {
-				panic(err.Error())
+				return written, err
 			}
-			buf.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
-			buf.WriteString(fmt.Sprintf("Content-Type: \"%s\"\r\n", http.DetectContentType(fileContent)))
-			buf.WriteString("Content-Transfer-Encoding: base64\r\n")
-			buf.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", attachment.Name))
+			l.lineLength = 0
+		}
+		n := base64LineLength - l.lineLength
+		if n > len(p) {
+			n = len(p)
+		}
+		n, err := l.w.Write(p[:n])
+		written += n
+		l.lineLength += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// write the attachment part, attachments with a content id are written inline, the
+// content is read and encoded in chunks, so it's never held in memory whole
+func writeAttachment(buf mimeWriter, attachment Attachment) error {
+	r, err := attachment.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	content := bufio.NewReaderSize(r, 512)
+	head, err := content.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	buf.WriteString(fmt.Sprintf("Content-Type: %s\r\n", attachment.detectContentType(head)))
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	// non-ascii file names are encoded as in RFC 2231
+	if attachment.ContentID != "" {
+		buf.WriteString(fmt.Sprintf("Content-Disposition: %s\r\n", mime.FormatMediaType("inline", map[string]string{"filename": attachment.Name})))
+		buf.WriteString(fmt.Sprintf("Content-ID: <%s>\r\n", attachment.ContentID))
+	} else {
+		buf.WriteString(fmt.Sprintf("Content-Disposition: %s\r\n", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})))
+	}
+	buf.WriteString("\r\n")
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: buf})
+	_, err = io.Copy(encoder, content)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
 
-			b := make([]byte, base64.StdEncoding.EncodedLen(len(fileContent)))
-			base64.StdEncoding.Encode(b, fileContent)
-			buf.Write(b)
-			file.Close()
+// the longest header line before it's folded, as recommended by RFC 5322
+const maxHeaderLineLength = 78
+
+// write the header folded before the whitespaces to keep its lines short, the value is kept as it is,
+// so unfolding it gives it back. A first word too long for the field line, like an encoded word, starts
+// on the next line, a word longer than a line is kept whole, line breaks in the value are removed so no
+// header can be injected
+func writeHeader(buf mimeWriter, name string, value string) {
+	value = removeLineBreaks(value)
+	line := name + ": "
+	start := 0 // the part of the value not added to the lines yet
+	for i := 1; i <= len(value); i++ {
+		// the words end where a run of whitespace starts, the whitespace goes with the next word
+		if i < len(value) && (!isWhitespace(value[i]) || isWhitespace(value[i-1])) {
+			continue
+		}
+		if start > 0 && len(line)+i-start > maxHeaderLineLength {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		} else if start == 0 && len(line)+i > maxHeaderLineLength && 1+i <= maxHeaderLineLength {
+			// folded right after the colon, the space before the value becomes the folding whitespace
+			buf.WriteString(name + ":\r\n")
+			line = " "
 		}
+		line += value[start:i]
+		start = i
 	}
-	buf.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary))
-	m.resetMessageProps()
-	return buf.Bytes()
+	buf.WriteString(line + "\r\n")
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// the headers built from the message fields, the extra headers can't set them
+var builtHeaders = map[string]bool{
+	"From":         true,
+	"To":           true,
+	"Cc":           true,
+	"Bcc":          true,
+	"Reply-To":     true,
+	"Subject":      true,
+	"Mime-Version": true,
+}
+
+// check the names of the extra headers, a name must be a field name as in RFC 5322, printable
+// ascii without the colon, so no header can be injected through it, and must not be a built header
+func checkHeaders(headers map[string]string) error {
+	for k := range headers {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool { return r < 33 || r > 126 || r == ':' }) >= 0 {
+			return fmt.Errorf("%w: the name %q isn't a valid field name", ErrInvalidHeader, k)
+		}
+		name := textproto.CanonicalMIMEHeaderKey(k)
+		if builtHeaders[name] || strings.HasPrefix(name, "Content-") {
+			return fmt.Errorf("%w: %s is set from the message fields", ErrInvalidHeader, name)
+		}
+	}
+	return nil
+}
+
+// encode the header value as in RFC 2047 when it isn't plain ascii,
+// long values are split into several encoded words so they can be folded
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("UTF-8", removeLineBreaks(value))
+}
+
+func removeLineBreaks(value string) string {
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+// the addresses separated by commas, the non-ascii names are encoded as in RFC 2047
+func formatAddressList(list []mail.Address) string {
+	addresses := make([]string, len(list))
+	for i, v := range list {
+		addresses[i] = v.String()
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// a unique Message-ID in the domain of the sender
+func newMessageID(from string) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain), nil
+}
+
+func randomBoundary() string {
+	return multipart.NewWriter(nil).Boundary()
 }
 
 func (m *messageBuilder) resetMessageProps() {
@@ -123,3 +540,76 @@ func (m *messageBuilder) resetMessageProps() {
 	m.htmlBody = ""
 	m.plainTextBody = ""
 }
+
+// read the attachments given as readers into memory, so the message can be sent more than once
+func (m *Message) bufferAttachments() (*Message, error) {
+	var hasReaders bool
+	for _, v := range m.Attachments {
+		if v.Reader != nil {
+			hasReaders = true
+		}
+	}
+	if !hasReaders {
+		return m, nil
+	}
+	c := m.Clone()
+	for i, v := range c.Attachments {
+		if v.Reader == nil {
+			continue
+		}
+		content, err := io.ReadAll(v.Reader)
+		if err != nil {
+			return nil, err
+		}
+		c.Attachments[i].Reader = nil
+		c.Attachments[i].Content = content
+	}
+	return c, nil
+}
+
+// open the attachment's content, from the reader, the content in memory or the file, in that order
+func (a Attachment) open() (io.ReadCloser, error) {
+	if a.Reader != nil {
+		return io.NopCloser(a.Reader), nil
+	}
+	if a.Content != nil {
+		return io.NopCloser(bytes.NewReader(a.Content)), nil
+	}
+	return os.Open(a.Path)
+}
+
+// read the whole attachment's content
+func (a Attachment) readAll() ([]byte, error) {
+	r, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// the attachment's content type, detected from the beginning of the content when not set
+func (a Attachment) detectContentType(head []byte) string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	return http.DetectContentType(head)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddress(list []mail.Address, address mail.Address) bool {
+	for _, v := range list {
+		if strings.EqualFold(v.Address, address.Address) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,23 @@
 package mailing
 
 import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/mail"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+var updateGolden = flag.Bool("update", false, "update the golden files in testingdata/golden")
+
 func TestBuild(t *testing.T) {
 	m := newMessageBuilder()
 	m.setFrom(mail.Address{
@@ -33,6 +45,7 @@ func TestBuild(t *testing.T) {
 		},
 	})
 	m.setSubject("the subject")
+	m.setHeaders(map[string]string{"X-Test-Header": "test value"})
 	m.setHTMLBody("this is html body")
 	m.setAttachments([]Attachment{
 		{
@@ -44,19 +57,26 @@ func TestBuild(t *testing.T) {
 			Path: "./testingdata/attachment2.md",
 		},
 	})
-	message := string(m.build())
+	built, err := m.build()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	message := string(built)
 	if !strings.Contains(message, `From: "from test name" <from@mail.com>`) {
 		t.Error("Failed test build")
 	}
-	if !strings.Contains(message, `To: "to test name1" <to1@mail.com>;"to test name2" <to2@mail.com>`) {
+	if !strings.Contains(message, `To: "to test name1" <to1@mail.com>, "to test name2" <to2@mail.com>`) {
 		t.Error("Failed test build")
 	}
-	if !strings.Contains(message, `Cc: "tcc test name1" <cc1@mail.com>;"cc test name2" <cc2@mail.com>`) {
+	if !strings.Contains(message, `Cc: "tcc test name1" <cc1@mail.com>, "cc test name2" <cc2@mail.com>`) {
 		t.Error("Failed test build")
 	}
 	if !strings.Contains(message, `Subject: the subject`) {
 		t.Error("Failed test build")
 	}
+	if !strings.Contains(message, "X-Test-Header: test value\r\n") {
+		t.Error("Failed test build")
+	}
 	if !strings.Contains(message, `Content-Type: text/html; charset="UTF-8"`) {
 		t.Error("Failed test build")
 	}
@@ -77,7 +97,11 @@ func TestBuild(t *testing.T) {
 	}
 	m.setHTMLBody("")
 	m.setPlainTextBody("this is plain text body")
-	message = string(m.build())
+	built, err = m.build()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	message = string(built)
 	if !strings.Contains(message, `Content-Type: text/plain; charset="UTF-8"`) {
 		t.Error("Failed test build")
 	}
@@ -85,3 +109,403 @@ func TestBuild(t *testing.T) {
 		t.Error("Failed test build")
 	}
 }
+
+func TestBuildAlternativeBodies(t *testing.T) {
+	m := newMessageBuilder()
+	m.setFrom(mail.Address{Address: "from@mail.com"})
+	m.setToList([]mail.Address{{Address: "to@mail.com"}})
+	m.setSubject("the subject")
+	m.setHTMLBody("this is html body")
+	m.setPlainTextBody("this is plain text body")
+	m.setAttachments([]Attachment{
+		{
+			Name: "attachment name1",
+			Path: "./testingdata/attachment1.md",
+		},
+	})
+	built, err := m.build()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(built))
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatal("Failed test build")
+	}
+	mixed := multipart.NewReader(parsed.Body, params["boundary"])
+	part, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatal("Failed test build")
+	}
+	alternative := multipart.NewReader(part, params["boundary"])
+	var types, bodies []string
+	for {
+		p, err := alternative.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	if strings.Join(types, ",") != `text/plain; charset="UTF-8",text/html; charset="UTF-8"` {
+		t.Error("Failed test build")
+	}
+	if strings.Join(bodies, ",") != "this is plain text body,this is html body" {
+		t.Error("Failed test build")
+	}
+	part, err = mixed.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	if part.FileName() != "attachment name1" {
+		t.Error("Failed test build")
+	}
+}
+
+func TestBuildInlineAttachments(t *testing.T) {
+	m := newMessageBuilder()
+	m.setFrom(mail.Address{Address: "from@mail.com"})
+	m.setToList([]mail.Address{{Address: "to@mail.com"}})
+	m.setSubject("the subject")
+	m.setHTMLBody(`<img src="cid:logo">`)
+	m.setAttachments([]Attachment{
+		{
+			Name: "attachment name1",
+			Path: "./testingdata/attachment1.md",
+		},
+		{
+			Name:      "logo.png",
+			Path:      "./testingdata/logo.png",
+			ContentID: "logo",
+		},
+	})
+	built, err := m.build()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(built))
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	_, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	mixed := multipart.NewReader(parsed.Body, params["boundary"])
+	part, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/related" {
+		t.Fatal("Failed test build")
+	}
+	related := multipart.NewReader(part, params["boundary"])
+	body, err := related.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	if body.Header.Get("Content-Type") != `text/html; charset="UTF-8"` {
+		t.Error("Failed test build")
+	}
+	inline, err := related.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	if inline.Header.Get("Content-ID") != "<logo>" || inline.Header.Get("Content-Type") != "image/png" {
+		t.Error("Failed test build")
+	}
+	if !strings.HasPrefix(inline.Header.Get("Content-Disposition"), "inline") {
+		t.Error("Failed test build")
+	}
+	_, err = related.NextPart()
+	if err != io.EOF {
+		t.Error("Failed test build")
+	}
+	attachment, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	if attachment.FileName() != "attachment name1" || !strings.HasPrefix(attachment.Header.Get("Content-Disposition"), "attachment") {
+		t.Error("Failed test build")
+	}
+}
+
+func TestBuildInMemoryAttachments(t *testing.T) {
+	m := newMessageBuilder()
+	m.setFrom(mail.Address{Address: "from@mail.com"})
+	m.setToList([]mail.Address{{Address: "to@mail.com"}})
+	m.setSubject("the subject")
+	m.setPlainTextBody("this is plain text body")
+	m.setAttachments([]Attachment{
+		{
+			Name:        "report.pdf",
+			Content:     []byte("%PDF-1.4 this is the report"),
+			ContentType: "application/pdf",
+		},
+		{
+			Name:   "data.csv",
+			Reader: strings.NewReader(strings.Repeat("a,b,c\n", 1000)),
+		},
+	})
+	built, err := m.build()
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(built))
+	if err != nil {
+		t.Fatal("Failed test build", err)
+	}
+	_, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	mixed := multipart.NewReader(parsed.Body, params["boundary"])
+	mixed.NextPart()
+	var names, types, contents []string
+	for {
+		part, err := mixed.NextPart()
+		if err != nil {
+			break
+		}
+		encoded, _ := io.ReadAll(part)
+		decoded, _ := base64.StdEncoding.DecodeString(string(encoded))
+		names = append(names, part.FileName())
+		types = append(types, part.Header.Get("Content-Type"))
+		contents = append(contents, string(decoded))
+	}
+	if strings.Join(names, ",") != "report.pdf,data.csv" {
+		t.Fatal("Failed test build")
+	}
+	if types[0] != "application/pdf" || types[1] != "text/plain; charset=utf-8" {
+		t.Error("Failed test build")
+	}
+	if contents[0] != "%PDF-1.4 this is the report" || contents[1] != strings.Repeat("a,b,c\n", 1000) {
+		t.Error("Failed test build")
+	}
+
+	m.setAttachments([]Attachment{{Name: "missing", Path: "./testingdata/missing.md"}})
+	_, err = m.build()
+	if err == nil {
+		t.Error("Failed test build")
+	}
+}
+
+func TestMessageBufferAttachments(t *testing.T) {
+	msg := &Message{
+		Attachments: []Attachment{
+			{Name: "attachment name1", Path: "./testingdata/attachment1.md"},
+			{Name: "data.csv", Reader: strings.NewReader("a,b,c")},
+		},
+	}
+	buffered, err := msg.bufferAttachments()
+	if err != nil {
+		t.Fatal("Failed test buffer attachments", err)
+	}
+	if buffered == msg || buffered.Attachments[1].Reader != nil || string(buffered.Attachments[1].Content) != "a,b,c" {
+		t.Error("Failed test buffer attachments")
+	}
+	if msg.Attachments[1].Reader == nil {
+		t.Error("Failed test buffer attachments")
+	}
+	for i := 0; i < 2; i++ {
+		content, err := buffered.Attachments[1].readAll()
+		if err != nil || string(content) != "a,b,c" {
+			t.Error("Failed test buffer attachments")
+		}
+	}
+}
+
+func TestBuildGolden(t *testing.T) {
+	var manyRecipients []mail.Address
+	for i := 1; i <= 6; i++ {
+		manyRecipients = append(manyRecipients, mail.Address{Name: fmt.Sprintf("recipient number %d", i), Address: fmt.Sprintf("recipient%d@mail.com", i)})
+	}
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"plain", &Message{
+			From:          mail.Address{Name: "from name", Address: "from@mail.com"},
+			To:            []mail.Address{{Name: "to name", Address: "to@mail.com"}},
+			Subject:       "the subject",
+			PlainTextBody: "this is plain text body",
+		}},
+		{"non-ascii", &Message{
+			From:          mail.Address{Name: "هاران علي", Address: "from@mail.com"},
+			To:            []mail.Address{{Name: "Zoë Müller", Address: "to@mail.com"}},
+			CC:            []mail.Address{{Address: "cc@mail.com"}},
+			Subject:       "مرحبا بالعالم 🎉 this subject is long enough to be split into several encoded words",
+			Headers:       map[string]string{"X-Campaign": "résumé"},
+			HTMLBody:      "<p>مرحبا</p>",
+			PlainTextBody: "مرحبا",
+		}},
+		{"non-ascii-subject", &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            []mail.Address{{Address: "to@mail.com"}},
+			Subject:       "مرحبا بالعالم، هذا عنوان طويل باللغة العربية لا يتسع في سطر واحد",
+			PlainTextBody: "مرحبا",
+		}},
+		{"folding", &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            manyRecipients,
+			CC:            manyRecipients[:3],
+			ReplyTo:       []mail.Address{{Name: "support", Address: "support@mail.com"}},
+			Subject:       "a long plain ascii subject that does not fit on a single header line of seventy eight characters",
+			Headers:       map[string]string{"Message-ID": "<custom@mail.com>", "X-Injected": "value\r\nBcc: someone@mail.com"},
+			PlainTextBody: "this is plain text body",
+		}},
+		{"encodings", &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            []mail.Address{{Address: "to@mail.com"}},
+			Subject:       "the subject",
+			PlainTextBody: "Café au lait, crème brûlée. " + strings.Repeat("a very long line ", 10),
+			HTMLBody:      "<p>مرحبا بالعالم</p>",
+			Attachments:   []Attachment{{Name: "data.bin", Content: bytes.Repeat([]byte{0, 1, 2, 254, 255}, 40), ContentType: "application/octet-stream"}},
+		}},
+		{"attachments", &Message{
+			From:     mail.Address{Address: "from@mail.com"},
+			To:       []mail.Address{{Address: "to@mail.com"}},
+			Subject:  "the subject",
+			HTMLBody: `<img src="cid:logo">`,
+			Attachments: []Attachment{
+				{Name: "attachment name1", Path: "./testingdata/attachment1.md"},
+				{Name: "تقرير.txt", Content: []byte("the report"), ContentType: "text/plain"},
+				{Name: "logo.png", Content: []byte("not really a png"), ContentType: "image/png", ContentID: "logo"},
+			},
+		}},
+	}
+	for _, test := range tests {
+		m := newMessageBuilder().
+			setSubject(test.msg.Subject).
+			setHTMLBody(test.msg.HTMLBody).
+			setPlainTextBody(test.msg.PlainTextBody).
+			setFrom(test.msg.From).
+			setToList(test.msg.To).
+			setCCList(test.msg.CC).
+			setReplyToList(test.msg.ReplyTo).
+			setAttachments(test.msg.Attachments).
+			setHeaders(test.msg.Headers)
+		m.date = time.Date(2023, time.May, 1, 10, 30, 0, 0, time.UTC)
+		m.messageID = "<0123456789abcdef@mail.com>"
+		boundaries := 0
+		m.boundary = func() string {
+			boundaries++
+			return fmt.Sprintf("boundary%d", boundaries)
+		}
+		built, err := m.build()
+		if err != nil {
+			t.Fatal("Failed test build golden", test.name, err)
+		}
+		golden := filepath.Join("testingdata", "golden", test.name+".eml")
+		if *updateGolden {
+			err = os.WriteFile(golden, built, 0644)
+			if err != nil {
+				t.Fatal("Failed test build golden", test.name, err)
+			}
+		}
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal("Failed test build golden", test.name, err)
+		}
+		if !bytes.Equal(built, expected) {
+			t.Errorf("Failed test build golden %s, got:\n%s", test.name, built)
+		}
+
+		// every header line is short, and the headers decode back to the original values
+		header, _, _ := bytes.Cut(built, []byte("\r\n\r\n"))
+		for _, line := range strings.Split(string(header), "\r\n") {
+			if len(line) > maxHeaderLineLength && !strings.HasPrefix(line, "Content-") {
+				t.Errorf("Failed test build golden %s, line too long: %s", test.name, line)
+			}
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(built))
+		if err != nil {
+			t.Fatal("Failed test build golden", test.name, err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+		if err != nil || subject != test.msg.Subject {
+			t.Error("Failed test build golden", test.name)
+		}
+		to, err := parsed.Header.AddressList("To")
+		if err != nil || len(to) != len(test.msg.To) || to[0].Name != test.msg.To[0].Name {
+			t.Error("Failed test build golden", test.name)
+		}
+		if parsed.Header.Get("Bcc") != "" {
+			t.Error("Failed test build golden", test.name)
+		}
+	}
+}
+
+func TestTextTransferEncoding(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{"", "7bit"},
+		{"plain ascii text\r\nwith lines\n", "7bit"},
+		{strings.Repeat("a", 998) + "\n" + strings.Repeat("a", 998), "7bit"},
+		{strings.Repeat("a", 999), "quoted-printable"},
+		{"a bare\rcarriage return", "quoted-printable"},
+		{"mostly ascii with an accent: café", "quoted-printable"},
+		{"مرحبا بالعالم", "base64"},
+		{"🎉🎉🎉", "base64"},
+	}
+	for _, test := range tests {
+		if textTransferEncoding(test.body) != test.expected {
+			t.Errorf("Failed test text transfer encoding of %q", test.body)
+		}
+	}
+}
+
+func TestLineWrapper(t *testing.T) {
+	var buf bytes.Buffer
+	w := &lineWrapper{w: &buf}
+	for _, v := range []string{strings.Repeat("a", 50), strings.Repeat("b", 50), strings.Repeat("c", 100)} {
+		n, err := w.Write([]byte(v))
+		if err != nil || n != len(v) {
+			t.Fatal("Failed test line wrapper")
+		}
+	}
+	lines := strings.Split(buf.String(), "\r\n")
+	if len(lines) != 3 || len(lines[0]) != 76 || len(lines[1]) != 76 || len(lines[2]) != 48 {
+		t.Error("Failed test line wrapper")
+	}
+	if lines[0] != strings.Repeat("a", 50)+strings.Repeat("b", 26) {
+		t.Error("Failed test line wrapper")
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	long := strings.Repeat("a", 90)
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", "X-Test: \r\n"},
+		{"a short value", "X-Test: a short value\r\n"},
+		// the whitespaces are kept as they are
+		{"two  spaces\tand a tab", "X-Test: two  spaces\tand a tab\r\n"},
+		{strings.Repeat("word ", 14) + " double", "X-Test: " + strings.TrimSuffix(strings.Repeat("word ", 14), " ") + "\r\n  double\r\n"},
+		// a first word too long for the field line starts on the next line
+		{"=?UTF-8?q?" + strings.Repeat("=D8=A7", 8) + "?= next", "X-Test: =?UTF-8?q?" + strings.Repeat("=D8=A7", 8) + "?= next\r\n"},
+		{"=?UTF-8?q?" + strings.Repeat("=D8=A7", 10) + "?= next", "X-Test:\r\n =?UTF-8?q?" + strings.Repeat("=D8=A7", 10) + "?= next\r\n"},
+		// unless it doesn't fit on a line of its own either, it's kept whole on the field line
+		{long + " next", "X-Test: " + long + "\r\n next\r\n"},
+		{"line\r\nBcc: someone@mail.com", "X-Test: line Bcc: someone@mail.com\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeHeader(&buf, "X-Test", test.value)
+		if buf.String() != test.expected {
+			t.Errorf("Failed test write header, got %q", buf.String())
+		}
+		// unfolding the header gives the value back
+		unfolded := strings.TrimPrefix(strings.ReplaceAll(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n", ""), "X-Test: ")
+		if unfolded != removeLineBreaks(test.value) {
+			t.Errorf("Failed test write header, unfolded %q", unfolded)
+		}
+	}
+}
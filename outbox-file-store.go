@@ -0,0 +1,237 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the file suffixes of the entries' states and messages
+const (
+	outboxEntrySuffix   = ".entry.json"
+	outboxMessageSuffix = ".message.json"
+)
+
+// FileOutboxStore is an OutboxStore that keeps every entry in its own files in a directory,
+// it needs no database but the directory must be used by a single process. Every file is
+// written to a temporary file first then renamed, so a crash never leaves a partly written entry.
+// The sent and failed entries are kept until Prune deletes them
+type FileOutboxStore struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*OutboxEntry // the states of the entries, their messages stay in the files
+	keys    map[string]string       // the ids of the entries by idempotency key
+	active  map[string]*OutboxEntry // the pending and sending entries, the ones Claim looks at
+}
+
+// NewFileOutboxStore opens the store in the directory, it's created when it doesn't exist
+func NewFileOutboxStore(dir string) (*FileOutboxStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+outboxEntrySuffix))
+	if err != nil {
+		return nil, err
+	}
+	s := &FileOutboxStore{
+		dir:     dir,
+		entries: make(map[string]*OutboxEntry),
+		keys:    make(map[string]string),
+		active:  make(map[string]*OutboxEntry),
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entry := &OutboxEntry{}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			return nil, err
+		}
+		s.set(entry)
+	}
+	return s, nil
+}
+
+// Add stores the entry's message then its state
+func (s *FileOutboxStore) Add(ctx context.Context, entry *OutboxEntry) (*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.keys[entry.IdempotencyKey]; ok && entry.IdempotencyKey != "" {
+		return s.load(s.entries[id])
+	}
+	message, err := MarshalOutboxMessage(entry.Message)
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeFile(entry.ID+outboxMessageSuffix, message)
+	if err != nil {
+		return nil, err
+	}
+	stored := *entry
+	stored.Message = nil
+	err = s.writeState(&stored)
+	if err != nil {
+		return nil, err
+	}
+	s.set(&stored)
+	return entry, nil
+}
+
+// Claim reserves the due entries, the earliest due first
+func (s *FileOutboxStore) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*OutboxEntry
+	for _, v := range s.active {
+		if !v.NextAttemptAt.After(now) {
+			due = append(due, v)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	var claimed []*OutboxEntry
+	for _, v := range due {
+		entry, err := s.load(v)
+		if err != nil {
+			return claimed, err
+		}
+		state := *v
+		state.Status, state.NextAttemptAt, state.UpdatedAt = OutboxSending, until, now
+		err = s.writeState(&state)
+		if err != nil {
+			return claimed, err
+		}
+		*v = state
+		entry.Status, entry.NextAttemptAt, entry.UpdatedAt = state.Status, state.NextAttemptAt, state.UpdatedAt
+		claimed = append(claimed, entry)
+	}
+	return claimed, nil
+}
+
+// Update saves the entry's state
+func (s *FileOutboxStore) Update(ctx context.Context, entry *OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[entry.ID] == nil {
+		return ErrOutboxEntryNotFound
+	}
+	state := *entry
+	state.Message = nil
+	state.Accepted = append([]string(nil), entry.Accepted...)
+	err := s.writeState(&state)
+	if err != nil {
+		return err
+	}
+	s.set(&state)
+	return nil
+}
+
+// Prune deletes the sent and failed entries last updated before the time, their idempotency keys
+// can be enqueued again afterwards, it returns the number of deleted entries
+func (s *FileOutboxStore) Prune(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for id, v := range s.entries {
+		if s.active[id] != nil || !v.UpdatedAt.Before(before) {
+			continue
+		}
+		// the state goes first, a message file left alone is never read
+		for _, suffix := range []string{outboxEntrySuffix, outboxMessageSuffix} {
+			err := os.Remove(filepath.Join(s.dir, id+suffix))
+			if err != nil && !os.IsNotExist(err) {
+				return pruned, err
+			}
+		}
+		delete(s.entries, id)
+		if v.IdempotencyKey != "" {
+			delete(s.keys, v.IdempotencyKey)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// keep the entry's state, in the active entries while it isn't sent or failed
+func (s *FileOutboxStore) set(state *OutboxEntry) {
+	s.entries[state.ID] = state
+	if state.IdempotencyKey != "" {
+		s.keys[state.IdempotencyKey] = state.ID
+	}
+	if state.Status == OutboxPending || state.Status == OutboxSending {
+		s.active[state.ID] = state
+	} else {
+		delete(s.active, state.ID)
+	}
+}
+
+// Get returns the entry with its message
+func (s *FileOutboxStore) Get(ctx context.Context, id string) (*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.entries[id]
+	if !ok {
+		return nil, ErrOutboxEntryNotFound
+	}
+	return s.load(state)
+}
+
+// a copy of the state with the message read from its file
+func (s *FileOutboxStore) load(state *OutboxEntry) (*OutboxEntry, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, state.ID+outboxMessageSuffix))
+	if err != nil {
+		return nil, err
+	}
+	entry := *state
+	entry.Accepted = append([]string(nil), state.Accepted...)
+	entry.Message, err = UnmarshalOutboxMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *FileOutboxStore) writeState(state *OutboxEntry) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(state.ID+outboxEntrySuffix, data)
+}
+
+// write the file through a temporary file renamed once its content is synced
+func (s *FileOutboxStore) writeFile(name string, data []byte) error {
+	if strings.ContainsAny(name, `/\`) {
+		return os.ErrInvalid
+	}
+	tmp, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultOutboxTable = "mailing_outbox"
+
+// SQLOutboxConfig is the configuration of an SQLOutboxStore
+type SQLOutboxConfig struct {
+	Table              string // the name of the table, defaults to "mailing_outbox"
+	DollarPlaceholders bool   // the queries use $1, $2... like PostgreSQL wants, instead of ?
+}
+
+// SQLOutboxStore is an OutboxStore that keeps the entries in a database through database/sql, several
+// processes can share the table, an entry is claimed by a single one of them. The times are stored as
+// unix nanoseconds and the messages as JSON, the table is created by CreateTable or by hand with:
+//
+//	CREATE TABLE mailing_outbox (
+//		id VARCHAR(64) PRIMARY KEY,
+//		idempotency_key VARCHAR(255) UNIQUE,
+//		message TEXT NOT NULL,
+//		status VARCHAR(16) NOT NULL,
+//		attempts INTEGER NOT NULL,
+//		next_attempt_at BIGINT NOT NULL,
+//		accepted TEXT NOT NULL,
+//		last_error TEXT NOT NULL,
+//		created_at BIGINT NOT NULL,
+//		updated_at BIGINT NOT NULL
+//	)
+type SQLOutboxStore struct {
+	db     *sql.DB
+	config SQLOutboxConfig
+}
+
+// the columns read by the queries, in the order of scanEntry
+const sqlOutboxColumns = "id, idempotency_key, message, status, attempts, next_attempt_at, accepted, last_error, created_at, updated_at"
+
+// NewSQLOutboxStore returns a store that uses the table of the database
+func NewSQLOutboxStore(db *sql.DB, config SQLOutboxConfig) *SQLOutboxStore {
+	if config.Table == "" {
+		config.Table = defaultOutboxTable
+	}
+	return &SQLOutboxStore{db: db, config: config}
+}
+
+// CreateTable creates the table and its index when they don't exist, the statements suit SQLite and
+// PostgreSQL, with other databases the table can be created by hand, MySQL would use LONGTEXT for the messages
+func (s *SQLOutboxStore) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id VARCHAR(64) PRIMARY KEY,
+	idempotency_key VARCHAR(255) UNIQUE,
+	message TEXT NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	attempts INTEGER NOT NULL,
+	next_attempt_at BIGINT NOT NULL,
+	accepted TEXT NOT NULL,
+	last_error TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+)`, s.config.Table))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_due ON %s (status, next_attempt_at)", s.config.Table, s.config.Table))
+	return err
+}
+
+// Add inserts the entry, the existing entry is looked up first and again when
+// the insert fails, in case another process added the same key in between
+func (s *SQLOutboxStore) Add(ctx context.Context, entry *OutboxEntry) (*OutboxEntry, error) {
+	if entry.IdempotencyKey != "" {
+		existing, err := s.getBy(ctx, "idempotency_key", entry.IdempotencyKey)
+		if !errors.Is(err, ErrOutboxEntryNotFound) {
+			return existing, err
+		}
+	}
+	message, err := MarshalOutboxMessage(entry.Message)
+	if err != nil {
+		return nil, err
+	}
+	accepted, err := json.Marshal(entry.Accepted)
+	if err != nil {
+		return nil, err
+	}
+	key := sql.NullString{String: entry.IdempotencyKey, Valid: entry.IdempotencyKey != ""}
+	_, err = s.db.ExecContext(ctx, s.query("INSERT INTO %s ("+sqlOutboxColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		entry.ID, key, string(message), string(entry.Status), entry.Attempts, entry.NextAttemptAt.UnixNano(),
+		string(accepted), entry.LastError, entry.CreatedAt.UnixNano(), entry.UpdatedAt.UnixNano())
+	if err != nil && entry.IdempotencyKey != "" {
+		existing, getErr := s.getBy(ctx, "idempotency_key", entry.IdempotencyKey)
+		if getErr == nil {
+			return existing, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Claim selects the due entries, the earliest due first, then reserves them one by one, an update
+// only succeeds when the entry is still as it was selected, so no two processes claim the same entry
+func (s *SQLOutboxStore) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]*OutboxEntry, error) {
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT "+sqlOutboxColumns+" FROM %s WHERE status IN (?, ?) AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?"),
+		string(OutboxPending), string(OutboxSending), now.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	var due []*OutboxEntry
+	for rows.Next() {
+		entry, err := scanOutboxEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, entry)
+	}
+	// the rows are closed before updating, some databases allow a single statement at once
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var claimed []*OutboxEntry
+	for _, v := range due {
+		result, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET status = ?, next_attempt_at = ?, updated_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?"),
+			string(OutboxSending), until.UnixNano(), now.UnixNano(), v.ID, string(v.Status), v.NextAttemptAt.UnixNano())
+		if err != nil {
+			return claimed, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			continue
+		}
+		v.Status, v.NextAttemptAt, v.UpdatedAt = OutboxSending, until, now
+		claimed = append(claimed, v)
+	}
+	return claimed, nil
+}
+
+// Update saves the entry's state
+func (s *SQLOutboxStore) Update(ctx context.Context, entry *OutboxEntry) error {
+	accepted, err := json.Marshal(entry.Accepted)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET status = ?, attempts = ?, next_attempt_at = ?, accepted = ?, last_error = ?, updated_at = ? WHERE id = ?"),
+		string(entry.Status), entry.Attempts, entry.NextAttemptAt.UnixNano(), string(accepted), entry.LastError, entry.UpdatedAt.UnixNano(), entry.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrOutboxEntryNotFound
+	}
+	return nil
+}
+
+// Prune deletes the sent and failed entries last updated before the time, their idempotency keys
+// can be enqueued again afterwards, it returns the number of deleted entries
+func (s *SQLOutboxStore) Prune(ctx context.Context, before time.Time) (int, error) {
+	result, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE status IN (?, ?) AND updated_at < ?"),
+		string(OutboxSent), string(OutboxFailed), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Get returns the entry with its message
+func (s *SQLOutboxStore) Get(ctx context.Context, id string) (*OutboxEntry, error) {
+	return s.getBy(ctx, "id", id)
+}
+
+func (s *SQLOutboxStore) getBy(ctx context.Context, column string, value string) (*OutboxEntry, error) {
+	row := s.db.QueryRowContext(ctx, s.query("SELECT "+sqlOutboxColumns+" FROM %s WHERE "+column+" = ?"), value)
+	entry, err := scanOutboxEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOutboxEntryNotFound
+	}
+	return entry, err
+}
+
+// the query with the table's name and the database's placeholders
+func (s *SQLOutboxStore) query(query string) string {
+	query = fmt.Sprintf(query, s.config.Table)
+	if !s.config.DollarPlaceholders {
+		return query
+	}
+	var b strings.Builder
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// scanOutboxEntry reads the columns of sqlOutboxColumns from *sql.Row or *sql.Rows
+func scanOutboxEntry(row interface{ Scan(...interface{}) error }) (*OutboxEntry, error) {
+	var entry OutboxEntry
+	var key sql.NullString
+	var message, status, accepted string
+	var nextAttemptAt, createdAt, updatedAt int64
+	err := row.Scan(&entry.ID, &key, &message, &status, &entry.Attempts, &nextAttemptAt, &accepted, &entry.LastError, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.IdempotencyKey = key.String
+	entry.Status = OutboxStatus(status)
+	entry.NextAttemptAt = time.Unix(0, nextAttemptAt)
+	entry.CreatedAt = time.Unix(0, createdAt)
+	entry.UpdatedAt = time.Unix(0, updatedAt)
+	err = json.Unmarshal([]byte(accepted), &entry.Accepted)
+	if err != nil {
+		return nil, err
+	}
+	entry.Message, err = UnmarshalOutboxMessage([]byte(message))
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
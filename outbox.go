@@ -0,0 +1,407 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrOutboxClosed is returned when a message is enqueued after the outbox was shut down
+	ErrOutboxClosed = errors.New("mailing: the outbox is shut down")
+	// ErrOutboxEntryNotFound is returned by the stores when there is no entry with the id
+	ErrOutboxEntryNotFound = errors.New("mailing: outbox entry not found")
+)
+
+const (
+	defaultOutboxWorkers      = 4
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxLease        = 5 * time.Minute
+	defaultOutboxAttempts     = 5
+	// the longest the workers wait between the claims while the store is failing, unless the poll interval is longer
+	maxOutboxClaimBackoff = time.Minute
+)
+
+// OutboxStatus is where an outbox entry is in its sending
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending" // waiting for its next attempt
+	OutboxSending OutboxStatus = "sending" // claimed by a worker, claimed again when the lease expires
+	OutboxSent    OutboxStatus = "sent"    // every recipient was sent the email
+	OutboxFailed  OutboxStatus = "failed"  // the sending failed permanently or ran out of attempts
+)
+
+// OutboxEntry is a message stored in the outbox with the state of its sending
+type OutboxEntry struct {
+	ID             string
+	IdempotencyKey string   // unique in the store, enqueuing the same key again returns the stored entry
+	Message        *Message `json:"-"`
+	Status         OutboxStatus
+	Attempts       int
+	NextAttemptAt  time.Time // when a pending entry is due, or when the lease of a sending one expires
+	Accepted       []string  // the recipients who were already sent the email, skipped by the next attempts
+	LastError      string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// OutboxStore keeps the outbox entries, the stores must keep the entries across restarts,
+// the message of an entry can be serialized with MarshalOutboxMessage
+type OutboxStore interface {
+	// Add stores the new entry, when an entry with the same idempotency key
+	// exists nothing is stored and the existing entry is returned
+	Add(ctx context.Context, entry *OutboxEntry) (*OutboxEntry, error)
+	// Claim reserves up to limit entries that are pending or sending with a next attempt before now,
+	// it sets their status to sending and their next attempt to until, an entry is never returned
+	// by two calls unless its lease expired
+	Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]*OutboxEntry, error)
+	// Update saves the state of the entry after an attempt, the message is not changed
+	Update(ctx context.Context, entry *OutboxEntry) error
+	// Get returns the entry with the id or ErrOutboxEntryNotFound
+	Get(ctx context.Context, id string) (*OutboxEntry, error)
+}
+
+// OutboxConfig is the configuration of an Outbox
+type OutboxConfig struct {
+	Workers      int                // the messages sent at once, defaults to 4
+	PollInterval time.Duration      // how often the idle workers look for due messages, defaults to 1s
+	Lease        time.Duration      // how long a claimed message is reserved before it's claimed again after a crash, defaults to 5m
+	RetryPolicy  RetryPolicy        // the attempts of every message and the wait between them, the first attempt is tried right away, defaults to 5 attempts
+	OnResult     func(OutboxResult) // optional, called after every attempt from the worker that made it
+	OnError      func(error)        // optional, called when claiming the due messages from the store fails
+}
+
+// OutboxResult is the result of an attempt to send an outbox entry
+type OutboxResult struct {
+	Entry  *OutboxEntry // the entry with its state after the attempt
+	Result *SendResult  // the result of every recipient
+	Err    error
+}
+
+// Outbox stores the messages before they are sent, so they survive restarts, and sends them
+// in the background with a pool of workers. A message is sent at least once: when the process
+// stops while sending, the message is sent again to the recipients that weren't recorded as sent
+type Outbox struct {
+	store    OutboxStore
+	mailer   *Mailer
+	config   OutboxConfig
+	now      func() time.Time
+	ctx      context.Context // the context of the sendings, cancelled when shutting down takes too long
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	done     chan struct{} // closed when all the workers returned
+	closing  chan struct{} // closed when the shutdown starts
+	shutdown sync.Once
+}
+
+// NewOutbox starts the workers that send the messages of the store with the driver
+func NewOutbox(driver Driver, store OutboxStore, config OutboxConfig) *Outbox {
+	if config.Workers <= 0 {
+		config.Workers = defaultOutboxWorkers
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultOutboxPollInterval
+	}
+	if config.Lease <= 0 {
+		config.Lease = defaultOutboxLease
+	}
+	// a transient failure must not fail the message for good
+	if config.RetryPolicy.MaxAttempts <= 0 {
+		config.RetryPolicy.MaxAttempts = defaultOutboxAttempts
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		store:   store,
+		mailer:  NewMailer(driver),
+		config:  config,
+		now:     time.Now,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	o.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go o.work()
+	}
+	go func() {
+		o.workers.Wait()
+		close(o.done)
+	}()
+	return o
+}
+
+// Enqueue stores the message and returns the id of its entry, the message is sent by the workers.
+// The attachments are read and stored with the message. When the idempotency key isn't empty and
+// an entry with the same key exists, the message is not stored again and the existing id is returned
+func (o *Outbox) Enqueue(ctx context.Context, msg *Message, idempotencyKey string) (string, error) {
+	select {
+	case <-o.closing:
+		return "", ErrOutboxClosed
+	default:
+	}
+	msg = msg.Clone()
+	for i, v := range msg.Attachments {
+		content, err := v.readAll()
+		if err != nil {
+			return "", &SendError{Stage: StageBuild, Err: err}
+		}
+		msg.Attachments[i] = Attachment{Name: v.Name, Content: content, ContentType: v.ContentType, ContentID: v.ContentID}
+	}
+	now := o.now()
+	entry, err := o.store.Add(ctx, &OutboxEntry{
+		ID:             uuid.NewString(),
+		IdempotencyKey: idempotencyKey,
+		Message:        msg,
+		Status:         OutboxPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+// claim and send the due messages until the outbox is shut down
+func (o *Outbox) work() {
+	defer o.workers.Done()
+	failures := 0 // the claims that failed in a row
+	for {
+		select {
+		case <-o.closing:
+			return
+		default:
+		}
+		now := o.now()
+		entries, err := o.store.Claim(o.ctx, now, now.Add(o.config.Lease), 1)
+		if err == nil && len(entries) > 0 {
+			failures = 0
+			o.process(entries[0])
+			continue
+		}
+		wait := o.config.PollInterval
+		if err != nil && o.ctx.Err() == nil {
+			// a failing store is reported and polled less often until it recovers
+			failures++
+			if o.config.OnError != nil {
+				o.config.OnError(err)
+			}
+			wait = o.claimBackoff(failures)
+		} else if err == nil {
+			failures = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-o.closing:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// the wait after the given number of failed claims in a row, the poll interval doubled after
+// every failure up to a minute
+func (o *Outbox) claimBackoff(failures int) time.Duration {
+	wait := o.config.PollInterval
+	for i := 1; i < failures && wait < maxOutboxClaimBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxOutboxClaimBackoff && o.config.PollInterval < maxOutboxClaimBackoff {
+		wait = maxOutboxClaimBackoff
+	}
+	return wait
+}
+
+// send a claimed entry and save its state
+func (o *Outbox) process(entry *OutboxEntry) {
+	msg := entry.Message.Clone()
+	// every attempt has the same Message-ID, so the receivers can drop the copies an attempt sent again
+	if !hasHeader(msg.Headers, "Message-ID") {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers["Message-ID"] = outboxMessageID(entry, msg.From)
+	}
+	log := &resultLog{}
+	for _, v := range entry.Accepted {
+		log.record([]mail.Address{{Address: v}}, RecipientResult{Status: RecipientAccepted})
+	}
+	result, err := o.mailer.sendWithLog(o.ctx, msg, log)
+
+	now := o.now()
+	entry.Attempts++
+	entry.UpdatedAt = now
+	entry.Accepted = entry.Accepted[:0]
+	for _, v := range result.Accepted() {
+		entry.Accepted = append(entry.Accepted, v.Address)
+	}
+	entry.LastError = ""
+	if err != nil {
+		entry.LastError = err.Error()
+	}
+	switch {
+	case err == nil:
+		entry.Status = OutboxSent
+	case o.ctx.Err() != nil:
+		// the shutdown cancelled the sending, the attempt doesn't count
+		entry.Status, entry.NextAttemptAt = OutboxPending, now
+		entry.Attempts--
+	case isPermanent(err) || entry.Attempts >= o.config.RetryPolicy.MaxAttempts:
+		entry.Status = OutboxFailed
+	default:
+		var retryAfter time.Duration
+		if sendErr := findSendError(err, (*SendError).Retryable); sendErr != nil {
+			retryAfter = sendErr.RetryAfter
+		}
+		entry.Status = OutboxPending
+		entry.NextAttemptAt = now.Add(o.config.RetryPolicy.backoff(entry.Attempts, retryAfter))
+	}
+	// the state is saved even when the shutdown cancelled the sending
+	updateErr := o.store.Update(context.Background(), entry)
+	if o.config.OnResult != nil {
+		o.config.OnResult(OutboxResult{Entry: entry, Result: result, Err: errors.Join(err, updateErr)})
+	}
+}
+
+// Shutdown stops claiming messages and waits for the in-flight ones to be sent, when the context
+// is done first the sendings are cancelled and the context's error is returned, the cancelled
+// messages stay in the store and are sent by the next outbox
+func (o *Outbox) Shutdown(ctx context.Context) error {
+	o.shutdown.Do(func() {
+		close(o.closing)
+	})
+	select {
+	case <-o.done:
+		o.cancel()
+		return nil
+	case <-ctx.Done():
+		o.cancel()
+		<-o.done
+		return ctx.Err()
+	}
+}
+
+// the Message-ID of every attempt of the entry, made from the idempotency key or the id
+func outboxMessageID(entry *OutboxEntry, from mail.Address) string {
+	key := entry.IdempotencyKey
+	if key == "" {
+		key = entry.ID
+	}
+	hash := sha256.Sum256([]byte(key))
+	domain := "localhost"
+	if i := strings.LastIndex(from.Address, "@"); i >= 0 && i < len(from.Address)-1 {
+		domain = from.Address[i+1:]
+	}
+	return "<" + hex.EncodeToString(hash[:16]) + "@" + domain + ">"
+}
+
+// whether the headers have the named header, the names are compared case-insensitively
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the serialized form of a message, the attachments are stored with their content
+type outboxMessage struct {
+	From          mail.Address
+	To            []mail.Address     `json:",omitempty"`
+	CC            []mail.Address     `json:",omitempty"`
+	BCC           []mail.Address     `json:",omitempty"`
+	ReplyTo       []mail.Address     `json:",omitempty"`
+	Subject       string             `json:",omitempty"`
+	HTMLBody      string             `json:",omitempty"`
+	PlainTextBody string             `json:",omitempty"`
+	Attachments   []outboxAttachment `json:",omitempty"`
+	Headers       map[string]string  `json:",omitempty"`
+	ReturnPath    string             `json:",omitempty"`
+}
+
+type outboxAttachment struct {
+	Name        string
+	Content     []byte
+	ContentType string `json:",omitempty"`
+	ContentID   string `json:",omitempty"`
+}
+
+// MarshalOutboxMessage serializes the message to JSON for the outbox stores,
+// the attachments' files and readers are read and stored with the message
+func MarshalOutboxMessage(msg *Message) ([]byte, error) {
+	stored := outboxMessage{
+		From:          msg.From,
+		To:            msg.To,
+		CC:            msg.CC,
+		BCC:           msg.BCC,
+		ReplyTo:       msg.ReplyTo,
+		Subject:       msg.Subject,
+		HTMLBody:      msg.HTMLBody,
+		PlainTextBody: msg.PlainTextBody,
+		Headers:       msg.Headers,
+		ReturnPath:    msg.ReturnPath,
+	}
+	for _, v := range msg.Attachments {
+		content, err := v.readAll()
+		if err != nil {
+			return nil, err
+		}
+		stored.Attachments = append(stored.Attachments, outboxAttachment{
+			Name:        v.Name,
+			Content:     content,
+			ContentType: v.ContentType,
+			ContentID:   v.ContentID,
+		})
+	}
+	return json.Marshal(stored)
+}
+
+// UnmarshalOutboxMessage parses a message serialized by MarshalOutboxMessage
+func UnmarshalOutboxMessage(data []byte) (*Message, error) {
+	var stored outboxMessage
+	err := json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		From:          stored.From,
+		To:            stored.To,
+		CC:            stored.CC,
+		BCC:           stored.BCC,
+		ReplyTo:       stored.ReplyTo,
+		Subject:       stored.Subject,
+		HTMLBody:      stored.HTMLBody,
+		PlainTextBody: stored.PlainTextBody,
+		Headers:       stored.Headers,
+		ReturnPath:    stored.ReturnPath,
+	}
+	for _, v := range stored.Attachments {
+		if v.Content == nil {
+			v.Content = []byte{}
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Name:        v.Name,
+			Content:     v.Content,
+			ContentType: v.ContentType,
+			ContentID:   v.ContentID,
+		})
+	}
+	return msg, nil
+}
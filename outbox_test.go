@@ -0,0 +1,436 @@
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestOutboxMessageSerialization(t *testing.T) {
+	msg := &Message{
+		From:          mail.Address{Name: "Sender", Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc@mail.com"}},
+		ReplyTo:       []mail.Address{{Address: "reply@mail.com"}},
+		Subject:       "subject",
+		HTMLBody:      "<p>html</p>",
+		PlainTextBody: "text",
+		Headers:       map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@mail.com>"},
+		ReturnPath:    "bounces@mail.com",
+		Attachments: []Attachment{
+			{Name: "attachment1.md", Path: "./testingdata/attachment1.md"},
+			{Name: "reader.txt", Reader: strings.NewReader("from a reader")},
+			{Name: "logo.png", Content: []byte{1, 2, 3}, ContentType: "image/png", ContentID: "logo"},
+		},
+	}
+	data, err := MarshalOutboxMessage(msg)
+	if err != nil {
+		t.Fatal("failed testing outbox message serialization", err)
+	}
+	parsed, err := UnmarshalOutboxMessage(data)
+	if err != nil {
+		t.Fatal("failed testing outbox message serialization", err)
+	}
+	file, _ := os.ReadFile("./testingdata/attachment1.md")
+	if parsed.From != msg.From || parsed.To[0] != msg.To[0] || parsed.BCC[0] != msg.BCC[0] || parsed.ReplyTo[0] != msg.ReplyTo[0] ||
+		parsed.Subject != msg.Subject || parsed.HTMLBody != msg.HTMLBody || parsed.PlainTextBody != msg.PlainTextBody ||
+		parsed.Headers["List-Unsubscribe"] != msg.Headers["List-Unsubscribe"] || parsed.ReturnPath != msg.ReturnPath {
+		t.Error("failed testing outbox message serialization")
+	}
+	if len(parsed.Attachments) != 3 || !bytes.Equal(parsed.Attachments[0].Content, file) || parsed.Attachments[0].Path != "" ||
+		string(parsed.Attachments[1].Content) != "from a reader" || parsed.Attachments[1].Reader != nil ||
+		parsed.Attachments[2].ContentType != "image/png" || parsed.Attachments[2].ContentID != "logo" {
+		t.Error("failed testing outbox message serialization")
+	}
+}
+
+func TestFileOutboxStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileOutboxStore(dir)
+	if err != nil {
+		t.Fatal("failed testing file outbox store", err)
+	}
+	testOutboxStore(t, store)
+
+	// the entries are kept across restarts, the pruned ones are gone
+	reopened, err := NewFileOutboxStore(dir)
+	if err != nil {
+		t.Fatal("failed testing file outbox store", err)
+	}
+	entry, err := reopened.Get(context.Background(), "later")
+	if err != nil || entry.Status != OutboxSending || entry.Message.Subject != "later" {
+		t.Error("failed testing file outbox store", err)
+	}
+	if _, err := reopened.Get(context.Background(), "first"); !errors.Is(err, ErrOutboxEntryNotFound) {
+		t.Error("failed testing file outbox store", err)
+	}
+	if entry, _ := reopened.Add(context.Background(), &OutboxEntry{ID: "new", IdempotencyKey: "key-1"}); entry == nil || entry.ID != "again" {
+		t.Error("failed testing file outbox store")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "first.*")); len(files) != 0 {
+		t.Error("failed testing file outbox store", files)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(leftovers) != 0 {
+		t.Error("failed testing file outbox store")
+	}
+}
+
+func TestSQLOutboxStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("sqlite isn't available", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	store := NewSQLOutboxStore(db, SQLOutboxConfig{})
+	err = store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal("failed testing sql outbox store", err)
+	}
+	// creating the table again does nothing
+	err = store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal("failed testing sql outbox store", err)
+	}
+	testOutboxStore(t, store)
+
+	store = NewSQLOutboxStore(db, SQLOutboxConfig{Table: "sending_outbox"})
+	err = store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal("failed testing sql outbox store", err)
+	}
+	testOutbox(t, store)
+}
+
+func TestSQLOutboxStoreQuery(t *testing.T) {
+	store := NewSQLOutboxStore(nil, SQLOutboxConfig{Table: "emails", DollarPlaceholders: true})
+	if q := store.query("UPDATE %s SET status = ? WHERE id = ?"); q != "UPDATE emails SET status = $1 WHERE id = $2" {
+		t.Error("failed testing sql outbox store query", q)
+	}
+	store = NewSQLOutboxStore(nil, SQLOutboxConfig{})
+	if q := store.query("UPDATE %s SET status = ? WHERE id = ?"); q != "UPDATE mailing_outbox SET status = ? WHERE id = ?" {
+		t.Error("failed testing sql outbox store query", q)
+	}
+}
+
+// the behavior every store shares
+func testOutboxStore(t *testing.T, store OutboxStore) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	add := func(id string, key string, due time.Time) *OutboxEntry {
+		entry, err := store.Add(ctx, &OutboxEntry{
+			ID:             id,
+			IdempotencyKey: key,
+			Message: &Message{
+				From:        mail.Address{Address: "from@mail.com"},
+				To:          []mail.Address{{Address: "to@mail.com"}},
+				Subject:     id,
+				Attachments: []Attachment{{Name: "file.txt", Content: []byte("content")}},
+			},
+			Status:        OutboxPending,
+			NextAttemptAt: due,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+		if err != nil {
+			t.Fatal("failed testing outbox store", err)
+		}
+		return entry
+	}
+	add("first", "key-1", now.Add(-2*time.Second))
+	add("second", "", now.Add(-time.Second))
+	add("later", "", now.Add(time.Hour))
+	// the same idempotency key returns the stored entry
+	if entry := add("duplicate", "key-1", now); entry.ID != "first" || entry.Message.Subject != "first" {
+		t.Error("failed testing outbox store")
+	}
+	if _, err := store.Get(ctx, "duplicate"); !errors.Is(err, ErrOutboxEntryNotFound) {
+		t.Error("failed testing outbox store", err)
+	}
+
+	until := now.Add(time.Minute)
+	claimed, err := store.Claim(ctx, now, until, 1)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != "first" || claimed[0].Status != OutboxSending || !claimed[0].NextAttemptAt.Equal(until) {
+		t.Fatal("failed testing outbox store", err)
+	}
+	if string(claimed[0].Message.Attachments[0].Content) != "content" || claimed[0].IdempotencyKey != "key-1" {
+		t.Error("failed testing outbox store")
+	}
+	// the claimed entry is leased and the later one isn't due
+	claimed2, err := store.Claim(ctx, now, until, 10)
+	if err != nil || len(claimed2) != 1 || claimed2[0].ID != "second" {
+		t.Fatal("failed testing outbox store", err)
+	}
+	if claimed3, _ := store.Claim(ctx, now, until, 10); len(claimed3) != 0 {
+		t.Error("failed testing outbox store")
+	}
+	// the lease expired, the entry is claimed again
+	claimed3, err := store.Claim(ctx, until, until.Add(time.Minute), 10)
+	if err != nil || len(claimed3) != 2 {
+		t.Error("failed testing outbox store", err)
+	}
+
+	entry := claimed[0]
+	entry.Status, entry.Attempts, entry.Accepted, entry.LastError = OutboxSent, 1, []string{"to@mail.com"}, "partly failed"
+	entry.UpdatedAt = now.Add(time.Second)
+	err = store.Update(ctx, entry)
+	if err != nil {
+		t.Fatal("failed testing outbox store", err)
+	}
+	stored, err := store.Get(ctx, "first")
+	if err != nil || stored.Status != OutboxSent || stored.Attempts != 1 || len(stored.Accepted) != 1 || stored.LastError != "partly failed" ||
+		!stored.UpdatedAt.Equal(entry.UpdatedAt) || !stored.CreatedAt.Equal(now) || stored.Message.Subject != "first" {
+		t.Error("failed testing outbox store", err)
+	}
+	if claimed4, _ := store.Claim(ctx, now.Add(2*time.Hour), now.Add(3*time.Hour), 10); len(claimed4) != 2 {
+		t.Error("failed testing outbox store")
+	}
+	if err := store.Update(ctx, &OutboxEntry{ID: "unknown"}); !errors.Is(err, ErrOutboxEntryNotFound) {
+		t.Error("failed testing outbox store", err)
+	}
+
+	// only the finished entries updated before the time are pruned, their keys can be used again
+	pruner := store.(interface {
+		Prune(ctx context.Context, before time.Time) (int, error)
+	})
+	if n, err := pruner.Prune(ctx, now.Add(time.Second)); err != nil || n != 0 {
+		t.Error("failed testing outbox store", n, err)
+	}
+	if n, err := pruner.Prune(ctx, now.Add(3*time.Hour)); err != nil || n != 1 {
+		t.Error("failed testing outbox store", n, err)
+	}
+	if _, err := store.Get(ctx, "first"); !errors.Is(err, ErrOutboxEntryNotFound) {
+		t.Error("failed testing outbox store", err)
+	}
+	if _, err := store.Get(ctx, "later"); err != nil {
+		t.Error("failed testing outbox store", err)
+	}
+	if entry := add("again", "key-1", now); entry.ID != "again" {
+		t.Error("failed testing outbox store")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	store, err := NewFileOutboxStore(t.TempDir())
+	if err != nil {
+		t.Fatal("failed testing outbox", err)
+	}
+	testOutbox(t, store)
+}
+
+// send through an outbox backed by the empty store
+func testOutbox(t *testing.T, store OutboxStore) {
+	var mu sync.Mutex
+	sent := map[string][]*Message{}
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent[msg.Subject] = append(sent[msg.Subject], msg.Clone())
+		switch {
+		case msg.Subject == "rejected":
+			return &SendError{Stage: StageHTTP, StatusCode: 400}
+		case msg.Subject == "flaky" && len(sent[msg.Subject]) < 3:
+			return &SendError{Stage: StageHTTP, StatusCode: 503}
+		}
+		return nil
+	})
+	results := make(chan OutboxResult, 10)
+	outbox := NewOutbox(driver, store, OutboxConfig{
+		Workers:      2,
+		PollInterval: 5 * time.Millisecond,
+		RetryPolicy:  RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond},
+		OnResult:     func(r OutboxResult) { results <- r },
+	})
+	ctx := context.Background()
+	msg := func(subject string) *Message {
+		return &Message{
+			From:        mail.Address{Address: "from@mail.com"},
+			To:          []mail.Address{{Address: "to@mail.com"}},
+			Subject:     subject,
+			Attachments: []Attachment{{Name: "file.txt", Reader: strings.NewReader("content")}},
+		}
+	}
+	flakyID, err := outbox.Enqueue(ctx, msg("flaky"), "order-1")
+	if err != nil {
+		t.Fatal("failed testing outbox", err)
+	}
+	// the same idempotency key is sent once
+	duplicateID, err := outbox.Enqueue(ctx, msg("flaky"), "order-1")
+	if err != nil || duplicateID != flakyID {
+		t.Error("failed testing outbox", err)
+	}
+	rejectedID, err := outbox.Enqueue(ctx, msg("rejected"), "")
+	if err != nil {
+		t.Fatal("failed testing outbox", err)
+	}
+
+	final := map[string]OutboxResult{}
+	for len(final) < 2 {
+		select {
+		case r := <-results:
+			if r.Entry.Status != OutboxPending {
+				final[r.Entry.ID] = r
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("failed testing outbox")
+		}
+	}
+	err = outbox.Shutdown(ctx)
+	if err != nil {
+		t.Error("failed testing outbox", err)
+	}
+	if _, err := outbox.Enqueue(ctx, msg("late"), ""); !errors.Is(err, ErrOutboxClosed) {
+		t.Error("failed testing outbox", err)
+	}
+
+	flaky, err := store.Get(ctx, flakyID)
+	if err != nil || flaky.Status != OutboxSent || flaky.Attempts != 3 || flaky.LastError != "" || final[flakyID].Err != nil {
+		t.Error("failed testing outbox", err)
+	}
+	rejected, err := store.Get(ctx, rejectedID)
+	if err != nil || rejected.Status != OutboxFailed || rejected.Attempts != 1 || rejected.LastError == "" || final[rejectedID].Err == nil {
+		t.Error("failed testing outbox", err)
+	}
+	// every attempt has the same Message-ID and the attachment read from the reader
+	attempts := sent["flaky"]
+	if len(attempts) != 3 {
+		t.Fatal("failed testing outbox")
+	}
+	for _, v := range attempts {
+		if v.Headers["Message-ID"] == "" || v.Headers["Message-ID"] != attempts[0].Headers["Message-ID"] || string(v.Attachments[0].Content) != "content" {
+			t.Error("failed testing outbox")
+		}
+	}
+	if !strings.HasSuffix(attempts[0].Headers["Message-ID"], "@mail.com>") {
+		t.Error("failed testing outbox")
+	}
+}
+
+func TestOutboxRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileOutboxStore(dir)
+	if err != nil {
+		t.Fatal("failed testing outbox recovery", err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	// a process claimed the entry, sent it to the first recipient and stopped
+	_, err = store.Add(ctx, &OutboxEntry{
+		ID: "crashed",
+		Message: &Message{
+			From: mail.Address{Address: "from@mail.com"},
+			To:   []mail.Address{{Address: "to@mail.com"}},
+			BCC:  []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}},
+		},
+		Status:        OutboxSending,
+		Attempts:      1,
+		NextAttemptAt: now.Add(-time.Second),
+		Accepted:      []string{"to@mail.com", "bcc1@mail.com"},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	if err != nil {
+		t.Fatal("failed testing outbox recovery", err)
+	}
+	var rcpts []string
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, to []mail.Address, d Driver) (string, error) {
+		rcpts = append(rcpts, to[0].Address)
+		return "id", nil
+	}
+	done := make(chan OutboxResult, 1)
+	outbox := NewOutbox(sDriver, store, OutboxConfig{Workers: 1, PollInterval: 5 * time.Millisecond, OnResult: func(r OutboxResult) { done <- r }})
+	defer outbox.Shutdown(ctx)
+	select {
+	case r := <-done:
+		if r.Err != nil || r.Entry.Status != OutboxSent || r.Entry.Attempts != 2 || len(r.Entry.Accepted) != 3 || len(r.Result.Accepted()) != 3 {
+			t.Error("failed testing outbox recovery", r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed testing outbox recovery")
+	}
+	// only the recipient who wasn't sent the email is sent it again
+	if len(rcpts) != 1 || rcpts[0] != "bcc2@mail.com" {
+		t.Error("failed testing outbox recovery", rcpts)
+	}
+}
+
+// a store whose claims fail until it's repaired
+type failingOutboxStore struct {
+	OutboxStore
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *failingOutboxStore) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("this is a test error")
+	}
+	return s.OutboxStore.Claim(ctx, now, until, limit)
+}
+
+func TestOutboxClaimError(t *testing.T) {
+	fileStore, err := NewFileOutboxStore(t.TempDir())
+	if err != nil {
+		t.Fatal("failed testing outbox claim error", err)
+	}
+	store := &failingOutboxStore{OutboxStore: fileStore, failures: 3}
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, to []mail.Address, d Driver) (string, error) {
+		return "id", nil
+	}
+	errs := make(chan error, 3)
+	done := make(chan OutboxResult, 1)
+	outbox := NewOutbox(sDriver, store, OutboxConfig{
+		Workers:      1,
+		PollInterval: time.Millisecond,
+		OnResult:     func(r OutboxResult) { done <- r },
+		OnError:      func(err error) { errs <- err },
+	})
+	defer outbox.Shutdown(context.Background())
+	// without a retry policy a transient failure is still tried again
+	if outbox.config.RetryPolicy.MaxAttempts != defaultOutboxAttempts {
+		t.Error("failed testing outbox claim error", outbox.config.RetryPolicy.MaxAttempts)
+	}
+	_, err = outbox.Enqueue(context.Background(), &Message{From: mail.Address{Address: "from@mail.com"}, To: []mail.Address{{Address: "to@mail.com"}}}, "")
+	if err != nil {
+		t.Fatal("failed testing outbox claim error", err)
+	}
+	select {
+	case r := <-done:
+		if r.Err != nil || r.Entry.Status != OutboxSent {
+			t.Error("failed testing outbox claim error", r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed testing outbox claim error")
+	}
+	if len(errs) != 3 {
+		t.Error("failed testing outbox claim error", len(errs))
+	}
+
+	// the wait doubles after every failure up to a minute
+	o := &Outbox{config: OutboxConfig{PollInterval: time.Second}}
+	if o.claimBackoff(1) != time.Second || o.claimBackoff(3) != 4*time.Second || o.claimBackoff(100) != time.Minute {
+		t.Error("failed testing outbox claim error")
+	}
+	o.config.PollInterval = 2 * time.Minute
+	if o.claimBackoff(5) != 2*time.Minute {
+		t.Error("failed testing outbox claim error")
+	}
+}
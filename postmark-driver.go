@@ -0,0 +1,188 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	PostmarkStreamTransactional = "outbound"  // the default transactional message stream
+	PostmarkStreamBroadcast     = "broadcast" // the default broadcast message stream
+)
+
+// the most recipients postmark accepts in a request
+const postmarkMaxRecipients = 50
+
+type PostmarkConfig struct {
+	BaseUrl       string // optional, defaults to https://api.postmarkapp.com
+	ServerToken   string // POSTMARK_SERVER_TOKEN
+	MessageStream string // optional, the id of the message stream, defaults to the transactional stream
+}
+
+type PostmarkDriver struct {
+	config       *PostmarkConfig
+	initiateSend func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error)
+}
+
+// PostmarkError is returned when the Postmark api rejects the email
+type PostmarkError struct {
+	StatusCode int    // the http status code of the response
+	ErrorCode  int    // the postmark api error code, see https://postmarkapp.com/developer/api/overview#error-codes
+	Message    string // the error message returned by the api
+}
+
+func (e *PostmarkError) Error() string {
+	return fmt.Sprintf("postmark error code %d (http status %d): %s", e.ErrorCode, e.StatusCode, e.Message)
+}
+
+type postmarkEmail struct {
+	From          string               `json:"From"`
+	To            string               `json:"To,omitempty"`
+	Cc            string               `json:"Cc,omitempty"`
+	Bcc           string               `json:"Bcc,omitempty"`
+	ReplyTo       string               `json:"ReplyTo,omitempty"`
+	Subject       string               `json:"Subject"`
+	HtmlBody      string               `json:"HtmlBody,omitempty"`
+	TextBody      string               `json:"TextBody,omitempty"`
+	Headers       []postmarkHeader     `json:"Headers,omitempty"`
+	Attachments   []postmarkAttachment `json:"Attachments,omitempty"`
+	MessageStream string               `json:"MessageStream,omitempty"`
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+type postmarkResponse struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+	MessageID string `json:"MessageID"`
+}
+
+var initiatePostmarkSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+	pmDriver := d.(*PostmarkDriver)
+	conf := pmDriver.config
+	email := postmarkEmail{
+		From:          msg.From.String(),
+		Subject:       msg.Subject,
+		HtmlBody:      msg.HTMLBody,
+		TextBody:      msg.PlainTextBody,
+		MessageStream: conf.MessageStream,
+	}
+	if email.MessageStream == "" {
+		email.MessageStream = PostmarkStreamTransactional
+	}
+	var to, cc, bcc []string
+	for _, v := range rcpts {
+		if containsAddress(msg.To, v) {
+			to = append(to, v.String())
+		} else if containsAddress(msg.CC, v) {
+			cc = append(cc, v.String())
+		} else {
+			bcc = append(bcc, v.String())
+		}
+	}
+	email.To = strings.Join(to, ",")
+	email.Cc = strings.Join(cc, ",")
+	email.Bcc = strings.Join(bcc, ",")
+	if len(msg.ReplyTo) > 0 {
+		email.ReplyTo = formatAddressList(msg.ReplyTo)
+	}
+	for k, v := range msg.Headers {
+		email.Headers = append(email.Headers, postmarkHeader{Name: k, Value: v})
+	}
+	for _, v := range msg.Attachments {
+		content, err := v.readAll()
+		if err != nil {
+			return "", &SendError{Driver: DriverPostmark, Stage: StageBuild, Err: err}
+		}
+		attachment := postmarkAttachment{
+			Name:        v.Name,
+			Content:     base64.StdEncoding.EncodeToString(content),
+			ContentType: v.detectContentType(content),
+		}
+		if v.ContentID != "" {
+			attachment.ContentID = "cid:" + v.ContentID
+		}
+		email.Attachments = append(email.Attachments, attachment)
+	}
+	body, err := json.Marshal(email)
+	if err != nil {
+		return "", &SendError{Driver: DriverPostmark, Stage: StageBuild, Err: err}
+	}
+
+	baseUrl := conf.BaseUrl
+	if baseUrl == "" {
+		baseUrl = "https://api.postmarkapp.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(baseUrl, "/")+"/email", bytes.NewReader(body))
+	if err != nil {
+		return "", &SendError{Driver: DriverPostmark, Stage: StageHTTP, Err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", conf.ServerToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", &SendError{Driver: DriverPostmark, Stage: StageHTTP, Err: err}
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	var pmRes postmarkResponse
+	json.Unmarshal(resBody, &pmRes)
+	if res.StatusCode < 200 || res.StatusCode > 299 || pmRes.ErrorCode != 0 {
+		message := pmRes.Message
+		if message == "" {
+			message = strings.TrimSpace(string(resBody))
+		}
+		sendErr := newHTTPError(DriverPostmark, res.StatusCode, string(resBody), &PostmarkError{StatusCode: res.StatusCode, ErrorCode: pmRes.ErrorCode, Message: message})
+		sendErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		return "", sendErr
+	}
+	return pmRes.MessageID, nil
+}
+
+func initiatePostmark(config *PostmarkConfig) *PostmarkDriver {
+	p := &PostmarkDriver{
+		config:       config,
+		initiateSend: initiatePostmarkSend,
+	}
+
+	return p
+}
+
+// Name of the driver as reported in the errors
+func (p *PostmarkDriver) Name() string {
+	return DriverPostmark
+}
+
+func (p *PostmarkDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// postmark supports bcc, so "to", "cc" and "bcc" are sent together, in a request per 50 recipients
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Driver: DriverPostmark, Stage: StageBuild, Err: err}
+	}
+	return sendInChunks(ctx, DriverPostmark, msg, postmarkMaxRecipients, func(rcpts []mail.Address) (string, error) {
+		return p.initiateSend(ctx, msg, rcpts, p)
+	})
+}
@@ -0,0 +1,144 @@
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestPostmarkDriverSend(t *testing.T) {
+	var emails []postmarkEmail
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/email" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tokens = append(tokens, r.Header.Get("X-Postmark-Server-Token"))
+		var email postmarkEmail
+		err := json.NewDecoder(r.Body).Decode(&email)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(email.To, "invalid") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"ErrorCode":300,"Message":"Invalid 'To' address: 'invalid'."}`))
+			return
+		}
+		emails = append(emails, email)
+		w.Write([]byte(`{"To":"to@mail.com","MessageID":"b7bc2f4a-e38e-4336-af7d-e6c392c2f817","ErrorCode":0,"Message":"OK"}`))
+	}))
+	defer server.Close()
+	pDriver := initiatePostmark(&PostmarkConfig{
+		BaseUrl:     server.URL,
+		ServerToken: "test-server-token",
+	})
+	msg := &Message{
+		From: mail.Address{Name: "test from name", Address: "from@mail.com"},
+		To: []mail.Address{
+			{Name: "test to name1", Address: "to1@mail.com"},
+			{Name: "test to name2", Address: "to2@mail.com"},
+		},
+		CC:            []mail.Address{{Address: "cc@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		ReplyTo:       []mail.Address{{Name: "support", Address: "support@mail.com"}},
+		Headers:       map[string]string{"X-Test-Header": "test value"},
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name:      "logo.png",
+				Path:      "./testingdata/logo.png",
+				ContentID: "logo",
+			},
+		},
+	}
+	err := pDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing send", err)
+	}
+	if len(emails) != 1 || tokens[0] != "test-server-token" {
+		t.Fatal("failed testing send")
+	}
+	email := emails[0]
+	if email.From != `"test from name" <from@mail.com>` {
+		t.Error("failed testing send")
+	}
+	if email.To != `"test to name1" <to1@mail.com>,"test to name2" <to2@mail.com>` || email.Cc != "<cc@mail.com>" || email.Bcc != "<bcc1@mail.com>,<bcc2@mail.com>" {
+		t.Error("failed testing send")
+	}
+	if email.Subject != "this is the subject" || email.HtmlBody != "this is html body" || email.TextBody != "this is plain text body" {
+		t.Error("failed testing send")
+	}
+	if email.ReplyTo != `"support" <support@mail.com>` {
+		t.Error("failed testing send")
+	}
+	if email.MessageStream != PostmarkStreamTransactional {
+		t.Error("failed testing send")
+	}
+	if len(email.Headers) != 1 || email.Headers[0].Name != "X-Test-Header" || email.Headers[0].Value != "test value" {
+		t.Error("failed testing send")
+	}
+	if len(email.Attachments) != 2 {
+		t.Fatal("failed testing send")
+	}
+	if email.Attachments[0].Name != "attachment name1" || email.Attachments[0].Content != "dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAx" || email.Attachments[0].ContentID != "" {
+		t.Error("failed testing send")
+	}
+	if email.Attachments[1].Name != "logo.png" || email.Attachments[1].ContentType != "image/png" || email.Attachments[1].ContentID != "cid:logo" {
+		t.Error("failed testing send")
+	}
+
+	pDriver.config.MessageStream = PostmarkStreamBroadcast
+	err = pDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing send", err)
+	}
+	if len(emails) != 2 || emails[1].MessageStream != PostmarkStreamBroadcast {
+		t.Error("failed testing send")
+	}
+
+	// more than 50 recipients are split in requests of 50, "to" and "cc" in the first one
+	emails = nil
+	msg.BCC = nil
+	for i := 0; i < 60; i++ {
+		msg.BCC = append(msg.BCC, mail.Address{Address: fmt.Sprintf("bcc%d@mail.com", i)})
+	}
+	err = pDriver.SendMessage(context.Background(), msg)
+	if err != nil || len(emails) != 2 {
+		t.Fatal("failed testing send", err)
+	}
+	if emails[0].To != `"test to name1" <to1@mail.com>,"test to name2" <to2@mail.com>` || emails[0].Cc != "<cc@mail.com>" || strings.Count(emails[0].Bcc, ",") != 46 {
+		t.Error("failed testing send")
+	}
+	if emails[1].To != "" || emails[1].Cc != "" || strings.Count(emails[1].Bcc, ",") != 12 || !strings.HasPrefix(emails[1].Bcc, "<bcc47@mail.com>") {
+		t.Error("failed testing send")
+	}
+	if len(emails[1].Attachments) != 2 || emails[1].Attachments[0].Content != emails[0].Attachments[0].Content {
+		t.Error("failed testing send")
+	}
+
+	err = pDriver.SendMessage(context.Background(), &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "invalid"}},
+	})
+	var pmErr *PostmarkError
+	if !errors.As(err, &pmErr) {
+		t.Fatal("failed testing send")
+	}
+	if pmErr.ErrorCode != 300 || pmErr.StatusCode != http.StatusUnprocessableEntity || pmErr.Message != "Invalid 'To' address: 'invalid'." {
+		t.Error("failed testing send")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueueClosed is returned when a message is enqueued after the queue was shut down
+var ErrQueueClosed = errors.New("mailing: the queue is shut down")
+
+const (
+	defaultQueueWorkers = 4
+	defaultQueueSize    = 100
+)
+
+// QueueConfig is the configuration of a Queue
+type QueueConfig struct {
+	Workers     int                // the messages sent at once, defaults to 4
+	Size        int                // the messages waiting to be sent before Enqueue blocks, defaults to 100
+	RetryPolicy RetryPolicy        // how the sending is tried again on transient errors
+	Results     chan<- QueueResult // optional, receives the result of every message and is closed by Shutdown, unread results are dropped once Shutdown gives up
+	OnResult    func(QueueResult)  // optional, called with the result of every message from the worker that sent it
+}
+
+// QueueResult is the result of sending a message of the queue
+type QueueResult struct {
+	ID      string // the id Enqueue returned
+	Message *Message
+	Result  *SendResult // the result of every recipient
+	Err     error
+}
+
+// Queue sends the messages in the background with a pool of workers, so the
+// callers don't wait for the driver
+type Queue struct {
+	mailer   *Mailer
+	jobs     chan queueJob
+	config   QueueConfig
+	ctx      context.Context // the context of the sendings, cancelled when shutting down takes too long
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	done     chan struct{} // closed when all the workers returned
+	closing  chan struct{} // closed when the shutdown starts
+	shutdown sync.Once
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type queueJob struct {
+	id  string
+	msg *Message
+}
+
+// NewQueue starts the workers that send the enqueued messages with the driver
+func NewQueue(driver Driver, config QueueConfig) *Queue {
+	if config.Workers <= 0 {
+		config.Workers = defaultQueueWorkers
+	}
+	if config.Size <= 0 {
+		config.Size = defaultQueueSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		mailer:  NewMailer(driver).SetRetryPolicy(config.RetryPolicy),
+		jobs:    make(chan queueJob, config.Size),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	q.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go q.work()
+	}
+	go func() {
+		q.workers.Wait()
+		if config.Results != nil {
+			close(config.Results)
+		}
+		close(q.done)
+	}()
+	return q
+}
+
+// Enqueue adds the message to the queue and returns its id, it blocks while the queue is full
+// until the context is done, the context only bounds the waiting, not the sending.
+// Attachments given as readers are read when the message is sent
+func (q *Queue) Enqueue(ctx context.Context, msg *Message) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return "", ErrQueueClosed
+	}
+	job := queueJob{id: uuid.NewString(), msg: msg.Clone()}
+	select {
+	case q.jobs <- job:
+		return job.id, nil
+	case <-q.closing:
+		return "", ErrQueueClosed
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// send the messages until the queue is shut down and drained
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for job := range q.jobs {
+		result, err := q.mailer.send(q.ctx, job.msg)
+		queueResult := QueueResult{ID: job.id, Message: job.msg, Result: result, Err: err}
+		if q.config.OnResult != nil {
+			q.config.OnResult(queueResult)
+		}
+		if q.config.Results != nil {
+			// once the shutdown gave up waiting the results nobody reads are dropped, so the workers can return
+			select {
+			case q.config.Results <- queueResult:
+			case <-q.ctx.Done():
+			}
+		}
+	}
+}
+
+// Shutdown stops accepting messages and waits for the queued and the in-flight ones to be sent,
+// when the context is done first the sendings are cancelled, the messages that were not sent
+// are still reported with the context error, and the context's error is returned
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.shutdown.Do(func() {
+		close(q.closing)
+		q.mu.Lock()
+		q.closed = true
+		close(q.jobs)
+		q.mu.Unlock()
+	})
+	select {
+	case <-q.done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,175 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	var running, maxRunning int32
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			highest := atomic.LoadInt32(&maxRunning)
+			if n <= highest || atomic.CompareAndSwapInt32(&maxRunning, highest, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if msg.Subject == "failing" {
+			return errors.New("connection lost")
+		}
+		return nil
+	})
+	results := make(chan QueueResult, 10)
+	var callbacks int32
+	queue := NewQueue(driver, QueueConfig{
+		Workers:  3,
+		Results:  results,
+		OnResult: func(QueueResult) { atomic.AddInt32(&callbacks, 1) },
+	})
+	ids := map[string]string{}
+	for i := 0; i < 10; i++ {
+		subject := fmt.Sprintf("subject %d", i)
+		if i == 4 {
+			subject = "failing"
+		}
+		id, err := queue.Enqueue(context.Background(), &Message{
+			From:    mail.Address{Address: "from@mail.com"},
+			To:      []mail.Address{{Address: "to@mail.com"}},
+			Subject: subject,
+		})
+		if err != nil || id == "" {
+			t.Fatal("failed testing queue", err)
+		}
+		ids[id] = subject
+	}
+	err := queue.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal("failed testing queue", err)
+	}
+	var received int
+	for v := range results {
+		received++
+		if ids[v.ID] != v.Message.Subject || len(v.Result.Recipients) != 1 {
+			t.Error("failed testing queue")
+		}
+		if (v.Err != nil) != (v.Message.Subject == "failing") || (v.Err != nil) != (len(v.Result.Failed()) == 1) {
+			t.Error("failed testing queue")
+		}
+	}
+	if len(ids) != 10 || received != 10 || atomic.LoadInt32(&callbacks) != 10 {
+		t.Error("failed testing queue")
+	}
+	if maxRunning < 2 || maxRunning > 3 {
+		t.Error("failed testing queue")
+	}
+
+	_, err = queue.Enqueue(context.Background(), &Message{})
+	if !errors.Is(err, ErrQueueClosed) {
+		t.Error("failed testing queue")
+	}
+	if queue.Shutdown(context.Background()) != nil {
+		t.Error("failed testing queue")
+	}
+}
+
+func TestQueueShutdownDeadline(t *testing.T) {
+	started := make(chan struct{}, 5)
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var mu sync.Mutex
+	var errs []error
+	queue := NewQueue(driver, QueueConfig{Workers: 1, OnResult: func(r QueueResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, r.Err)
+	}})
+	for i := 0; i < 3; i++ {
+		_, err := queue.Enqueue(context.Background(), &Message{To: []mail.Address{{Address: "to@mail.com"}}})
+		if err != nil {
+			t.Fatal("failed testing queue shutdown deadline", err)
+		}
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := queue.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("failed testing queue shutdown deadline")
+	}
+	// the in-flight and the queued messages are all reported
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 3 {
+		t.Fatal("failed testing queue shutdown deadline")
+	}
+	for _, v := range errs {
+		if !errors.Is(v, context.Canceled) {
+			t.Error("failed testing queue shutdown deadline", v)
+		}
+	}
+}
+
+func TestQueueShutdownUnreadResults(t *testing.T) {
+	driver := driverFunc(func(ctx context.Context, msg *Message) error { return nil })
+	// nobody reads the results
+	queue := NewQueue(driver, QueueConfig{Workers: 2, Results: make(chan QueueResult)})
+	for i := 0; i < 5; i++ {
+		_, err := queue.Enqueue(context.Background(), &Message{To: []mail.Address{{Address: "to@mail.com"}}})
+		if err != nil {
+			t.Fatal("failed testing queue shutdown unread results", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- queue.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("failed testing queue shutdown unread results", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed testing queue shutdown unread results")
+	}
+}
+
+func TestQueueEnqueueFull(t *testing.T) {
+	release := make(chan struct{})
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		<-release
+		return nil
+	})
+	queue := NewQueue(driver, QueueConfig{Workers: 1, Size: 1})
+	// the first message is taken by the worker, the second fills the queue
+	for i := 0; i < 2; i++ {
+		_, err := queue.Enqueue(context.Background(), &Message{})
+		if err != nil {
+			t.Fatal("failed testing enqueue full", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var err error
+	for err == nil {
+		_, err = queue.Enqueue(ctx, &Message{})
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("failed testing enqueue full")
+	}
+	close(release)
+	if queue.Shutdown(context.Background()) != nil {
+		t.Error("failed testing enqueue full")
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when sending would exceed the rate limit and the limit doesn't wait,
+// the *SendError that holds it has the wait before the message can be sent in RetryAfter, it's
+// retryable so the retry policy waits for it
+var ErrRateLimited = errors.New("mailing: the rate limit is reached")
+
+// ErrDailyCapExceeded is returned when a single request to the provider has more recipients than the daily cap,
+// it can't be sent on any day, so it isn't retried
+var ErrDailyCapExceeded = errors.New("mailing: the request has more recipients than the daily cap")
+
+// RateLimit limits the sending on the client side, to stay under the quotas of the provider.
+// The limit is taken for every request to the provider, like the request of every bcc with
+// the providers that send them apart, and only for the recipients who weren't sent the email yet.
+// The rates are token buckets that allow a burst of one second worth of sending, a request larger
+// than the burst is sent once the bucket is full and the next requests wait until it's paid back
+type RateLimit struct {
+	MessagesPerSecond   float64 // the requests to the provider, 0 for no limit
+	RecipientsPerSecond float64 // 0 for no limit, the "to", "cc" and "bcc" recipients of the requests
+	DailyCap            int     // the recipients sent per day, the day starts at midnight UTC, 0 for no limit
+	Wait                bool    // wait until the message can be sent instead of returning ErrRateLimited
+}
+
+// rateLimiter applies a rate limit, it's shared by the goroutines sending with the same mailer or driver
+type rateLimiter struct {
+	limit      RateLimit
+	mu         sync.Mutex
+	messages   *tokenBucket
+	recipients *tokenBucket
+	day        time.Time // the start of the day of sentToday
+	sentToday  int
+	now        func() time.Time
+}
+
+// tokenBucket holds up to capacity tokens and gets rate tokens per second
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	l := &rateLimiter{limit: limit, now: time.Now}
+	now := l.now()
+	if limit.MessagesPerSecond > 0 {
+		l.messages = newTokenBucket(limit.MessagesPerSecond, now)
+	}
+	if limit.RecipientsPerSecond > 0 {
+		l.recipients = newTokenBucket(limit.RecipientsPerSecond, now)
+	}
+	return l
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	capacity := rate
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+// the wait until the bucket has n tokens, a request larger than the bucket waits for a full bucket
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	if n > b.capacity {
+		n = b.capacity
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take the n tokens, a request larger than the bucket leaves it in debt
+func (b *tokenBucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	b.tokens -= n
+}
+
+// take the tokens of a request to the recipients, waiting for them when the limit waits
+func (l *rateLimiter) take(ctx context.Context, driver string, rcpts int) error {
+	if l.limit.DailyCap > 0 && rcpts > l.limit.DailyCap {
+		return &SendError{Driver: driver, Stage: StageRateLimit, Err: ErrDailyCapExceeded}
+	}
+	for {
+		wait := l.tryTake(rcpts)
+		if wait == 0 {
+			return nil
+		}
+		if !l.limit.Wait {
+			return &SendError{Driver: driver, Stage: StageRateLimit, RetryAfter: wait, Err: ErrRateLimited}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &SendError{Driver: driver, Stage: StageRateLimit, Err: ctx.Err()}
+		case <-timer.C:
+		}
+	}
+}
+
+// take the tokens when they are all available, otherwise return the wait until they may be
+func (l *rateLimiter) tryTake(rcpts int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	if l.limit.DailyCap > 0 {
+		l.startDay(now)
+		if l.sentToday+rcpts > l.limit.DailyCap {
+			wait = l.day.Add(24 * time.Hour).Sub(now)
+		}
+	}
+	for _, v := range []time.Duration{l.messages.wait(1, now), l.recipients.wait(float64(rcpts), now)} {
+		if v > wait {
+			wait = v
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	l.messages.take(1)
+	l.recipients.take(float64(rcpts))
+	l.sentToday += rcpts
+	return 0
+}
+
+// reset the recipients sent today when the day changed
+func (l *rateLimiter) startDay(now time.Time) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !day.Equal(l.day) {
+		l.day, l.sentToday = day, 0
+	}
+}
+
+// the size of the next batch request, cut to the recipients the daily cap still allows today,
+// when the cap is reached the request waits for the next day
+func (l *rateLimiter) batchSize(size int) int {
+	if l.limit.DailyCap <= 0 {
+		return size
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.startDay(l.now())
+	left := l.limit.DailyCap - l.sentToday
+	if left <= 0 {
+		left = l.limit.DailyCap
+	}
+	if size > left {
+		return left
+	}
+	return size
+}
+
+// take the rate limit of a request to the provider, when the message is sent through a rate limited driver
+func (m *Message) takeLimit(rcpts int) error {
+	if m.limit == nil {
+		return nil
+	}
+	return m.limit(rcpts)
+}
+
+// whether the driver takes the limit of the message before every request with takeLimit,
+// the limit of the other drivers, like custom ones, is taken once for the whole message
+func limitsRequests(driver Driver) bool {
+	switch d := driver.(type) {
+	case *SMTPDriver, *SendGridDriver, *MailGunDriver, *SparkPostDriver, *SESDriver, *PostmarkDriver:
+		return true
+	case *RateLimitedDriver:
+		return limitsRequests(d.driver)
+	case *FailoverDriver:
+		for _, v := range d.drivers {
+			if !limitsRequests(v.driver) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// the number of different recipients of the message
+func countRecipients(msg *Message) int {
+	seen := make(map[string]bool)
+	for _, list := range [][]mail.Address{msg.To, msg.CC, msg.BCC} {
+		for _, v := range list {
+			seen[strings.ToLower(v.Address)] = true
+		}
+	}
+	return len(seen)
+}
+
+// RateLimitedDriver applies a rate limit to a driver, so the mailers sharing the driver, or the
+// failover driver using it, share the limit. With the failover driver a limit that doesn't wait
+// makes the next driver send the message, without counting as a failure of the limited driver.
+// The native scheduling and batches of the wrapped driver are kept
+type RateLimitedDriver struct {
+	driver  Driver
+	limiter *rateLimiter
+}
+
+// NewRateLimitedDriver wraps the driver with the rate limit
+func NewRateLimitedDriver(driver Driver, limit RateLimit) *RateLimitedDriver {
+	return &RateLimitedDriver{driver: driver, limiter: newRateLimiter(limit)}
+}
+
+// Name of the wrapped driver
+func (r *RateLimitedDriver) Name() string {
+	return driverName(r.driver)
+}
+
+// SendMessage sends the message with the wrapped driver, every request waits until the limit allows it
+func (r *RateLimitedDriver) SendMessage(ctx context.Context, msg *Message) error {
+	name := driverName(r.driver)
+	if !limitsRequests(r.driver) {
+		err := r.limiter.take(ctx, name, len(msg.results.pending(msg)))
+		if err != nil {
+			return err
+		}
+		return r.driver.SendMessage(ctx, msg)
+	}
+	// the limits of the wrapping drivers are taken first
+	outer := msg.limit
+	limited := msg.Clone()
+	limited.limit = func(rcpts int) error {
+		if outer != nil {
+			if err := outer(rcpts); err != nil {
+				return err
+			}
+		}
+		return r.limiter.take(ctx, name, rcpts)
+	}
+	return r.driver.SendMessage(ctx, limited)
+}
+
+// the wrapped driver's scheduling, zero when it can't schedule natively
+func (r *RateLimitedDriver) maxScheduleDelay() time.Duration {
+	if scheduler, ok := r.driver.(nativeScheduler); ok {
+		return scheduler.maxScheduleDelay()
+	}
+	return 0
+}
+
+func (r *RateLimitedDriver) schedule(ctx context.Context, msg *Message, at time.Time) (*Message, error) {
+	return r.driver.(nativeScheduler).schedule(ctx, msg, at)
+}
+
+func (r *RateLimitedDriver) cancelSchedule(ctx context.Context, msg *Message, result *SendResult) error {
+	return r.driver.(nativeScheduler).cancelSchedule(ctx, msg, result)
+}
+
+// the wrapped driver's batches cut to the daily cap, zero when it can't send batches
+func (r *RateLimitedDriver) maxBatchSize() int {
+	if sender, ok := r.driver.(batchSender); ok && sender.maxBatchSize() > 0 {
+		return r.limiter.batchSize(sender.maxBatchSize())
+	}
+	return 0
+}
+
+// send the batch with the wrapped driver once the limit allows its recipients
+func (r *RateLimitedDriver) sendBatch(ctx context.Context, msg *Message, recipients []Recipient) (string, error) {
+	err := r.limiter.take(ctx, driverName(r.driver), len(recipients))
+	if err != nil {
+		return "", err
+	}
+	return r.driver.(batchSender).sendBatch(ctx, msg, recipients)
+}
+
+// Close the wrapped driver if it holds resources, like the pooled smtp connections
+func (r *RateLimitedDriver) Close() error {
+	if closer, ok := r.driver.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 23, 59, 0, 0, time.UTC)
+	limiter := newRateLimiter(RateLimit{MessagesPerSecond: 2, RecipientsPerSecond: 5, DailyCap: 9})
+	limiter.now = func() time.Time { return now }
+	limiter.messages.last, limiter.recipients.last = now, now
+	ctx := context.Background()
+
+	// the buckets start full
+	if limiter.take(ctx, "test", 2) != nil || limiter.take(ctx, "test", 2) != nil {
+		t.Fatal("failed testing rate limiter")
+	}
+	err := limiter.take(ctx, "test", 1)
+	var sendErr *SendError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &sendErr) || sendErr.Stage != StageRateLimit || sendErr.RetryAfter != 500*time.Millisecond || sendErr.Driver != "test" {
+		t.Fatal("failed testing rate limiter", err)
+	}
+	// both buckets refill, the recipients one is short of 3 recipients
+	now = now.Add(200 * time.Millisecond)
+	err = limiter.take(ctx, "test", 5)
+	if !errors.As(err, &sendErr) || sendErr.RetryAfter != 600*time.Millisecond {
+		t.Fatal("failed testing rate limiter", err)
+	}
+	now = now.Add(600 * time.Millisecond)
+	if err := limiter.take(ctx, "test", 5); err != nil {
+		t.Fatal("failed testing rate limiter", err)
+	}
+	// 9 recipients were sent today, the cap waits for the next day
+	now = now.Add(10 * time.Second)
+	err = limiter.take(ctx, "test", 1)
+	if !errors.As(err, &sendErr) || sendErr.RetryAfter != 49200*time.Millisecond {
+		t.Fatal("failed testing rate limiter", err)
+	}
+	now = now.Add(49200 * time.Millisecond)
+	if err := limiter.take(ctx, "test", 1); err != nil {
+		t.Error("failed testing rate limiter", err)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{MessagesPerSecond: 20, Wait: true})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.take(context.Background(), "test", 1); err != nil {
+				t.Error("failed testing rate limiter wait", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 20 messages at once, then the 5 others at 20 per second
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("failed testing rate limiter wait", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	limiter = newRateLimiter(RateLimit{MessagesPerSecond: 0.1, Wait: true})
+	limiter.take(ctx, "test", 1)
+	if err := limiter.take(ctx, "test", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("failed testing rate limiter wait", err)
+	}
+}
+
+func TestMailerRateLimit(t *testing.T) {
+	var sent int32
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+	mailer := NewMailer(driver).SetRateLimit(RateLimit{RecipientsPerSecond: 3})
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "TO@mail.com"}, {Address: "bcc@mail.com"}},
+	}
+	// the two different recipients fit, the next message doesn't
+	if err := mailer.SendMessage(context.Background(), msg); err != nil {
+		t.Fatal("failed testing mailer rate limit", err)
+	}
+	result, err := mailer.SendMessageWithResult(context.Background(), msg)
+	if !errors.Is(err, ErrRateLimited) || len(result.Failed()) != 2 || result.Recipients[0].Err.Stage != StageRateLimit {
+		t.Error("failed testing mailer rate limit", err)
+	}
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Error("failed testing mailer rate limit")
+	}
+}
+
+func TestMailerRateLimitRetry(t *testing.T) {
+	var sent int32
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+	mailer := NewMailer(driver).
+		SetRateLimit(RateLimit{MessagesPerSecond: 20}).
+		SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond})
+	msg := &Message{From: mail.Address{Address: "from@mail.com"}, To: []mail.Address{{Address: "to@mail.com"}}}
+	start := time.Now()
+	// the 21st message is retried once the bucket has refilled
+	for i := 0; i < 21; i++ {
+		if err := mailer.SendMessage(context.Background(), msg); err != nil {
+			t.Fatal("failed testing mailer rate limit retry", err)
+		}
+	}
+	if atomic.LoadInt32(&sent) != 21 || time.Since(start) < 40*time.Millisecond {
+		t.Error("failed testing mailer rate limit retry")
+	}
+}
+
+func TestRateLimitedDriverForwarding(t *testing.T) {
+	limited := NewRateLimitedDriver(initiateSendGrid(&SendGridConfig{}), RateLimit{RecipientsPerSecond: 1000})
+	if limited.maxScheduleDelay() != 72*time.Hour || limited.maxBatchSize() != 1000 {
+		t.Error("failed testing rate limited driver forwarding")
+	}
+	limited = NewRateLimitedDriver(driverFunc(func(ctx context.Context, msg *Message) error { return nil }), RateLimit{})
+	if limited.maxScheduleDelay() != 0 || limited.maxBatchSize() != 0 {
+		t.Error("failed testing rate limited driver forwarding")
+	}
+}
+
+func TestRateLimitedDriverFailover(t *testing.T) {
+	var first, second int32
+	limited := NewRateLimitedDriver(driverFunc(func(ctx context.Context, msg *Message) error {
+		atomic.AddInt32(&first, 1)
+		return nil
+	}), RateLimit{MessagesPerSecond: 1})
+	failover := NewFailoverDriver(limited, driverFunc(func(ctx context.Context, msg *Message) error {
+		atomic.AddInt32(&second, 1)
+		return nil
+	}))
+	failover.FailureThreshold = 1
+	mailer := NewMailer(failover)
+	msg := &Message{From: mail.Address{Address: "from@mail.com"}, To: []mail.Address{{Address: "to@mail.com"}}}
+	for i := 0; i < 3; i++ {
+		if err := mailer.SendMessage(context.Background(), msg); err != nil {
+			t.Fatal("failed testing rate limited driver", err)
+		}
+	}
+	// the limited driver sends one message per second, the next driver sends the others
+	if atomic.LoadInt32(&first) != 1 || atomic.LoadInt32(&second) != 2 {
+		t.Error("failed testing rate limited driver")
+	}
+	// the limit doesn't open the circuit of the limited driver
+	if !failover.drivers[0].available(time.Now()) {
+		t.Error("failed testing rate limited driver")
+	}
+	if limited.Name() != driverName(limited.driver) {
+		t.Error("failed testing rate limited driver")
+	}
+}
+
+func TestRateLimiterLargeRequests(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(RateLimit{RecipientsPerSecond: 10, DailyCap: 2000})
+	limiter.now = func() time.Time { return now }
+	limiter.recipients.last = now
+	ctx := context.Background()
+
+	// a request larger than the bucket is sent once the bucket is full and leaves it in debt
+	if err := limiter.take(ctx, "test", 1000); err != nil {
+		t.Fatal("failed testing rate limiter large requests", err)
+	}
+	err := limiter.take(ctx, "test", 1000)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.RetryAfter != 100*time.Second {
+		t.Fatal("failed testing rate limiter large requests", err)
+	}
+	now = now.Add(100 * time.Second)
+	if err := limiter.take(ctx, "test", 1000); err != nil {
+		t.Fatal("failed testing rate limiter large requests", err)
+	}
+
+	// a request larger than the daily cap is never sent
+	err = limiter.take(ctx, "test", 2001)
+	if !errors.Is(err, ErrDailyCapExceeded) || !errors.As(err, &sendErr) || sendErr.Retryable() || sendErr.Permanent() {
+		t.Error("failed testing rate limiter large requests", err)
+	}
+}
+
+func TestMailerRateLimitRequests(t *testing.T) {
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	var requests int
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		requests++
+		if requests == 3 {
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 503}
+		}
+		return "id", nil
+	}
+	mailer := NewMailer(sDriver).
+		SetRateLimit(RateLimit{MessagesPerSecond: 100, DailyCap: 100}).
+		SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond})
+	now := time.Now()
+	mailer.limiter.now = func() time.Time { return now }
+	mailer.limiter.messages.last = now
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}},
+	}
+	if err := mailer.SendMessage(context.Background(), msg); err != nil {
+		t.Fatal("failed testing mailer rate limit requests", err)
+	}
+	// every bcc is a request, and the retry only counts the bcc that failed
+	if requests != 4 || mailer.limiter.messages.tokens != 96 || mailer.limiter.sentToday != 4 {
+		t.Error("failed testing mailer rate limit requests", requests, mailer.limiter.messages.tokens, mailer.limiter.sentToday)
+	}
+}
+
+func TestSendBatchDailyCap(t *testing.T) {
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Personalizations []interface{} `json:"personalizations"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		sizes = append(sizes, len(request.Personalizations))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	mailer := NewMailer(initiateSendGrid(&SendGridConfig{Host: server.URL, Endpoint: "/v3/mail/send"})).
+		SetRateLimit(RateLimit{DailyCap: 500})
+	var recipients []Recipient
+	for i := 0; i < 1200; i++ {
+		recipients = append(recipients, Recipient{Address: mail.Address{Address: fmt.Sprintf("rcpt%d@mail.com", i)}})
+	}
+	if _, err := mailer.SendBatch(context.Background(), batchTemplate, recipients[:200]); err != nil {
+		t.Fatal("failed testing send batch daily cap", err)
+	}
+	// the next request is cut to the 300 recipients left today, the others wait for the next day
+	result, err := mailer.SendBatch(context.Background(), batchTemplate, recipients[200:])
+	if !errors.Is(err, ErrRateLimited) || len(sizes) != 2 || sizes[0] != 200 || sizes[1] != 300 {
+		t.Fatal("failed testing send batch daily cap", err, sizes)
+	}
+	if len(result.Accepted()) != 300 || result.Recipients[300].Err.Stage != StageRateLimit {
+		t.Error("failed testing send batch daily cap")
+	}
+}
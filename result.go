@@ -0,0 +1,268 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// RecipientStatus is what happened to the email of a recipient
+type RecipientStatus string
+
+const (
+	RecipientAccepted RecipientStatus = "accepted" // the server or the provider accepted the email
+	RecipientRejected RecipientStatus = "rejected" // the sending failed, Err tells why
+	RecipientSkipped  RecipientStatus = "skipped"  // not tried because an earlier failure stopped the sending, Err tells why
+)
+
+// SendResult is the result of sending an email, with the result of every recipient
+type SendResult struct {
+	Recipients []RecipientResult // in the order of the "to", "cc" and "bcc" lists
+}
+
+// RecipientResult is the result of sending the email to a single recipient
+type RecipientResult struct {
+	Address   string
+	Status    RecipientStatus
+	Driver    string     // the name of the driver that sent or tried to send the email
+	MessageID string     // the id the provider gave the email, ex: SendGrid X-Message-Id, MailGun id, SparkPost transmission id
+	Reply     string     // the smtp server's reply to the email
+	Err       *SendError // why the email wasn't sent
+}
+
+// Accepted returns the recipients who were sent the email
+func (r *SendResult) Accepted() []RecipientResult {
+	var accepted []RecipientResult
+	for _, v := range r.Recipients {
+		if v.Status == RecipientAccepted {
+			accepted = append(accepted, v)
+		}
+	}
+	return accepted
+}
+
+// Failed returns the recipients who weren't sent the email
+func (r *SendResult) Failed() []RecipientResult {
+	var failed []RecipientResult
+	for _, v := range r.Recipients {
+		if v.Status != RecipientAccepted {
+			failed = append(failed, v)
+		}
+	}
+	return failed
+}
+
+// resultLog keeps the result of every recipient while a message is sent,
+// a nil log is valid, it records nothing and contains no one
+type resultLog struct {
+	mu      sync.Mutex
+	results map[string]RecipientResult
+}
+
+// whether all the given recipients were sent the email
+func (l *resultLog) accepted(rcpts []mail.Address) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, v := range rcpts {
+		if l.results[strings.ToLower(v.Address)].Status != RecipientAccepted {
+			return false
+		}
+	}
+	return true
+}
+
+// the permanent error all the given recipients were rejected with, nil when one of them
+// may still be sent the email, a recipient rejected for good isn't tried again by the retries
+func (l *resultLog) rejected(rcpts []mail.Address) *SendError {
+	if l == nil || len(rcpts) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err *SendError
+	for _, v := range rcpts {
+		result := l.results[strings.ToLower(v.Address)]
+		if result.Status != RecipientRejected || result.Err == nil || !result.Err.Permanent() {
+			return nil
+		}
+		if err == nil {
+			err = result.Err
+		}
+	}
+	return err
+}
+
+// the different recipients of the message who weren't sent the email yet and weren't rejected for good
+func (l *resultLog) pending(msg *Message) []mail.Address {
+	var pending []mail.Address
+	seen := make(map[string]bool)
+	for _, list := range [][]mail.Address{msg.To, msg.CC, msg.BCC} {
+		for _, v := range list {
+			key := strings.ToLower(v.Address)
+			if !seen[key] && !l.accepted([]mail.Address{v}) && l.rejected([]mail.Address{v}) == nil {
+				pending = append(pending, v)
+			}
+			seen[key] = true
+		}
+	}
+	return pending
+}
+
+// record the same result for the given recipients
+func (l *resultLog) record(rcpts []mail.Address, result RecipientResult) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.results == nil {
+		l.results = make(map[string]RecipientResult)
+	}
+	for _, v := range rcpts {
+		result.Address = v.Address
+		l.results[strings.ToLower(v.Address)] = result
+	}
+}
+
+// the result of every recipient of the message, the recipients the driver didn't record a result
+// for, like with custom drivers, are accepted when the sending succeeded and rejected otherwise
+func (l *resultLog) sendResult(msg *Message, driver string, err error) *SendResult {
+	var sendErr *SendError
+	if err != nil && !errors.As(err, &sendErr) {
+		sendErr = &SendError{Driver: driver, Stage: StageSend, Err: err}
+	}
+	result := &SendResult{}
+	seen := make(map[string]bool)
+	for _, list := range [][]mail.Address{msg.To, msg.CC, msg.BCC} {
+		for _, v := range list {
+			key := strings.ToLower(v.Address)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			var recipient RecipientResult
+			var ok bool
+			if l != nil {
+				l.mu.Lock()
+				recipient, ok = l.results[key]
+				l.mu.Unlock()
+			}
+			if !ok {
+				recipient = RecipientResult{Address: v.Address, Status: RecipientAccepted, Driver: driver}
+				if err != nil {
+					recipient.Status, recipient.Err = RecipientRejected, sendErr
+				}
+			}
+			result.Recipients = append(result.Recipients, recipient)
+		}
+	}
+	return result
+}
+
+// send the message once to the "to" and "cc" recipients and once to every bcc, for the providers
+// that show every recipient of a request to the others
+func sendPerBCC(ctx context.Context, driver string, msg *Message, send func(rcpts []mail.Address) (string, error)) error {
+	var groups [][]mail.Address
+	var toCC []mail.Address
+	toCC = append(toCC, msg.To...)
+	toCC = append(toCC, msg.CC...)
+	if len(toCC) > 0 {
+		groups = append(groups, toCC)
+	}
+	for _, v := range msg.BCC {
+		groups = append(groups, []mail.Address{v})
+	}
+	return sendGroups(ctx, driver, msg, groups, send)
+}
+
+// send the message to the "to", "cc" and "bcc" recipients together, in requests of up to
+// size recipients for the providers that limit them, the "to" and "cc" recipients come first
+func sendInChunks(ctx context.Context, driver string, msg *Message, size int, send func(rcpts []mail.Address) (string, error)) error {
+	var rcpts []mail.Address
+	rcpts = append(rcpts, msg.To...)
+	rcpts = append(rcpts, msg.CC...)
+	rcpts = append(rcpts, msg.BCC...)
+	var groups [][]mail.Address
+	for len(rcpts) > size {
+		groups = append(groups, rcpts[:size:size])
+		rcpts = rcpts[size:]
+	}
+	if len(rcpts) > 0 {
+		groups = append(groups, rcpts)
+	}
+	return sendGroups(ctx, driver, msg, groups, send)
+}
+
+// send the message in a request per group of recipients, the groups whose recipients were already
+// sent the email or were rejected for good are skipped, and a failure only stops the sending to the
+// next groups when it isn't permanent
+func sendGroups(ctx context.Context, driver string, msg *Message, groups [][]mail.Address, send func(rcpts []mail.Address) (string, error)) error {
+	var sent []string
+	var failed []RecipientError
+	var firstErr, stopErr *SendError
+	for _, rcpts := range groups {
+		if msg.results.accepted(rcpts) {
+			continue
+		}
+		// the recipients rejected for good by an earlier attempt are still reported
+		if sendErr := msg.results.rejected(rcpts); sendErr != nil {
+			if firstErr == nil {
+				firstErr = sendErr
+			}
+			for _, v := range rcpts {
+				failed = append(failed, RecipientError{Address: v.Address, Err: sendErr})
+			}
+			continue
+		}
+		if stopErr == nil && ctx.Err() != nil {
+			stopErr = &SendError{Driver: driver, Stage: StageSend, Err: ctx.Err()}
+		}
+		var sendErr *SendError
+		if stopErr != nil {
+			sendErr = stopErr
+			msg.results.record(rcpts, RecipientResult{Status: RecipientSkipped, Driver: driver, Err: sendErr})
+		} else {
+			var id string
+			err := msg.takeLimit(len(rcpts))
+			if err == nil {
+				id, err = send(rcpts)
+			}
+			if err == nil {
+				msg.results.record(rcpts, RecipientResult{Status: RecipientAccepted, Driver: driver, MessageID: id})
+				for _, v := range rcpts {
+					sent = append(sent, v.Address)
+				}
+				continue
+			}
+			errors.As(asSendError(driver, StageSend, err), &sendErr)
+			msg.results.record(rcpts, RecipientResult{Status: RecipientRejected, Driver: driver, Err: sendErr})
+			if !sendErr.Permanent() {
+				stopErr = sendErr
+			}
+		}
+		if firstErr == nil {
+			firstErr = sendErr
+		}
+		for _, v := range rcpts {
+			failed = append(failed, RecipientError{Address: v.Address, Err: sendErr})
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(sent) > 0:
+		return &PartialFailureError{Sent: sent, Failed: failed}
+	case stopErr != nil:
+		return stopErr
+	}
+	return firstErr
+}
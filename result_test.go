@@ -0,0 +1,100 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestSendWithResultProvider(t *testing.T) {
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		switch rcpts[0].Address {
+		case "bcc1@mail.com":
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 400}
+		case "bcc2@mail.com":
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 503}
+		}
+		return "id-" + rcpts[0].Address, nil
+	}
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		CC:   []mail.Address{{Address: "cc@mail.com"}},
+		BCC:  []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}, {Address: "bcc3@mail.com"}},
+	}
+	result, err := NewMailer(sDriver).SendMessageWithResult(context.Background(), msg)
+	var partialErr *PartialFailureError
+	if !errors.As(err, &partialErr) || len(result.Recipients) != 5 {
+		t.Fatal("failed testing send with result")
+	}
+	// the "to" and "cc" recipients share the same request
+	for _, v := range result.Recipients[:2] {
+		if v.Status != RecipientAccepted || v.MessageID != "id-to@mail.com" || v.Driver != DriverSendGrid || v.Err != nil {
+			t.Error("failed testing send with result")
+		}
+	}
+	// a permanent failure doesn't stop the sending, a transient one skips the next recipients
+	bcc1, bcc2, bcc3 := result.Recipients[2], result.Recipients[3], result.Recipients[4]
+	if bcc1.Status != RecipientRejected || bcc1.Err.StatusCode != 400 {
+		t.Error("failed testing send with result")
+	}
+	if bcc2.Status != RecipientRejected || bcc2.Err.StatusCode != 503 {
+		t.Error("failed testing send with result")
+	}
+	if bcc3.Status != RecipientSkipped || bcc3.Err != bcc2.Err || bcc3.MessageID != "" {
+		t.Error("failed testing send with result")
+	}
+	if len(result.Accepted()) != 2 || len(result.Failed()) != 3 {
+		t.Error("failed testing send with result")
+	}
+}
+
+func TestSendWithResultSMTP(t *testing.T) {
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.rcptReply = func(rcpt string) string {
+			if rcpt == "unknown@mail.com" {
+				return "550 5.1.1 Recipient address rejected"
+			}
+			return ""
+		}
+	})
+	mailer := NewMailerWithSMTP(server.config(SMTPEncryptionNone))
+	defer mailer.Close()
+	result, err := mailer.SendMessageWithResult(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}, {Address: "unknown@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	})
+	if err == nil || len(result.Recipients) != 3 {
+		t.Fatal("failed testing send with result")
+	}
+	to, unknown, bcc := result.Recipients[0], result.Recipients[1], result.Recipients[2]
+	if to.Status != RecipientAccepted || to.Reply != "250 2.0.0 OK queued" || to.Driver != DriverSMTP || bcc.Reply != to.Reply {
+		t.Error("failed testing send with result")
+	}
+	if unknown.Status != RecipientRejected || unknown.Err.SMTPCode != 550 || unknown.Err.Stage != StageRcpt {
+		t.Error("failed testing send with result")
+	}
+}
+
+func TestSendWithResultCustomDriver(t *testing.T) {
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "TO@mail.com"}, {Address: "bcc@mail.com"}},
+	}
+	// drivers that record nothing have every recipient accepted or rejected at once
+	result, err := NewMailer(driverFunc(func(ctx context.Context, msg *Message) error { return nil })).SendMessageWithResult(context.Background(), msg)
+	if err != nil || len(result.Recipients) != 2 || len(result.Accepted()) != 2 || !strings.HasPrefix(result.Recipients[0].Driver, "mailing.") {
+		t.Error("failed testing send with result")
+	}
+	failure := errors.New("connection lost")
+	result, err = NewMailer(driverFunc(func(ctx context.Context, msg *Message) error { return failure })).SendMessageWithResult(context.Background(), msg)
+	if !errors.Is(err, failure) || len(result.Failed()) != 2 || !errors.Is(result.Recipients[1].Err, failure) || result.Recipients[1].Err.Stage != StageSend {
+		t.Error("failed testing send with result")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how the mailer tries again when sending fails with a transient error,
+// like an smtp 4xx reply, an http 429 or 5xx status, or a network failure
+type RetryPolicy struct {
+	MaxAttempts     int           // the number of attempts including the first one, 0 or 1 disables retrying
+	BaseBackoff     time.Duration // the wait before the first retry, doubled on every retry, defaults to 500ms
+	MaxBackoff      time.Duration // the longest wait between two attempts, defaults to 30s
+	Jitter          float64       // between 0 and 1, the fraction of the wait that is randomized to spread the retries
+	HonorRetryAfter bool          // wait at least as long as the provider asked in the Retry-After header
+}
+
+const (
+	defaultBaseBackoff = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+// returns a number in [0, 1), replaceable in tests
+var retryRandom = rand.Float64
+
+// the wait before the given retry, the first retry is 1
+func (p RetryPolicy) backoff(retry int, retryAfter time.Duration) time.Duration {
+	base := p.BaseBackoff
+	if base <= 0 {
+		base = defaultBaseBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	wait := base
+	for i := 1; i < retry && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		wait -= time.Duration(float64(wait) * jitter * retryRandom())
+	}
+	if p.HonorRetryAfter && retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// send the message with the driver, trying again on transient errors as the policy allows,
+// the recipients who got the email in a failed attempt are not sent to again
+func sendWithRetry(ctx context.Context, driver Driver, policy RetryPolicy, msg *Message) error {
+	if policy.MaxAttempts <= 1 {
+		return driver.SendMessage(ctx, msg)
+	}
+	// readers can only be read once, so their content is kept for the next attempts
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Stage: StageBuild, Err: err}
+	}
+	if msg.results == nil {
+		msg = msg.Clone()
+		msg.results = &resultLog{}
+	}
+	return retry(ctx, policy, func() error {
+		return driver.SendMessage(ctx, msg)
+	})
+}
+
+// call the function until it succeeds, it fails with an error that isn't
+// transient, or the policy's attempts are used
+func retry(ctx context.Context, policy RetryPolicy, attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || n >= policy.MaxAttempts {
+			return err
+		}
+		sendErr := findSendError(err, (*SendError).Retryable)
+		if sendErr == nil {
+			return err
+		}
+		wait := policy.backoff(n, sendErr.RetryAfter)
+		// the rate limit fails again until its bucket refills, whatever the policy
+		if sendErr.Stage == StageRateLimit && sendErr.RetryAfter > wait {
+			wait = sendErr.RetryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, v := range expected {
+		if policy.backoff(i+1, 0) != v {
+			t.Error("failed testing retry policy backoff")
+		}
+	}
+	if (RetryPolicy{}).backoff(1, 0) != defaultBaseBackoff || (RetryPolicy{}).backoff(100, 0) != defaultMaxBackoff {
+		t.Error("failed testing retry policy backoff")
+	}
+
+	defer func(random func() float64) { retryRandom = random }(retryRandom)
+	retryRandom = func() float64 { return 0.5 }
+	policy.Jitter = 0.5
+	if policy.backoff(1, 0) != 75*time.Millisecond {
+		t.Error("failed testing retry policy backoff")
+	}
+
+	// Retry-After is only used when honored, and never shortens the wait
+	if policy.backoff(1, 3*time.Second) != 75*time.Millisecond {
+		t.Error("failed testing retry policy backoff")
+	}
+	policy.HonorRetryAfter = true
+	if policy.backoff(1, 3*time.Second) != 3*time.Second || policy.backoff(1, time.Millisecond) != 75*time.Millisecond {
+		t.Error("failed testing retry policy backoff")
+	}
+}
+
+func TestMailerRetry(t *testing.T) {
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	var sent []string
+	failures := map[string]int{"bcc2@mail.com": 2}
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		var addresses []string
+		for _, v := range rcpts {
+			addresses = append(addresses, v.Address)
+		}
+		key := strings.Join(addresses, ",")
+		if failures[key] > 0 {
+			failures[key]--
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 503}
+		}
+		sent = append(sent, key)
+		return "", nil
+	}
+	mailer := NewMailer(sDriver).SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+	msg := &Message{
+		From:        mail.Address{Address: "from@mail.com"},
+		To:          []mail.Address{{Address: "to@mail.com"}},
+		BCC:         []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}, {Address: "bcc3@mail.com"}},
+		Attachments: []Attachment{{Name: "data.csv", Reader: strings.NewReader("a,b,c")}},
+	}
+	err := mailer.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing mailer retry", err)
+	}
+	// the recipients who got the email before the failures are not sent to again
+	if strings.Join(sent, ";") != "to@mail.com;bcc1@mail.com;bcc2@mail.com;bcc3@mail.com" {
+		t.Error("failed testing mailer retry")
+	}
+	if msg.results != nil {
+		t.Error("failed testing mailer retry")
+	}
+
+	// giving up after the max attempts
+	sent = nil
+	failures["to@mail.com"] = 5
+	err = mailer.SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.StatusCode != 503 || failures["to@mail.com"] != 2 || len(sent) != 0 {
+		t.Error("failed testing mailer retry")
+	}
+
+	// errors that are not transient are not retried, each recipient is tried once
+	sent = nil
+	attempts := 0
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		attempts++
+		return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 400}
+	}
+	err = mailer.SendMessage(context.Background(), msg)
+	if err == nil || attempts != 4 {
+		t.Error("failed testing mailer retry")
+	}
+
+	// cancelling the context stops waiting for the next attempt
+	attempts = 0
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		attempts++
+		return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 429, RetryAfter: time.Minute}
+	}
+	mailer.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, HonorRetryAfter: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = mailer.SendMessage(ctx, msg)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &sendErr) || attempts != 1 {
+		t.Error("failed testing mailer retry")
+	}
+}
+
+func TestMailerRetryRejectedRecipients(t *testing.T) {
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "busy@mail.com"}, {Address: "unknown@mail.com"}},
+	}
+	policy := RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+
+	// a recipient rejected for good isn't sent the email again by the retries
+	tries := make(map[string]int)
+	sDriver := initiateSendGrid(&SendGridConfig{})
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		tries[rcpts[0].Address]++
+		switch {
+		case rcpts[0].Address == "busy@mail.com" && tries["busy@mail.com"] == 1:
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 503}
+		case rcpts[0].Address == "unknown@mail.com":
+			return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, StatusCode: 400}
+		}
+		return "id", nil
+	}
+	result, err := NewMailer(sDriver).SetRetryPolicy(policy).SendMessageWithResult(context.Background(), msg)
+	var partialErr *PartialFailureError
+	if !errors.As(err, &partialErr) || len(partialErr.Failed) != 1 || partialErr.Failed[0].Address != "unknown@mail.com" || len(result.Accepted()) != 2 {
+		t.Error("failed testing mailer retry rejected recipients", err)
+	}
+	if tries["unknown@mail.com"] != 1 || tries["busy@mail.com"] != 2 || tries["to@mail.com"] != 1 {
+		t.Error("failed testing mailer retry rejected recipients", tries)
+	}
+
+	// the smtp transaction of the retry doesn't give the rejected recipient to the server again
+	var busy int32
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.rcptReply = func(rcpt string) string {
+			switch {
+			case rcpt == "busy@mail.com" && atomic.AddInt32(&busy, 1) == 1:
+				return "450 4.2.1 Mailbox busy"
+			case rcpt == "unknown@mail.com":
+				return "550 5.1.1 No such user"
+			}
+			return ""
+		}
+	})
+	result, err = NewMailer(initiateSMTP(server.config(SMTPEncryptionNone))).SetRetryPolicy(policy).SendMessageWithResult(context.Background(), msg)
+	if !errors.As(err, &partialErr) || len(partialErr.Failed) != 1 || partialErr.Failed[0].Address != "unknown@mail.com" || len(result.Accepted()) != 2 {
+		t.Error("failed testing mailer retry rejected recipients", err)
+	}
+	var unknown int
+	for _, v := range server.receivedCommands() {
+		if strings.Contains(v, "unknown@mail.com") {
+			unknown++
+		}
+	}
+	if unknown != 1 || len(server.sentMails()) != 2 {
+		t.Error("failed testing mailer retry rejected recipients", unknown)
+	}
+}
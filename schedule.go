@@ -0,0 +1,195 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrScheduleNotFound is returned when cancelling a message that isn't scheduled,
+	// it was already sent, cancelled, or scheduled by another mailer
+	ErrScheduleNotFound = errors.New("mailing: no scheduled message with this id")
+	// ErrScheduleNotCancellable is returned when the provider can't cancel the scheduled message, like MailGun
+	ErrScheduleNotCancellable = errors.New("mailing: the provider can't cancel scheduled messages")
+	// ErrScheduleNoRecipients is returned when scheduling an email without "to", "cc" or "bcc" recipients
+	ErrScheduleNoRecipients = errors.New("mailing: the scheduled email has no recipients")
+)
+
+// ScheduledResult is the result of sending a message the mailer scheduled itself
+type ScheduledResult struct {
+	ID      string // the id SendAt returned
+	Message *Message
+	Result  *SendResult // the result of every recipient
+	Err     error
+}
+
+// messageSchedule is when the provider sends the message, set on the messages the drivers schedule natively
+type messageSchedule struct {
+	at      time.Time
+	batchID string // the SendGrid batch the message belongs to, to cancel it
+}
+
+// nativeScheduler is implemented by the drivers whose provider holds the messages until a given time
+type nativeScheduler interface {
+	// the longest the provider holds a message, the later messages are scheduled by the mailer,
+	// zero when the driver can't schedule, like a wrapper of a driver without native scheduling
+	maxScheduleDelay() time.Duration
+	// the message prepared to be sent at the given time by SendMessage
+	schedule(ctx context.Context, msg *Message, at time.Time) (*Message, error)
+	// cancel the sent scheduled message
+	cancelSchedule(ctx context.Context, msg *Message, result *SendResult) error
+}
+
+// a message scheduled by the mailer or by the provider, the timer
+// sends the message or, for the providers, forgets it once it's sent
+type scheduledSend struct {
+	timer  *time.Timer
+	native bool
+	msg    *Message
+	result *SendResult
+}
+
+// Set the function called with the result of every message the mailer scheduled itself, when
+// the driver has no native scheduling, it's called from the goroutine that sent the message
+func (m *Mailer) SetScheduledResultHandler(handler func(ScheduledResult)) *Mailer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scheduledResultHandler = handler
+	return m
+}
+
+// SendAt schedules the email built through the setters to be sent at the given time and returns the
+// id that cancels it, the mailer starts a fresh message afterwards. SendGrid, MailGun and SparkPost hold
+// the message until then, with the other drivers, or later than the provider allows, the mailer keeps
+// the message in memory and sends it at that time, so it's lost if the process stops before
+func (m *Mailer) SendAt(at time.Time) (string, error) {
+	m.mu.Lock()
+	msg, buildErr := m.message, m.buildErr
+	m.message, m.buildErr = &Message{}, nil
+	m.mu.Unlock()
+	if buildErr != nil {
+		return "", &SendError{Stage: StageBuild, Err: buildErr}
+	}
+	return m.scheduleMessage(context.Background(), msg, at)
+}
+
+// SendMessageAt schedules a ready message like SendAt without touching the message built through
+// the setters, the context bounds scheduling the message with the provider, not the sending
+func (m *Mailer) SendMessageAt(ctx context.Context, msg *Message, at time.Time) (string, error) {
+	return m.scheduleMessage(ctx, msg.Clone(), at)
+}
+
+// CancelScheduled cancels the scheduled message with the id, it returns ErrScheduleNotFound when
+// the message was already sent, and ErrScheduleNotCancellable when the provider can't cancel it
+func (m *Mailer) CancelScheduled(ctx context.Context, id string) error {
+	m.mu.Lock()
+	scheduled, ok := m.schedules[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrScheduleNotFound
+	}
+	if !scheduled.native {
+		delete(m.schedules, id)
+		m.mu.Unlock()
+		if !scheduled.timer.Stop() {
+			return ErrScheduleNotFound
+		}
+		return nil
+	}
+	m.mu.Unlock()
+
+	err := m.driver.(nativeScheduler).cancelSchedule(ctx, scheduled.msg, scheduled.result)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.schedules, id)
+	m.mu.Unlock()
+	scheduled.timer.Stop()
+	return nil
+}
+
+// schedule a message the mailer owns
+func (m *Mailer) scheduleMessage(ctx context.Context, msg *Message, at time.Time) (string, error) {
+	// a message without recipients would have no sending to cancel
+	if countRecipients(msg) == 0 {
+		return "", &SendError{Stage: StageBuild, Err: ErrScheduleNoRecipients}
+	}
+	if err := checkHeaders(msg.Headers); err != nil {
+		return "", &SendError{Stage: StageBuild, Err: err}
+	}
+	id := uuid.NewString()
+	delay := time.Until(at)
+	scheduler, native := m.driver.(nativeScheduler)
+	if !native || delay <= 0 || delay > scheduler.maxScheduleDelay() {
+		// readers can only be read once the message is sent
+		msg, err := msg.bufferAttachments()
+		if err != nil {
+			return "", &SendError{Stage: StageBuild, Err: err}
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.schedules == nil {
+			m.schedules = make(map[string]*scheduledSend)
+		}
+		m.schedules[id] = &scheduledSend{timer: time.AfterFunc(delay, func() { m.sendScheduled(id, msg) })}
+		return id, nil
+	}
+
+	msg, err := scheduler.schedule(ctx, msg, at)
+	if err != nil {
+		return "", err
+	}
+	result, err := m.send(ctx, msg)
+	if len(result.Accepted()) == 0 {
+		return "", err
+	}
+	// the recipients who were sent the message can still be cancelled, so the id is returned with the partial failure
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.schedules == nil {
+		m.schedules = make(map[string]*scheduledSend)
+	}
+	m.schedules[id] = &scheduledSend{
+		native: true,
+		msg:    msg,
+		result: result,
+		timer:  time.AfterFunc(delay, func() { m.forgetScheduled(id) }),
+	}
+	return id, err
+}
+
+// send a message the mailer scheduled and report its result
+func (m *Mailer) sendScheduled(id string, msg *Message) {
+	m.forgetScheduled(id)
+	result, err := m.send(context.Background(), msg)
+	m.mu.Lock()
+	handler := m.scheduledResultHandler
+	m.mu.Unlock()
+	if handler != nil {
+		handler(ScheduledResult{ID: id, Message: msg, Result: result, Err: err})
+	}
+}
+
+func (m *Mailer) forgetScheduled(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.schedules, id)
+}
+
+// stop the messages the mailer scheduled itself, they are not sent
+func (m *Mailer) stopScheduled() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, v := range m.schedules {
+		v.timer.Stop()
+		delete(m.schedules, id)
+	}
+}
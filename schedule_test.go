@@ -0,0 +1,228 @@
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendAtLocal(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	driver := driverFunc(func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, msg.Subject)
+		return nil
+	})
+	results := make(chan ScheduledResult, 1)
+	mailer := NewMailer(driver).SetScheduledResultHandler(func(r ScheduledResult) { results <- r })
+	msg := &Message{
+		From:        mail.Address{Address: "from@mail.com"},
+		To:          []mail.Address{{Address: "to@mail.com"}},
+		Subject:     "reminder",
+		Attachments: []Attachment{{Name: "file.txt", Reader: strings.NewReader("content")}},
+	}
+	start := time.Now()
+	id, err := mailer.SendMessageAt(context.Background(), msg, start.Add(50*time.Millisecond))
+	if err != nil || id == "" {
+		t.Fatal("failed testing send at", err)
+	}
+	cancelled, err := mailer.SetFrom(EmailAddress{Address: "from@mail.com"}).
+		SetTo([]EmailAddress{{Address: "to@mail.com"}}).
+		SetSubject("cancelled").
+		SendAt(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal("failed testing send at", err)
+	}
+	if err := mailer.CancelScheduled(context.Background(), cancelled); err != nil {
+		t.Error("failed testing send at", err)
+	}
+	if err := mailer.CancelScheduled(context.Background(), cancelled); !errors.Is(err, ErrScheduleNotFound) {
+		t.Error("failed testing send at", err)
+	}
+
+	select {
+	case r := <-results:
+		if r.ID != id || r.Err != nil || len(r.Result.Accepted()) != 1 || time.Since(start) < 50*time.Millisecond {
+			t.Error("failed testing send at", r.Err)
+		}
+		// the reader was read before the message was kept
+		if string(r.Message.Attachments[0].Content) != "content" {
+			t.Error("failed testing send at")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed testing send at")
+	}
+	// a sent message can't be cancelled
+	if err := mailer.CancelScheduled(context.Background(), id); !errors.Is(err, ErrScheduleNotFound) {
+		t.Error("failed testing send at", err)
+	}
+
+	// closing the mailer drops the messages it holds
+	_, err = mailer.SendMessageAt(context.Background(), msg, time.Now().Add(20*time.Millisecond))
+	if err != nil {
+		t.Fatal("failed testing send at", err)
+	}
+	mailer.Close()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "reminder" {
+		t.Error("failed testing send at", sent)
+	}
+}
+
+func TestSendAtBuildError(t *testing.T) {
+	mailer := NewMailer(driverFunc(func(ctx context.Context, msg *Message) error { return nil }))
+	_, err := mailer.SetTemplate("welcome", nil).SendAt(time.Now().Add(time.Hour))
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageBuild {
+		t.Error("failed testing send at build error", err)
+	}
+}
+
+func TestSendAtSendGrid(t *testing.T) {
+	var mu sync.Mutex
+	var requests []map[string]interface{}
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		request := map[string]interface{}{}
+		json.Unmarshal(body, &request)
+		requests = append(requests, request)
+		switch r.URL.Path {
+		case "/v3/mail/batch":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"batch_id":"batch-1"}`))
+		case "/v3/mail/send":
+			w.WriteHeader(http.StatusAccepted)
+		case "/v3/user/scheduled_sends":
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	mailer := NewMailer(initiateSendGrid(&SendGridConfig{Host: server.URL, Endpoint: "/v3/mail/send", ApiKey: "test-api-key"}))
+	at := time.Now().Add(time.Hour)
+	id, err := mailer.SendMessageAt(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc@mail.com"}},
+		PlainTextBody: "reminder",
+	}, at)
+	if err != nil || id == "" {
+		t.Fatal("failed testing send at sendgrid", err)
+	}
+	// a batch, then a request for the "to" and one for the bcc
+	if len(paths) != 3 || paths[0] != "/v3/mail/batch" {
+		t.Fatal("failed testing send at sendgrid", paths)
+	}
+	for _, v := range requests[1:] {
+		if v["send_at"] != float64(at.Unix()) || v["batch_id"] != "batch-1" {
+			t.Error("failed testing send at sendgrid", v)
+		}
+	}
+	err = mailer.CancelScheduled(context.Background(), id)
+	if err != nil || len(paths) != 4 || paths[3] != "/v3/user/scheduled_sends" {
+		t.Fatal("failed testing send at sendgrid", err)
+	}
+	if requests[3]["batch_id"] != "batch-1" || requests[3]["status"] != "cancel" {
+		t.Error("failed testing send at sendgrid", requests[3])
+	}
+
+	// later than sendgrid holds the messages, the mailer keeps the message
+	id, err = mailer.SendMessageAt(context.Background(), &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	}, time.Now().Add(100*time.Hour))
+	if err != nil || len(paths) != 4 {
+		t.Error("failed testing send at sendgrid", err)
+	}
+	if err := mailer.CancelScheduled(context.Background(), id); err != nil {
+		t.Error("failed testing send at sendgrid", err)
+	}
+}
+
+func TestSendAtSparkPost(t *testing.T) {
+	var deleted []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	sDriver := initiateSparkPost(&SparkPostConfig{BaseUrl: server.URL, ApiKey: "test-api-key", ApiVersion: 1})
+	sDriver.httpClient = server.Client()
+	var schedules []*messageSchedule
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		schedules = append(schedules, msg.schedule)
+		if rcpts[0].Address == "bcc@mail.com" {
+			return "102", nil
+		}
+		return "101", nil
+	}
+	mailer := NewMailer(sDriver)
+	at := time.Now().Add(10 * 24 * time.Hour)
+	id, err := mailer.SendMessageAt(context.Background(), &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}, {Address: "to2@mail.com"}},
+		BCC:  []mail.Address{{Address: "bcc@mail.com"}},
+	}, at)
+	if err != nil || len(schedules) != 2 {
+		t.Fatal("failed testing send at sparkpost", err)
+	}
+	for _, v := range schedules {
+		if v == nil || !v.at.Equal(at) {
+			t.Error("failed testing send at sparkpost")
+		}
+	}
+	err = mailer.CancelScheduled(context.Background(), id)
+	if err != nil || len(deleted) != 2 || deleted[0] != "/api/v1/transmissions/101" || deleted[1] != "/api/v1/transmissions/102" {
+		t.Error("failed testing send at sparkpost", err, deleted)
+	}
+}
+
+func TestSendAtMailGun(t *testing.T) {
+	mDriver := initiateMailGun(&MailGunConfig{Domain: "mail.com", APIKey: "test-api-key"})
+	var schedule *messageSchedule
+	mDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		schedule = msg.schedule
+		return "<id@mail.com>", nil
+	}
+	mailer := NewMailer(mDriver)
+	at := time.Now().Add(time.Hour)
+	id, err := mailer.SendMessageAt(context.Background(), &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	}, at)
+	if err != nil || schedule == nil || !schedule.at.Equal(at) {
+		t.Fatal("failed testing send at mailgun", err)
+	}
+	if err := mailer.CancelScheduled(context.Background(), id); !errors.Is(err, ErrScheduleNotCancellable) {
+		t.Error("failed testing send at mailgun", err)
+	}
+}
+
+func TestSendAtNoRecipients(t *testing.T) {
+	sDriver := initiateSendGrid(&SendGridConfig{Host: "http://127.0.0.1:1", Endpoint: "/v3/mail/send"})
+	for _, driver := range []Driver{sDriver, driverFunc(func(ctx context.Context, msg *Message) error { return nil })} {
+		id, err := NewMailer(driver).SendMessageAt(context.Background(), &Message{From: mail.Address{Address: "from@mail.com"}}, time.Now().Add(time.Hour))
+		var sendErr *SendError
+		if id != "" || !errors.Is(err, ErrScheduleNoRecipients) || !errors.As(err, &sendErr) || sendErr.Stage != StageBuild {
+			t.Error("failed testing send at no recipients", err)
+		}
+	}
+}
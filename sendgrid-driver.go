@@ -5,12 +5,13 @@
 package mailing
 
 import (
+	"context"
 	"encoding/base64"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/mail"
-	"os"
+	"time"
 
 	"github.com/sendgrid/sendgrid-go"
 	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
@@ -20,171 +21,204 @@ type SendGridConfig struct {
 	Host     string // "https://api.sendgrid.com"
 	Endpoint string // "/v3/mail/send"
 	ApiKey   string // SENDGRID_API_KEY
+	// optional, the id of a dynamic template stored on sendgrid, ex: d-0123456789abcdef, SendBatch renders it
+	// with the Vars of every recipient as dynamic_template_data instead of the subject and the bodies of the message
+	DynamicTemplateID string
 }
 
 type SendGridDriver struct {
-	config         *SendGridConfig
-	messageBuilder *messageBuilder
-	from           mail.Address
-	toList         []mail.Address
-	ccList         []mail.Address
-	bccList        []mail.Address
-	subject        string
-	htmlBody       string
-	plainTextBody  string
-	attachments    []Attachment
-	initiateSend   func(from string, rcpts []string, message []byte, conf Driver) error
+	config       *SendGridConfig
+	initiateSend func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error)
 }
 
-var initiateSendGridSend = func(from string, rcpts []string, message []byte, d Driver) error {
+var initiateSendGridSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
 	sgDriver := d.(*SendGridDriver)
-	m := sgmail.NewV3Mail()
-	fromEmail := sgmail.NewEmail(sgDriver.from.Name, sgDriver.from.Address)
-	m.SetFrom(fromEmail)
-	m.Subject = sgDriver.subject
-
-	p := sgmail.NewPersonalization()
-	if len(sgDriver.toList) != 0 {
-		var tos []*sgmail.Email
-		for _, v := range sgDriver.toList {
-			tos = append(tos, sgmail.NewEmail(v.Name, v.Address))
-		}
-		p.AddTos(tos...)
+	m, err := newSendGridMail(msg)
+	if err != nil {
+		return "", err
 	}
-	if len(sgDriver.ccList) != 0 {
-		var ccs []*sgmail.Email
-		for _, v := range sgDriver.ccList {
-			ccs = append(ccs, sgmail.NewEmail(v.Name, v.Address))
+	p := sgmail.NewPersonalization()
+	for _, v := range rcpts {
+		if containsAddress(msg.CC, v) {
+			p.AddCCs(sgmail.NewEmail(v.Name, v.Address))
+		} else {
+			p.AddTos(sgmail.NewEmail(v.Name, v.Address))
 		}
-		p.AddCCs(ccs...)
 	}
 	m.AddPersonalizations(p)
-	if sgDriver.plainTextBody != "" {
-		c := sgmail.NewContent("text/plain", sgDriver.plainTextBody)
+	return sgDriver.sendMail(ctx, m)
+}
+
+// the sendgrid mail of the message without its personalizations
+func newSendGridMail(msg *Message) (*sgmail.SGMailV3, error) {
+	m := sgmail.NewV3Mail()
+	fromEmail := sgmail.NewEmail(msg.From.Name, msg.From.Address)
+	m.SetFrom(fromEmail)
+	m.Subject = msg.Subject
+	// sendgrid takes a single reply-to address
+	if len(msg.ReplyTo) > 0 {
+		m.SetReplyTo(sgmail.NewEmail(msg.ReplyTo[0].Name, msg.ReplyTo[0].Address))
+	}
+	if msg.PlainTextBody != "" {
+		c := sgmail.NewContent("text/plain", msg.PlainTextBody)
 		m.AddContent(c)
 	}
-	if sgDriver.htmlBody != "" {
-		c := sgmail.NewContent("text/html", sgDriver.htmlBody)
+	if msg.HTMLBody != "" {
+		c := sgmail.NewContent("text/html", msg.HTMLBody)
 		m.AddContent(c)
 	}
+	for k, v := range msg.Headers {
+		m.SetHeader(k, v)
+	}
+	if msg.schedule != nil {
+		m.SetSendAt(int(msg.schedule.at.Unix()))
+		m.SetBatchID(msg.schedule.batchID)
+	}
 
 	var a *sgmail.Attachment
 	var attachementContent []byte
 	var err error
-	for _, v := range sgDriver.attachments {
-		attachementContent, err = os.ReadFile(v.Path)
+	for _, v := range msg.Attachments {
+		attachementContent, err = v.readAll()
 		if err != nil {
-			return err
+			return nil, &SendError{Driver: DriverSendGrid, Stage: StageBuild, Err: err}
 		}
 		encodedAttachmentbuf := base64.StdEncoding.EncodeToString(attachementContent)
-		fmt.Println(encodedAttachmentbuf)
 		a = sgmail.NewAttachment()
 		a.SetContent(encodedAttachmentbuf)
-		a.SetType(http.DetectContentType(attachementContent))
+		a.SetType(v.detectContentType(attachementContent))
 		a.SetFilename(v.Name)
-		a.SetDisposition("attachment")
+		if v.ContentID != "" {
+			a.SetDisposition("inline")
+			a.SetContentID(v.ContentID)
+		} else {
+			a.SetDisposition("attachment")
+		}
 		m.AddAttachment(a)
 	}
+	return m, nil
+}
+
+// send the mail and return its X-Message-Id
+func (s *SendGridDriver) sendMail(ctx context.Context, m *sgmail.SGMailV3) (string, error) {
 	requestBody := sgmail.GetRequestBody(m)
-	request := sendgrid.GetRequest(sgDriver.config.ApiKey, sgDriver.config.Endpoint, sgDriver.config.Host)
+	request := sendgrid.GetRequest(s.config.ApiKey, s.config.Endpoint, s.config.Host)
 	request.Method = "POST"
 	var Body = requestBody
 	request.Body = Body
-	_, err = sendgrid.API(request)
+	res, err := sendgrid.MakeRequestWithContext(ctx, request)
 	if err != nil {
-		return err
+		return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, Err: err}
 	}
-	return nil
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		sendErr := newHTTPError(DriverSendGrid, res.StatusCode, res.Body, nil)
+		sendErr.RetryAfter = parseRetryAfter(http.Header(res.Headers).Get("Retry-After"), time.Now())
+		return "", sendErr
+	}
+	return http.Header(res.Headers).Get("X-Message-Id"), nil
 }
 
 func initiateSendGrid(config *SendGridConfig) *SendGridDriver {
 	s := &SendGridDriver{
-		config:         config,
-		messageBuilder: newMessageBuilder(),
-		htmlBody:       "",
-		plainTextBody:  "",
-		initiateSend:   initiateSendGridSend,
+		config:       config,
+		initiateSend: initiateSendGridSend,
 	}
 
 	return s
 }
 
-func (s *SendGridDriver) SetFrom(from mail.Address) error {
-	s.from = from
-	return nil
+// Name of the driver as reported in the errors
+func (s *SendGridDriver) Name() string {
+	return DriverSendGrid
 }
 
-func (s *SendGridDriver) SetTo(toList []mail.Address) error {
-	s.toList = toList
-	return nil
+func (s *SendGridDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// the message is sent once for "to" and "cc" and once for every bcc
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Driver: DriverSendGrid, Stage: StageBuild, Err: err}
+	}
+	return sendPerBCC(ctx, DriverSendGrid, msg, func(rcpts []mail.Address) (string, error) {
+		return s.initiateSend(ctx, msg, rcpts, s)
+	})
 }
 
-func (s *SendGridDriver) SetCC(ccList []mail.Address) error {
-	s.ccList = ccList
-	return nil
-}
-func (s *SendGridDriver) SetBCC(bccList []mail.Address) error {
-	s.bccList = bccList
-	return nil
+// sendgrid holds the messages up to 72 hours
+func (s *SendGridDriver) maxScheduleDelay() time.Duration {
+	return 72 * time.Hour
 }
-func (s *SendGridDriver) SetSubject(Subject string) error {
-	s.subject = Subject
-	return nil
+
+// the requests of the message share a new batch, so they are cancelled together
+func (s *SendGridDriver) schedule(ctx context.Context, msg *Message, at time.Time) (*Message, error) {
+	body, err := s.request(ctx, "/v3/mail/batch", nil)
+	if err != nil {
+		return nil, err
+	}
+	var batch struct {
+		BatchID string `json:"batch_id"`
+	}
+	err = json.Unmarshal([]byte(body), &batch)
+	if err != nil || batch.BatchID == "" {
+		return nil, &SendError{Driver: DriverSendGrid, Stage: StageHTTP, Err: fmt.Errorf("invalid batch response %q", body)}
+	}
+	msg = msg.Clone()
+	msg.schedule = &messageSchedule{at: at, batchID: batch.BatchID}
+	return msg, nil
 }
-func (s *SendGridDriver) SetHTMLBody(body string) error {
-	s.htmlBody = body
-	return nil
+
+// cancel the batch of the message
+func (s *SendGridDriver) cancelSchedule(ctx context.Context, msg *Message, result *SendResult) error {
+	body, _ := json.Marshal(map[string]string{"batch_id": msg.schedule.batchID, "status": "cancel"})
+	_, err := s.request(ctx, "/v3/user/scheduled_sends", body)
+	return err
 }
-func (s *SendGridDriver) SetPlainTextBody(body string) error {
-	s.plainTextBody = body
-	return nil
+
+// make a POST request to the api and return the response's body
+func (s *SendGridDriver) request(ctx context.Context, endpoint string, body []byte) (string, error) {
+	request := sendgrid.GetRequest(s.config.ApiKey, endpoint, s.config.Host)
+	request.Method = "POST"
+	request.Body = body
+	res, err := sendgrid.MakeRequestWithContext(ctx, request)
+	if err != nil {
+		return "", &SendError{Driver: DriverSendGrid, Stage: StageHTTP, Err: err}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", newHTTPError(DriverSendGrid, res.StatusCode, res.Body, nil)
+	}
+	return res.Body, nil
 }
-func (s *SendGridDriver) SetAttachments(attachments []Attachment) error {
-	s.attachments = attachments
-	return nil
+
+// sendgrid takes up to 1000 personalizations per request
+func (s *SendGridDriver) maxBatchSize() int {
+	return 1000
 }
 
-func (s *SendGridDriver) Send() error {
-	// prepare the message
-	s.messageBuilder.setSubject(s.subject)
-	if s.htmlBody != "" {
-		s.messageBuilder.setHTMLBody(s.htmlBody)
-	} else {
-		s.messageBuilder.setPlainTextBody(s.plainTextBody)
-	}
-	s.messageBuilder.setFrom(s.from)
-	s.messageBuilder.setToList(s.toList)
-	s.messageBuilder.setCCList(s.ccList)
-	s.messageBuilder.setAttachments(s.attachments)
-	message := s.messageBuilder.build()
-
-	// "to" and "cc" message sending
-	var rcpts []string
-	for _, v := range s.toList {
-		rcpts = append(rcpts, v.String())
-	}
-	for _, v := range s.ccList {
-		rcpts = append(rcpts, v.String())
-	}
-	from := s.from.String()
-	err := s.initiateSend(from, rcpts, message, s)
+// send a personalization per recipient, with the dynamic template the values are the dynamic_template_data,
+// sendgrid escapes them in the html, otherwise the placeholders of the message are replaced through the
+// substitutions, which apply to every part, so the html body has its own keys with the escaped values
+func (s *SendGridDriver) sendBatch(ctx context.Context, msg *Message, recipients []Recipient) (string, error) {
+	msg, names := rewritePlaceholders(msg, func(name string, html bool) string { return "{{" + placeholderKey(name, html) + "}}" })
+	m, err := newSendGridMail(msg)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+		return "", err
 	}
-
-	// send to bcc
-	for _, v := range s.bccList {
-		err = s.initiateSend(from, []string{v.String()}, message, s)
-		if err != nil {
-			return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+	if s.config.DynamicTemplateID != "" {
+		m.SetTemplateID(s.config.DynamicTemplateID)
+		m.Subject, m.Content = "", nil
+	}
+	for _, v := range recipients {
+		p := sgmail.NewPersonalization()
+		p.AddTos(sgmail.NewEmail(v.Address.Name, v.Address.Address))
+		if s.config.DynamicTemplateID != "" {
+			for name, value := range v.Vars {
+				p.SetDynamicTemplateData(name, value)
+			}
+		} else {
+			for key, value := range escapedPlaceholderValues(names, v) {
+				p.SetSubstitution("{{"+key+"}}", value)
+			}
 		}
+		m.AddPersonalizations(p)
 	}
-	s.resetDriverProps()
-	return nil
-}
-
-func (s *SendGridDriver) resetDriverProps() {
-	s.subject = ""
-	s.htmlBody = ""
-	s.plainTextBody = ""
+	return s.sendMail(ctx, m)
 }
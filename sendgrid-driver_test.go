@@ -1,15 +1,15 @@
 package mailing
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
-	"os"
-	"path/filepath"
 	"strings"
 	"testing"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 func TestSendGridDriverSend(t *testing.T) {
@@ -18,108 +18,235 @@ func TestSendGridDriverSend(t *testing.T) {
 		Endpoint: "/v3/mail/send",
 		ApiKey:   "test-api-key",
 	})
-	tmpFilePath := filepath.Join(t.TempDir(), uuid.NewString())
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		file, err := os.Create(tmpFilePath)
-		if err != nil {
-			t.Error("faild test send")
-		}
-		file.Write(message)
-		file.Close()
-		return nil
+	var sentMessages []*Message
+	var sentRcpts [][]mail.Address
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		sentMessages = append(sentMessages, msg)
+		sentRcpts = append(sentRcpts, rcpts)
+		return "", nil
 	}
 
-	sDriver.SetFrom(mail.Address{
-		Name:    "test from name",
-		Address: "from@mail.com",
-	})
-	sDriver.SetTo([]mail.Address{
-		{Name: "test from name1", Address: "from1@mail.com"},
-		{Name: "test from name2", Address: "from2@mail.com"},
-	})
-	sDriver.SetCC([]mail.Address{
-		{Name: "test cc name1", Address: "cc1@mail.com"},
-		{Name: "test cc name2", Address: "cc2@mail.com"},
-	})
-	sDriver.SetBCC([]mail.Address{
-		{Name: "test bcc name1", Address: "bcc1@mail.com"},
-		{Name: "test bcc name2", Address: "bcc2@mail.com"},
-	})
-	sDriver.SetSubject("this is the subject")
-	sDriver.SetPlainTextBody("this is plain text body")
-	sDriver.SetHTMLBody("this is html body")
-	sDriver.SetAttachments([]Attachment{
-		{
-			Name: "attachment name1",
-			Path: "./testingdata/attachment1.md",
+	msg := &Message{
+		From: mail.Address{
+			Name:    "test from name",
+			Address: "from@mail.com",
 		},
-		{
-			Name: "attachment name2",
-			Path: "./testingdata/attachment2.md",
+		To: []mail.Address{
+			{Name: "test from name1", Address: "from1@mail.com"},
+			{Name: "test from name2", Address: "from2@mail.com"},
 		},
-	})
-	err := sDriver.Send()
+		CC: []mail.Address{
+			{Name: "test cc name1", Address: "cc1@mail.com"},
+			{Name: "test cc name2", Address: "cc2@mail.com"},
+		},
+		BCC: []mail.Address{
+			{Name: "test bcc name1", Address: "bcc1@mail.com"},
+			{Name: "test bcc name2", Address: "bcc2@mail.com"},
+		},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name: "attachment name2",
+				Path: "./testingdata/attachment2.md",
+			},
+		},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
 	if err != nil {
 		t.Error("failed testing send")
 	}
-	file, _ := os.Open(tmpFilePath)
-	mBytes, _ := ioutil.ReadAll(file)
-	file.Close()
-	os.Truncate(tmpFilePath, 0)
-	m := string(mBytes)
-
-	if !strings.Contains(m, `From: "test from name" <from@mail.com>`) {
-		t.Error("Failed test send")
-	}
-	if !strings.Contains(m, `To: "test from name1" <from1@mail.com>;"test from name2" <from2@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts) != 3 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `Cc: "test cc name1" <cc1@mail.com>;"test cc name2" <cc2@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[0]) != 4 || sentRcpts[0][0].Address != "from1@mail.com" || sentRcpts[0][3].Address != "cc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Subject: this is the subject`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[1]) != 1 || sentRcpts[1][0].Address != "bcc1@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Type: text/html; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[2]) != 1 || sentRcpts[2][0].Address != "bcc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `this is html body`) {
-		t.Error("Failed test send")
+	for _, v := range sentMessages {
+		if v != msg {
+			t.Error("failed testing send")
+		}
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name1"`) {
-		t.Error("Failed test send")
+
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		return "", errors.New("this is a test error")
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAx`) {
-		t.Error("Failed test send")
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err == nil {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name2"`) {
-		t.Error("Failed test send")
+}
+
+func TestSendGridDriverSendContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	sDriver := initiateSendGrid(&SendGridConfig{
+		Host:     server.URL,
+		Endpoint: "/v3/mail/send",
+		ApiKey:   "test-api-key",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := sDriver.SendMessage(ctx, &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	})
+	if err == nil {
+		t.Error("failed testing send context")
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAy`) {
-		t.Error("Failed test send")
+	if time.Since(start) > 2*time.Second {
+		t.Error("failed testing send context")
 	}
+}
 
-	sDriver.SetHTMLBody("")
-	sDriver.SetPlainTextBody("this is plain text body")
-	err = sDriver.Send()
+func TestSendGridDriverSendToServer(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/mail/send" || r.Header.Get("Authorization") != "Bearer test-api-key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	sDriver := initiateSendGrid(&SendGridConfig{
+		Host:     server.URL,
+		Endpoint: "/v3/mail/send",
+		ApiKey:   "test-api-key",
+	})
+	err := sDriver.SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      `this is html body <img src="cid:logo">`,
+		ReplyTo:       []mail.Address{{Name: "support", Address: "support@mail.com"}},
+		Headers:       map[string]string{"List-Unsubscribe": "<https://mail.com/unsubscribe>"},
+		Attachments: []Attachment{
+			{Name: "attachment name1", Path: "./testingdata/attachment1.md"},
+			{Name: "logo.png", Path: "./testingdata/logo.png", ContentID: "logo"},
+		},
+	})
 	if err != nil {
+		t.Fatal("failed testing send", err)
+	}
+	if len(bodies) != 1 {
+		t.Fatal("failed testing send")
+	}
+	replyTo, _ := bodies[0]["reply_to"].(map[string]interface{})
+	headers, _ := bodies[0]["headers"].(map[string]interface{})
+	if replyTo["email"] != "support@mail.com" || replyTo["name"] != "support" || headers["List-Unsubscribe"] != "<https://mail.com/unsubscribe>" {
 		t.Error("failed testing send")
 	}
-	file, _ = os.Open(tmpFilePath)
-	mBytes, _ = ioutil.ReadAll(file)
-	m = string(mBytes)
-	if !strings.Contains(m, `Content-Type: text/plain; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	attachments, _ := bodies[0]["attachments"].([]interface{})
+	if len(attachments) != 2 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `this is plain text body`) {
-		t.Error("Failed test send")
+	attachment := attachments[0].(map[string]interface{})
+	if attachment["filename"] != "attachment name1" || attachment["disposition"] != "attachment" || attachment["content_id"] != nil {
+		t.Error("failed testing send")
 	}
+	inline := attachments[1].(map[string]interface{})
+	if inline["filename"] != "logo.png" || inline["disposition"] != "inline" || inline["content_id"] != "logo" || inline["type"] != "image/png" {
+		t.Error("failed testing send")
+	}
+}
 
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		return errors.New("this is a test error")
+func TestSendGridDriverSendReaderAttachment(t *testing.T) {
+	var contents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Attachments []struct {
+				Content string `json:"content"`
+				Type    string `json:"type"`
+			} `json:"attachments"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, v := range body.Attachments {
+			contents = append(contents, v.Type+":"+v.Content)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	sDriver := initiateSendGrid(&SendGridConfig{
+		Host:     server.URL,
+		Endpoint: "/v3/mail/send",
+		ApiKey:   "test-api-key",
+	})
+	// the reader is sent to "to" and to the bcc
+	err := sDriver.SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		Attachments: []Attachment{
+			{Name: "report.pdf", Reader: strings.NewReader("the report"), ContentType: "application/pdf"},
+		},
+	})
+	if err != nil {
+		t.Fatal("failed testing send", err)
 	}
-	err = sDriver.Send()
-	if err == nil {
+	if strings.Join(contents, ",") != "application/pdf:dGhlIHJlcG9ydA==,application/pdf:dGhlIHJlcG9ydA==" {
 		t.Error("failed testing send")
 	}
 }
+
+func TestSendGridDriverSendError(t *testing.T) {
+	status := http.StatusTooManyRequests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":[{"message":"too many requests"}]}`))
+	}))
+	defer server.Close()
+	sDriver := initiateSendGrid(&SendGridConfig{
+		Host:     server.URL,
+		Endpoint: "/v3/mail/send",
+		ApiKey:   "test-api-key",
+	})
+	msg := &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatal("failed testing send error")
+	}
+	if sendErr.Driver != DriverSendGrid || sendErr.Stage != StageHTTP || sendErr.StatusCode != http.StatusTooManyRequests || !sendErr.Retryable() {
+		t.Error("failed testing send error")
+	}
+	if sendErr.Body != `{"errors":[{"message":"too many requests"}]}` || sendErr.RetryAfter != 5*time.Second {
+		t.Error("failed testing send error")
+	}
+
+	status = http.StatusBadRequest
+	err = sDriver.SendMessage(context.Background(), msg)
+	if !errors.As(err, &sendErr) || sendErr.StatusCode != http.StatusBadRequest || sendErr.Retryable() {
+		t.Error("failed testing send error")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the most recipients ses accepts in a request
+const sesMaxRecipients = 50
+
+type SESConfig struct {
+	Region               string // example: us-east-1
+	AccessKeyID          string // AWS_ACCESS_KEY_ID
+	SecretAccessKey      string // AWS_SECRET_ACCESS_KEY
+	SessionToken         string // AWS_SESSION_TOKEN, only needed with temporary credentials
+	Endpoint             string // optional, defaults to https://email.<region>.amazonaws.com
+	ConfigurationSetName string // optional
+	RawMessage           bool   // send the full mime message instead of the simple content, always used when there are attachments or extra headers
+}
+
+type SESDriver struct {
+	config       *SESConfig
+	initiateSend func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error)
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress               string         `json:"FromEmailAddress"`
+	Destination                    sesDestination `json:"Destination"`
+	ReplyToAddresses               []string       `json:"ReplyToAddresses,omitempty"`
+	FeedbackForwardingEmailAddress string         `json:"FeedbackForwardingEmailAddress,omitempty"` // where ses forwards the bounce and complaint notifications
+	Content                        sesContent     `json:"Content"`
+	ConfigurationSetName           string         `json:"ConfigurationSetName,omitempty"`
+}
+
+type sesDestination struct {
+	ToAddresses  []string `json:"ToAddresses,omitempty"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type sesContent struct {
+	Simple *sesSimpleContent `json:"Simple,omitempty"`
+	Raw    *sesRawContent    `json:"Raw,omitempty"`
+}
+
+type sesSimpleContent struct {
+	Subject sesData `json:"Subject"`
+	Body    sesBody `json:"Body"`
+}
+
+type sesBody struct {
+	Text *sesData `json:"Text,omitempty"`
+	Html *sesData `json:"Html,omitempty"`
+}
+
+type sesData struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset,omitempty"`
+}
+
+type sesRawContent struct {
+	Data []byte `json:"Data"` // encoded as base64 by encoding/json
+}
+
+var initiateSESSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+	sesDriv := d.(*SESDriver)
+	conf := sesDriv.config
+	reqBody := sesSendEmailRequest{
+		FromEmailAddress:               msg.From.String(),
+		FeedbackForwardingEmailAddress: msg.ReturnPath,
+		ConfigurationSetName:           conf.ConfigurationSetName,
+	}
+	for _, v := range msg.ReplyTo {
+		reqBody.ReplyToAddresses = append(reqBody.ReplyToAddresses, v.String())
+	}
+	// the envelope, addresses that are neither in "to" nor in "cc" are sent as bcc
+	for _, v := range rcpts {
+		if containsAddress(msg.To, v) {
+			reqBody.Destination.ToAddresses = append(reqBody.Destination.ToAddresses, v.String())
+		} else if containsAddress(msg.CC, v) {
+			reqBody.Destination.CcAddresses = append(reqBody.Destination.CcAddresses, v.String())
+		} else {
+			reqBody.Destination.BccAddresses = append(reqBody.Destination.BccAddresses, v.String())
+		}
+	}
+	// the simple content has no headers, so the extra headers need the raw message
+	if conf.RawMessage || len(msg.Attachments) > 0 || len(msg.Headers) > 0 {
+		message, err := buildMessage(msg)
+		if err != nil {
+			return "", &SendError{Driver: DriverSES, Stage: StageBuild, Err: err}
+		}
+		reqBody.Content.Raw = &sesRawContent{Data: message}
+	} else {
+		simple := &sesSimpleContent{
+			Subject: sesData{Data: msg.Subject, Charset: "UTF-8"},
+		}
+		if msg.PlainTextBody != "" {
+			simple.Body.Text = &sesData{Data: msg.PlainTextBody, Charset: "UTF-8"}
+		}
+		if msg.HTMLBody != "" {
+			simple.Body.Html = &sesData{Data: msg.HTMLBody, Charset: "UTF-8"}
+		}
+		reqBody.Content.Simple = simple
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", &SendError{Driver: DriverSES, Stage: StageBuild, Err: err}
+	}
+
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", conf.Region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return "", &SendError{Driver: DriverSES, Stage: StageHTTP, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sigV4Sign(req, body, "ses", conf.Region, conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken, time.Now())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", &SendError{Driver: DriverSES, Stage: StageHTTP, Err: err}
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var sesErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(resBody, &sesErr)
+		sendErr := newHTTPError(DriverSES, res.StatusCode, string(resBody), fmt.Errorf("%s: %s", res.Header.Get("X-Amzn-Errortype"), sesErr.Message))
+		sendErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		return "", sendErr
+	}
+	var sesRes struct {
+		MessageId string `json:"MessageId"`
+	}
+	json.Unmarshal(resBody, &sesRes)
+	return sesRes.MessageId, nil
+}
+
+// sign the request with AWS signature version 4, the host, the content type and
+// the x-amz-* headers are signed
+func sigV4Sign(req *http.Request, body []byte, service, region, accessKeyID, secretAccessKey, sessionToken string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var headerNames []string
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, k := range headerNames {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", shortDate, region, service)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), shortDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func initiateSES(config *SESConfig) *SESDriver {
+	s := &SESDriver{
+		config:       config,
+		initiateSend: initiateSESSend,
+	}
+
+	return s
+}
+
+// Name of the driver as reported in the errors
+func (s *SESDriver) Name() string {
+	return DriverSES
+}
+
+func (s *SESDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// ses supports bcc, so "to", "cc" and "bcc" are sent together, in a request per 50 recipients
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Driver: DriverSES, Stage: StageBuild, Err: err}
+	}
+	return sendInChunks(ctx, DriverSES, msg, sesMaxRecipients, func(rcpts []mail.Address) (string, error) {
+		return s.initiateSend(ctx, msg, rcpts, s)
+	})
+}
@@ -0,0 +1,214 @@
+package mailing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSESDriverSend(t *testing.T) {
+	sDriver := initiateSES(&SESConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "test-access-key-id",
+		SecretAccessKey: "test-secret-access-key",
+	})
+	var sentMessages []*Message
+	var sentRcpts [][]mail.Address
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		sentMessages = append(sentMessages, msg)
+		sentRcpts = append(sentRcpts, rcpts)
+		return "", nil
+	}
+
+	msg := &Message{
+		From: mail.Address{
+			Name:    "test from name",
+			Address: "from@mail.com",
+		},
+		To: []mail.Address{
+			{Name: "test from name1", Address: "from1@mail.com"},
+			{Name: "test from name2", Address: "from2@mail.com"},
+		},
+		CC: []mail.Address{
+			{Name: "test cc name1", Address: "cc1@mail.com"},
+			{Name: "test cc name2", Address: "cc2@mail.com"},
+		},
+		BCC: []mail.Address{
+			{Name: "test bcc name1", Address: "bcc1@mail.com"},
+			{Name: "test bcc name2", Address: "bcc2@mail.com"},
+		},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name: "attachment name2",
+				Path: "./testingdata/attachment2.md",
+			},
+		},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Error("failed testing send")
+	}
+	if len(sentRcpts) != 1 {
+		t.Fatal("failed testing send")
+	}
+	if len(sentRcpts[0]) != 6 || sentRcpts[0][0].Address != "from1@mail.com" || sentRcpts[0][3].Address != "cc2@mail.com" || sentRcpts[0][5].Address != "bcc2@mail.com" {
+		t.Error("failed testing send")
+	}
+	for _, v := range sentMessages {
+		if v != msg {
+			t.Error("failed testing send")
+		}
+	}
+
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		return "", errors.New("this is a test error")
+	}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err == nil {
+		t.Error("failed testing send")
+	}
+}
+
+func TestSESDriverSendToServer(t *testing.T) {
+	var requests []sesSendEmailRequest
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/email/outbound-emails" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		var req sesSendEmailRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(req.FromEmailAddress, "rejected@mail.com") {
+			w.Header().Set("X-Amzn-Errortype", "MessageRejected")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"Email address is not verified."}`))
+			return
+		}
+		requests = append(requests, req)
+		w.Write([]byte(`{"MessageId":"test-message-id"}`))
+	}))
+	defer server.Close()
+	sDriver := initiateSES(&SESConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "test-access-key-id",
+		SecretAccessKey: "test-secret-access-key",
+		Endpoint:        server.URL,
+	})
+	msg := &Message{
+		From:          mail.Address{Name: "from name", Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		CC:            []mail.Address{{Address: "cc@mail.com"}},
+		BCC:           []mail.Address{{Address: "bcc@mail.com"}},
+		ReplyTo:       []mail.Address{{Address: "support@mail.com"}},
+		ReturnPath:    "bounces@mail.com",
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing send", err)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=test-access-key-id/") || !strings.Contains(authorization, "/us-east-1/ses/aws4_request") {
+		t.Error("failed testing send")
+	}
+	if len(requests) != 1 {
+		t.Fatal("failed testing send")
+	}
+	first := requests[0]
+	if first.FromEmailAddress != `"from name" <from@mail.com>` {
+		t.Error("failed testing send")
+	}
+	if strings.Join(first.ReplyToAddresses, ",") != "<support@mail.com>" || first.FeedbackForwardingEmailAddress != "bounces@mail.com" {
+		t.Error("failed testing send")
+	}
+	if strings.Join(first.Destination.ToAddresses, ",") != "<to@mail.com>" || strings.Join(first.Destination.CcAddresses, ",") != "<cc@mail.com>" || strings.Join(first.Destination.BccAddresses, ",") != "<bcc@mail.com>" {
+		t.Error("failed testing send")
+	}
+	if first.Content.Raw != nil || first.Content.Simple == nil {
+		t.Fatal("failed testing send")
+	}
+	if first.Content.Simple.Subject.Data != "this is the subject" || first.Content.Simple.Body.Html.Data != "this is html body" || first.Content.Simple.Body.Text.Data != "this is plain text body" {
+		t.Error("failed testing send")
+	}
+
+	// more than 50 recipients are split in requests of 50, "to" and "cc" in the first one
+	requests = nil
+	msg.BCC = nil
+	for i := 0; i < 60; i++ {
+		msg.BCC = append(msg.BCC, mail.Address{Address: fmt.Sprintf("bcc%d@mail.com", i)})
+	}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err != nil || len(requests) != 2 {
+		t.Fatal("failed testing send", err)
+	}
+	firstTo, secondTo := requests[0].Destination, requests[1].Destination
+	if len(firstTo.ToAddresses) != 1 || len(firstTo.CcAddresses) != 1 || len(firstTo.BccAddresses) != 48 || len(secondTo.ToAddresses) != 0 || len(secondTo.BccAddresses) != 12 {
+		t.Error("failed testing send")
+	}
+
+	// extra headers switch to the raw message
+	requests = nil
+	msg.BCC = nil
+	msg.Headers = map[string]string{"List-Unsubscribe": "<https://mail.com/unsubscribe>"}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err != nil || len(requests) != 1 || requests[0].Content.Raw == nil {
+		t.Fatal("failed testing send", err)
+	}
+	if !strings.Contains(string(requests[0].Content.Raw.Data), "List-Unsubscribe: <https://mail.com/unsubscribe>\r\n") {
+		t.Error("failed testing send")
+	}
+
+	// attachments switch to the raw message
+	requests = nil
+	msg.Headers = nil
+	msg.Attachments = []Attachment{{Name: "attachment name1", Path: "./testingdata/attachment1.md"}}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing send", err)
+	}
+	if len(requests) != 1 || requests[0].Content.Simple != nil || requests[0].Content.Raw == nil {
+		t.Fatal("failed testing send")
+	}
+	raw := string(requests[0].Content.Raw.Data)
+	if !strings.Contains(raw, "Subject: this is the subject") || !strings.Contains(raw, "Reply-To: <support@mail.com>\r\n") || !strings.Contains(raw, `Content-Disposition: attachment; filename="attachment name1"`) {
+		t.Error("failed testing send")
+	}
+
+	msg.From = mail.Address{Address: "rejected@mail.com"}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err == nil || !strings.Contains(err.Error(), "Email address is not verified.") {
+		t.Error("failed testing send")
+	}
+}
+
+func TestSigV4Sign(t *testing.T) {
+	// the get-vanilla case from the AWS signature version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	sigV4Sign(req, nil, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if req.Header.Get("Authorization") != expected {
+		t.Error("failed testing sigv4 sign")
+	}
+}
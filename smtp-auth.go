@@ -0,0 +1,144 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPAuthMechanism is the authentication used with the smtp server
+type SMTPAuthMechanism string
+
+const (
+	SMTPAuthAuto    SMTPAuthMechanism = ""         // picks a mechanism from the ones the server advertises, skipped when it advertises none or there are no credentials
+	SMTPAuthNone    SMTPAuthMechanism = "NONE"     // no authentication
+	SMTPAuthPlain   SMTPAuthMechanism = "PLAIN"    // username and password, only sent over tls or to localhost
+	SMTPAuthLogin   SMTPAuthMechanism = "LOGIN"    // username and password, only sent over tls or to localhost
+	SMTPAuthCRAMMD5 SMTPAuthMechanism = "CRAM-MD5" // the password is never sent, the server challenge is signed with it
+	SMTPAuthXOAUTH2 SMTPAuthMechanism = "XOAUTH2"  // username and an OAuth2 access token from SMTPConfig.TokenSource, ex: Gmail and Office 365
+)
+
+// SMTPTokenSource returns the OAuth2 access token for XOAUTH2, it's called for every
+// connection so it can refresh the token when it expires
+type SMTPTokenSource func(ctx context.Context) (string, error)
+
+// the authentication to use with the server, nil when it's skipped
+func smtpAuth(ctx context.Context, client *smtp.Client, conf *SMTPConfig) (smtp.Auth, error) {
+	mechanism := conf.Auth
+	if mechanism == SMTPAuthAuto {
+		ok, advertised := client.Extension("AUTH")
+		if !ok || (conf.Username == "" && conf.TokenSource == nil) {
+			return nil, nil
+		}
+		_, isTLS := client.TLSConnectionState()
+		mechanism = pickSMTPAuth(strings.Fields(strings.ToUpper(advertised)), conf.TokenSource != nil, isTLS)
+		if mechanism == SMTPAuthAuto {
+			return nil, fmt.Errorf("mailing: none of the smtp server's authentication mechanisms is supported: %s", advertised)
+		}
+	}
+	switch mechanism {
+	case SMTPAuthNone:
+		return nil, nil
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", conf.Username, conf.Password, conf.Host), nil
+	case SMTPAuthLogin:
+		return &loginAuth{username: conf.Username, password: conf.Password, host: conf.Host}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(conf.Username, conf.Password), nil
+	case SMTPAuthXOAUTH2:
+		if conf.TokenSource == nil {
+			return nil, errors.New("mailing: XOAUTH2 needs SMTPConfig.TokenSource")
+		}
+		token, err := conf.TokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &xoauth2Auth{username: conf.Username, token: token, host: conf.Host}, nil
+	}
+	return nil, fmt.Errorf("mailing: unknown smtp authentication mechanism %q", mechanism)
+}
+
+// pick the mechanism from the advertised ones, the password isn't sent
+// in plain text when the connection isn't encrypted and CRAM-MD5 is available
+func pickSMTPAuth(advertised []string, hasTokenSource bool, isTLS bool) SMTPAuthMechanism {
+	preferred := []SMTPAuthMechanism{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5}
+	if !isTLS {
+		preferred = []SMTPAuthMechanism{SMTPAuthCRAMMD5, SMTPAuthPlain, SMTPAuthLogin}
+	}
+	if hasTokenSource {
+		preferred = []SMTPAuthMechanism{SMTPAuthXOAUTH2}
+	}
+	for _, v := range preferred {
+		for _, a := range advertised {
+			if a == string(v) {
+				return v
+			}
+		}
+	}
+	return SMTPAuthAuto
+}
+
+// the credentials are only sent over tls or to localhost, like smtp.PlainAuth
+func checkSMTPAuthServer(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
+
+// loginAuth implements the LOGIN mechanism, the server asks for the username then the password
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	err := checkSMTPAuthServer(server, a.host)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(SMTPAuthLogin), nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism of Gmail and Office 365
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	err := checkSMTPAuthServer(server, a.host)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(SMTPAuthXOAUTH2), []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sent the error details, an empty response ends the exchange with the failure reply
+		return []byte{}, nil
+	}
+	return nil, nil
+}
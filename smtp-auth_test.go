@@ -0,0 +1,118 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestSMTPAuth(t *testing.T) {
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	}
+	var tokens int
+	tokenSource := func(ctx context.Context) (string, error) {
+		tokens++
+		return "access-token", nil
+	}
+	cases := []struct {
+		auth        SMTPAuthMechanism
+		advertised  string
+		username    string
+		tokenSource SMTPTokenSource
+		expected    string
+	}{
+		{SMTPAuthAuto, "", "user", nil, ""},
+		{SMTPAuthAuto, "AUTH PLAIN LOGIN", "", nil, ""},
+		{SMTPAuthAuto, "AUTH LOGIN PLAIN", "user", nil, "PLAIN \x00user\x00secret"},
+		{SMTPAuthAuto, "AUTH LOGIN", "user", nil, "LOGIN user secret"},
+		{SMTPAuthAuto, "AUTH PLAIN XOAUTH2", "user", tokenSource, "XOAUTH2 user=user\x01auth=Bearer access-token\x01\x01"},
+		{SMTPAuthNone, "AUTH PLAIN", "user", nil, ""},
+		{SMTPAuthLogin, "AUTH PLAIN LOGIN", "user", nil, "LOGIN user secret"},
+		{SMTPAuthCRAMMD5, "AUTH CRAM-MD5", "user", nil, "CRAM-MD5 user a3c0530e986b6803a9b4e4d78013746d"},
+		{SMTPAuthXOAUTH2, "", "user", tokenSource, "XOAUTH2 user=user\x01auth=Bearer access-token\x01\x01"},
+	}
+	for i, c := range cases {
+		server := newTestSMTPServer(t, func(s *testSMTPServer) {
+			if c.advertised != "" {
+				s.extensions = append(s.extensions, c.advertised)
+			}
+		})
+		config := server.config(SMTPEncryptionNone)
+		config.Auth = c.auth
+		config.Username = c.username
+		config.Password = "secret"
+		config.TokenSource = c.tokenSource
+		err := initiateSMTP(config).SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Errorf("failed testing smtp auth, case %d: %v", i, err)
+			continue
+		}
+		auths := server.receivedAuths()
+		if c.expected == "" && len(auths) != 0 {
+			t.Errorf("failed testing smtp auth, case %d", i)
+		}
+		if c.expected != "" && (len(auths) != 1 || auths[0] != c.expected) {
+			t.Errorf("failed testing smtp auth, case %d: %q", i, auths)
+		}
+		if len(server.sentMails()) != 1 {
+			t.Errorf("failed testing smtp auth, case %d", i)
+		}
+	}
+	if tokens != 2 {
+		t.Error("failed testing smtp auth")
+	}
+
+	// a failing token source fails the authentication
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.extensions = append(s.extensions, "AUTH XOAUTH2")
+	})
+	config := server.config(SMTPEncryptionNone)
+	config.Username = "user"
+	config.TokenSource = func(ctx context.Context) (string, error) {
+		return "", errors.New("token expired")
+	}
+	err := initiateSMTP(config).SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageAuth || !strings.Contains(err.Error(), "token expired") {
+		t.Error("failed testing smtp auth")
+	}
+}
+
+func TestPickSMTPAuth(t *testing.T) {
+	if pickSMTPAuth([]string{"LOGIN", "CRAM-MD5", "PLAIN"}, false, true) != SMTPAuthPlain {
+		t.Error("failed testing pick smtp auth")
+	}
+	if pickSMTPAuth([]string{"LOGIN", "CRAM-MD5", "PLAIN"}, false, false) != SMTPAuthCRAMMD5 {
+		t.Error("failed testing pick smtp auth")
+	}
+	if pickSMTPAuth([]string{"PLAIN"}, true, true) != SMTPAuthAuto || pickSMTPAuth([]string{"GSSAPI"}, false, true) != SMTPAuthAuto {
+		t.Error("failed testing pick smtp auth")
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth := &loginAuth{username: "user", password: "secret", host: "smtp.mail.com"}
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.mail.com", TLS: false})
+	if err == nil {
+		t.Error("failed testing login auth")
+	}
+	mechanism, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.mail.com", TLS: true})
+	if err != nil || mechanism != "LOGIN" {
+		t.Error("failed testing login auth")
+	}
+	username, _ := auth.Next([]byte("Username:"), true)
+	password, _ := auth.Next([]byte("Password:"), true)
+	if string(username) != "user" || string(password) != "secret" {
+		t.Error("failed testing login auth")
+	}
+	_, err = auth.Next([]byte("Something:"), true)
+	if err == nil {
+		t.Error("failed testing login auth")
+	}
+}
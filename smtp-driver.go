@@ -5,163 +5,330 @@
 package mailing
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/mail"
 	"net/smtp"
+	"time"
 )
 
 type SMTPConfig struct {
-	Host      string
-	Port      int
-	Username  string
-	Password  string
-	TLSConfig tls.Config
-}
-
-type smtpDriver struct {
-	config         *SMTPConfig
-	messageBuilder *messageBuilder
-	from           mail.Address
-	toList         []mail.Address
-	ccList         []mail.Address
-	bccList        []mail.Address
-	subject        string
-	htmlBody       string
-	plainTextBody  string
-	attachments    []Attachment
-	initiateSend   func(from string, rcpts []string, message []byte, d Driver) error
-}
-
-var smtpInitiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-	smtpDriv := d.(*smtpDriver)
-	conf := smtpDriv.config
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", conf.Host, conf.Port), &conf.TLSConfig)
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	TLSConfig   tls.Config
+	Encryption  SMTPEncryption    // how the connection is secured, defaults to implicit tls
+	Auth        SMTPAuthMechanism // the authentication mechanism, defaults to picking one the server advertises
+	TokenSource SMTPTokenSource   // returns the access token for XOAUTH2
+	PoolSize    int               // the most connections kept open and reused between emails, 0 opens a new connection for every email
+	IdleTimeout time.Duration     // how long a pooled connection is kept open without being used, defaults to 30s
+	DKIM        *DKIMConfig       // signs the emails with DKIM when set
+}
+
+// SMTPEncryption is how the connection to the smtp server is secured
+type SMTPEncryption int
+
+const (
+	SMTPEncryptionImplicitTLS      SMTPEncryption = iota // tls from the start of the connection, usually on port 465
+	SMTPEncryptionNone                                   // plain text connection, ex: a local relay on port 25
+	SMTPEncryptionSTARTTLS                               // upgrade to tls when the server supports STARTTLS, stay in plain text otherwise
+	SMTPEncryptionSTARTTLSRequired                       // upgrade to tls with STARTTLS and fail when the server doesn't support it, usually on port 587
+)
+
+// ErrSTARTTLSNotSupported is returned when STARTTLS is required but the smtp server doesn't advertise it
+var ErrSTARTTLSNotSupported = errors.New("mailing: the smtp server doesn't support STARTTLS")
+
+// Err8BITMIMENotSupported is returned when the message isn't 7bit but the smtp server doesn't advertise 8BITMIME
+var Err8BITMIMENotSupported = errors.New("mailing: the smtp server doesn't support 8BITMIME")
+
+// ErrSMTPUTF8NotSupported is returned when an address isn't ascii but the smtp server doesn't advertise SMTPUTF8
+var ErrSMTPUTF8NotSupported = errors.New("mailing: the smtp server doesn't support SMTPUTF8")
+
+type SMTPDriver struct {
+	config       *SMTPConfig
+	pool         *smtpPool   // nil when the connections are not pooled
+	dkim         *dkimSigner // nil when the emails are not signed
+	dkimErr      error       // the DKIM config is invalid, every sending fails with it
+	initiateSend func(ctx context.Context, from string, rcpts []string, message *smtpMessage, d Driver) (string, error)
+}
+
+// smtpMessage is the message written after the DATA command, without DKIM it's written straight to the
+// connection while the attachments are read, so large attachments are never held in memory whole
+type smtpMessage struct {
+	built    []byte                  // the message built in memory, nil when it's streamed
+	stream   func(w io.Writer) error // writes the message when it's streamed
+	eightBit bool                    // the message isn't ascii, it needs BODY=8BITMIME
+	once     bool                    // the streamed message has attachments given as readers, it can only be written once
+	written  bool
+}
+
+// build the message in memory, the readers are read so the message can be written again
+func builtSMTPMessage(built []byte) *smtpMessage {
+	return &smtpMessage{built: built, eightBit: !isASCII(string(built))}
+}
+
+// stream the message when it's written, the Date and Message-ID are set once so writing it again gives the same email
+func streamedSMTPMessage(msg *Message) (*smtpMessage, error) {
+	builder := messageBuilderOf(msg)
+	builder.date = time.Now()
+	messageID, err := newMessageID(msg.From.Address)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling tls.Dial(): %v", err.Error()))
+		return nil, err
 	}
-	defer conn.Close()
-	client, err := smtp.NewClient(conn, conf.Host)
-	if err != nil {
-		return errors.New(fmt.Sprintf("error calling smtp.NewClient(): %v", err.Error()))
+	builder.messageID = messageID
+	message := &smtpMessage{stream: builder.writeTo, eightBit: !builder.isASCII()}
+	for _, v := range msg.Attachments {
+		message.once = message.once || v.Reader != nil
 	}
-	defer client.Close()
-	err = client.Auth(smtp.PlainAuth("", conf.Username, conf.Password, conf.Host))
-	if err != nil {
-		return errors.New(fmt.Sprintf("error calling SMTP's client.Auth(): %v", err.Error()))
+	return message, nil
+}
+
+// write the message to w
+func (m *smtpMessage) writeTo(w io.Writer) error {
+	m.written = true
+	if m.built != nil {
+		_, err := w.Write(m.built)
+		return err
 	}
-	client.Mail(from)
-	for _, emailAddress := range rcpts {
-		err = client.Rcpt(emailAddress)
-		if err != nil {
-			return errors.New(fmt.Sprintf("error calling rcpt(): %v", err.Error()))
-		}
+	return m.stream(w)
+}
+
+// whether the message can be written, again for a new connection
+func (m *smtpMessage) canWrite() bool {
+	return !m.once || !m.written
+}
+
+var smtpInitiateSend = func(ctx context.Context, from string, rcpts []string, message *smtpMessage, d Driver) (string, error) {
+	smtpDriv := d.(*SMTPDriver)
+	if smtpDriv.pool != nil {
+		return smtpDriv.pool.send(ctx, from, rcpts, message)
 	}
-	writer, err := client.Data()
+	c, err := openSMTPConn(ctx, smtpDriv.config)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling data(): %v", err.Error()))
+		return "", err
+	}
+	defer c.conn.Close()
+	reply, err := c.send(ctx, from, rcpts, message)
+	var partialErr *PartialFailureError
+	if err != nil && !errors.As(err, &partialErr) {
+		return "", err
+	}
+	stopWatching := watchConnContext(ctx, c.conn)
+	defer stopWatching()
+	quitErr := c.client.Quit()
+	if quitErr != nil && err == nil {
+		return "", smtpFail(ctx, StageData, quitErr)
 	}
-	_, err = writer.Write(message)
+	return reply, err
+}
+
+// dial the server, both the tcp connection and the tls handshake of implicit tls are bound to the context
+func smtpDial(ctx context.Context, conf *SMTPConfig) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", conf.Host, conf.Port))
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling writer.Close(): %v", err.Error()))
+		return nil, err
+	}
+	if conf.Encryption != SMTPEncryptionImplicitTLS {
+		return conn, nil
 	}
-	writer.Close()
-	err = client.Quit()
+	tlsConn := tls.Client(conn, smtpTLSConfig(conf))
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error quiting client: %v", err.Error()))
+		conn.Close()
+		return nil, err
 	}
-	return nil
+	return tlsConn, nil
 }
 
-func initiateSMTP(config *SMTPConfig) *smtpDriver {
-	s := &smtpDriver{
-		config:         config,
-		messageBuilder: newMessageBuilder(),
-		htmlBody:       "",
-		plainTextBody:  "",
-		initiateSend:   smtpInitiateSend,
+// upgrade the connection with STARTTLS when the encryption mode asks for it
+func smtpStartTLS(client *smtp.Client, conf *SMTPConfig) error {
+	if conf.Encryption != SMTPEncryptionSTARTTLS && conf.Encryption != SMTPEncryptionSTARTTLSRequired {
+		return nil
 	}
-
-	return s
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if conf.Encryption == SMTPEncryptionSTARTTLSRequired {
+			return ErrSTARTTLSNotSupported
+		}
+		return nil
+	}
+	return client.StartTLS(smtpTLSConfig(conf))
 }
 
-func (s *smtpDriver) SetFrom(from mail.Address) error {
-	s.from = from
-	return nil
+func smtpTLSConfig(conf *SMTPConfig) *tls.Config {
+	tlsConfig := conf.TLSConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = conf.Host
+	}
+	return tlsConfig
 }
 
-func (s *smtpDriver) SetTo(toList []mail.Address) error {
-	s.toList = toList
-	return nil
+// apply the context's deadline to the connection and interrupt any pending smtp command
+// once the context is done, the returned func stops the watching and clears the deadline
+func watchConnContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
 }
 
-func (s *smtpDriver) SetCC(ccList []mail.Address) error {
-	s.ccList = ccList
-	return nil
-}
-func (s *smtpDriver) SetBCC(bccList []mail.Address) error {
-	s.bccList = bccList
-	return nil
-}
-func (s *smtpDriver) SetSubject(Subject string) error {
-	s.subject = Subject
-	return nil
+// the error of a failed smtp step, errors caused by the context
+// interrupting the connection report the context's error
+func smtpFail(ctx context.Context, stage SendStage, err error) error {
+	if ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return newSMTPError(stage, err)
 }
-func (s *smtpDriver) SetHTMLBody(body string) error {
-	s.htmlBody = body
-	return nil
+
+func initiateSMTP(config *SMTPConfig) *SMTPDriver {
+	s := &SMTPDriver{
+		config:       config,
+		initiateSend: smtpInitiateSend,
+	}
+	if config.PoolSize > 0 {
+		s.pool = newSMTPPool(config)
+	}
+	if config.DKIM != nil {
+		s.dkim, s.dkimErr = newDKIMSigner(config.DKIM)
+	}
+
+	return s
 }
-func (s *smtpDriver) SetPlainTextBody(body string) error {
-	s.plainTextBody = body
-	return nil
+
+// Name of the driver as reported in the errors
+func (s *SMTPDriver) Name() string {
+	return DriverSMTP
 }
-func (s *smtpDriver) SetAttachments(attachments []Attachment) error {
-	s.attachments = attachments
+
+// Close the pooled connections that are idle
+func (s *SMTPDriver) Close() error {
+	if s.pool != nil {
+		s.pool.close()
+	}
 	return nil
 }
 
-func (s *smtpDriver) Send() error {
-	// prepare the message
-	s.messageBuilder.setSubject(s.subject)
-	if s.htmlBody != "" {
-		s.messageBuilder.setHTMLBody(s.htmlBody)
-	} else {
-		s.messageBuilder.setPlainTextBody(s.plainTextBody)
+func (s *SMTPDriver) SendMessage(ctx context.Context, msg *Message) error {
+	if s.dkimErr != nil {
+		return &SendError{Driver: DriverSMTP, Stage: StageBuild, Err: s.dkimErr}
+	}
+	message, err := s.prepare(msg)
+	if err != nil {
+		return &SendError{Driver: DriverSMTP, Stage: StageBuild, Err: err}
 	}
-	s.messageBuilder.setFrom(s.from)
-	s.messageBuilder.setToList(s.toList)
-	s.messageBuilder.setCCList(s.ccList)
-	s.messageBuilder.setAttachments(s.attachments)
-	message := s.messageBuilder.build()
 
-	// "to" and "cc" message sending
+	// the email is sent to all the recipients in a single transaction, the bcc
+	// recipients are only given to the server and never written in the headers,
+	// the recipients rejected for good by an earlier attempt are only reported
 	var rcpts []string
-	for _, v := range s.toList {
-		rcpts = append(rcpts, v.String())
+	var rejected []RecipientError
+	for _, list := range [][]mail.Address{msg.To, msg.CC, msg.BCC} {
+		for _, v := range list {
+			if sendErr := msg.results.rejected([]mail.Address{v}); sendErr != nil {
+				rejected = append(rejected, RecipientError{Address: v.Address, Err: sendErr})
+			} else if !msg.results.accepted([]mail.Address{v}) {
+				rcpts = append(rcpts, v.Address)
+			}
+		}
 	}
-	for _, v := range s.ccList {
-		rcpts = append(rcpts, v.String())
+	if len(rcpts) == 0 {
+		if len(rejected) > 0 {
+			return &PartialFailureError{Failed: rejected}
+		}
+		return nil
 	}
-	from := s.from.String()
-	err := s.initiateSend(from, rcpts, message, s)
-	if err != nil {
-		return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+	err = s.sendTransaction(ctx, msg, rcpts, message)
+	if len(rejected) == 0 {
+		return err
 	}
+	var partialErr *PartialFailureError
+	switch {
+	case err == nil:
+		return &PartialFailureError{Sent: rcpts, Failed: rejected}
+	case errors.As(err, &partialErr):
+		partialErr.Failed = append(partialErr.Failed, rejected...)
+	}
+	return err
+}
 
-	// send to bcc
-	for _, v := range s.bccList {
-		err = s.initiateSend(from, []string{v.String()}, message, s)
-		if err != nil {
-			return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+// send the transaction to the recipients and record their results
+func (s *SMTPDriver) sendTransaction(ctx context.Context, msg *Message, rcpts []string, message *smtpMessage) error {
+	if ctx.Err() != nil {
+		return &SendError{Driver: DriverSMTP, Stage: StageSend, Err: ctx.Err()}
+	}
+	from := msg.From.Address
+	if msg.ReturnPath != "" {
+		from = msg.ReturnPath
+	}
+	var reply string
+	err := msg.takeLimit(len(rcpts))
+	if err == nil {
+		reply, err = s.initiateSend(ctx, from, rcpts, message, s)
+	}
+	var partialErr *PartialFailureError
+	if errors.As(err, &partialErr) {
+		msg.results.record(addressesOf(partialErr.Sent), RecipientResult{Status: RecipientAccepted, Driver: DriverSMTP, Reply: reply})
+		for _, v := range partialErr.Failed {
+			msg.results.record(addressesOf([]string{v.Address}), RecipientResult{Status: RecipientRejected, Driver: DriverSMTP, Reply: v.Err.Body, Err: v.Err})
 		}
+		return err
+	}
+	if err != nil {
+		err = asSendError(DriverSMTP, StageSend, err)
+		var sendErr *SendError
+		errors.As(err, &sendErr)
+		msg.results.record(addressesOf(rcpts), RecipientResult{Status: RecipientRejected, Driver: DriverSMTP, Reply: sendErr.Body, Err: sendErr})
+		return err
 	}
-	s.resetDriverProps()
+	msg.results.record(addressesOf(rcpts), RecipientResult{Status: RecipientAccepted, Driver: DriverSMTP, Reply: reply})
 	return nil
 }
 
-func (s *smtpDriver) resetDriverProps() {
-	s.subject = ""
-	s.htmlBody = ""
-	s.plainTextBody = ""
+// prepare the message, the signature covers the whole message so it's built in memory with DKIM,
+// otherwise it's streamed to the server, the retries and the failover driver read the readers
+// into memory before, since they send the message more than once
+func (s *SMTPDriver) prepare(msg *Message) (*smtpMessage, error) {
+	if s.dkim == nil {
+		if err := checkHeaders(msg.Headers); err != nil {
+			return nil, err
+		}
+		return streamedSMTPMessage(msg)
+	}
+	message, err := buildMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	message, err = s.dkim.sign(message)
+	if err != nil {
+		return nil, err
+	}
+	return builtSMTPMessage(message), nil
+}
+
+func addressesOf(emailAddresses []string) []mail.Address {
+	var addresses []mail.Address
+	for _, v := range emailAddresses {
+		addresses = append(addresses, mail.Address{Address: v})
+	}
+	return addresses
 }
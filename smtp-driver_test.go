@@ -1,14 +1,28 @@
 package mailing
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"errors"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -25,46 +39,50 @@ func TestSMTPDriverSend(t *testing.T) {
 		},
 	})
 	tmpFilePath := filepath.Join(t.TempDir(), uuid.NewString())
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
+	var calls [][]string
+	sDriver.initiateSend = func(ctx context.Context, from string, rcpts []string, message *smtpMessage, d Driver) (string, error) {
+		calls = append(calls, rcpts)
 		file, err := os.Create(tmpFilePath)
 		if err != nil {
 			t.Error("faild test send")
 		}
-		file.Write(message)
+		message.writeTo(file)
 		file.Close()
-		return nil
+		return "", nil
 	}
 
-	sDriver.SetFrom(mail.Address{
-		Name:    "test from name",
-		Address: "from@mail.com",
-	})
-	sDriver.SetTo([]mail.Address{
-		{Name: "test from name1", Address: "from1@mail.com"},
-		{Name: "test from name2", Address: "from2@mail.com"},
-	})
-	sDriver.SetCC([]mail.Address{
-		{Name: "test cc name1", Address: "cc1@mail.com"},
-		{Name: "test cc name2", Address: "cc2@mail.com"},
-	})
-	sDriver.SetBCC([]mail.Address{
-		{Name: "test bcc name1", Address: "bcc1@mail.com"},
-		{Name: "test bcc name2", Address: "bcc2@mail.com"},
-	})
-	sDriver.SetSubject("this is the subject")
-	sDriver.SetPlainTextBody("this is plain text body")
-	sDriver.SetHTMLBody("this is html body")
-	sDriver.SetAttachments([]Attachment{
-		{
-			Name: "attachment name1",
-			Path: "./testingdata/attachment1.md",
+	msg := &Message{
+		From: mail.Address{
+			Name:    "test from name",
+			Address: "from@mail.com",
 		},
-		{
-			Name: "attachment name2",
-			Path: "./testingdata/attachment2.md",
+		To: []mail.Address{
+			{Name: "test from name1", Address: "from1@mail.com"},
+			{Name: "test from name2", Address: "from2@mail.com"},
 		},
-	})
-	err := sDriver.Send()
+		CC: []mail.Address{
+			{Name: "test cc name1", Address: "cc1@mail.com"},
+			{Name: "test cc name2", Address: "cc2@mail.com"},
+		},
+		BCC: []mail.Address{
+			{Name: "test bcc name1", Address: "bcc1@mail.com"},
+			{Name: "test bcc name2", Address: "bcc2@mail.com"},
+		},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name: "attachment name2",
+				Path: "./testingdata/attachment2.md",
+			},
+		},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
 	if err != nil {
 		t.Error("failed testing send")
 	}
@@ -74,13 +92,22 @@ func TestSMTPDriverSend(t *testing.T) {
 	os.Truncate(tmpFilePath, 0)
 	m := string(mBytes)
 
+	if len(calls) != 1 {
+		t.Fatal("Failed test send")
+	}
+	if strings.Join(calls[0], ",") != "from1@mail.com,from2@mail.com,cc1@mail.com,cc2@mail.com,bcc1@mail.com,bcc2@mail.com" {
+		t.Error("Failed test send")
+	}
+	if strings.Contains(m, "bcc1@mail.com") || strings.Contains(m, "Bcc:") {
+		t.Error("Failed test send")
+	}
 	if !strings.Contains(m, `From: "test from name" <from@mail.com>`) {
 		t.Error("Failed test send")
 	}
-	if !strings.Contains(m, `To: "test from name1" <from1@mail.com>;"test from name2" <from2@mail.com>`) {
+	if !strings.Contains(m, `To: "test from name1" <from1@mail.com>, "test from name2" <from2@mail.com>`) {
 		t.Error("Failed test send")
 	}
-	if !strings.Contains(m, `Cc: "test cc name1" <cc1@mail.com>;"test cc name2" <cc2@mail.com>`) {
+	if !strings.Contains(m, `Cc: "test cc name1" <cc1@mail.com>, "test cc name2" <cc2@mail.com>`) {
 		t.Error("Failed test send")
 	}
 	if !strings.Contains(m, `Subject: this is the subject`) {
@@ -105,9 +132,8 @@ func TestSMTPDriverSend(t *testing.T) {
 		t.Error("Failed test send")
 	}
 
-	sDriver.SetHTMLBody("")
-	sDriver.SetPlainTextBody("this is plain text body")
-	err = sDriver.Send()
+	msg.HTMLBody = ""
+	err = sDriver.SendMessage(context.Background(), msg)
 	if err != nil {
 		t.Error("failed testing send")
 	}
@@ -121,11 +147,588 @@ func TestSMTPDriverSend(t *testing.T) {
 		t.Error("Failed test send")
 	}
 
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		return errors.New("this is a test error")
+	sDriver.initiateSend = func(ctx context.Context, from string, rcpts []string, message *smtpMessage, d Driver) (string, error) {
+		return "", errors.New("this is a test error")
 	}
-	err = sDriver.Send()
+	err = sDriver.SendMessage(context.Background(), msg)
 	if err == nil {
 		t.Error("failed testing send")
 	}
 }
+
+func TestSMTPDriverSendContext(t *testing.T) {
+	// a server that accepts the connection but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	sDriver := initiateSMTP(&SMTPConfig{
+		Host: "127.0.0.1",
+		Port: addr.Port,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sDriver.SendMessage(ctx, &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("failed testing send context")
+	}
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Retryable() {
+		t.Error("failed testing send context")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("failed testing send context")
+	}
+
+	// a cancelled context stops the sending
+	var calls int
+	sDriver.initiateSend = func(ctx context.Context, from string, rcpts []string, message *smtpMessage, d Driver) (string, error) {
+		calls++
+		return "", nil
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = sDriver.SendMessage(ctx, &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+		BCC:  []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}},
+	})
+	if !errors.Is(err, context.Canceled) || calls != 0 {
+		t.Error("failed testing send context")
+	}
+}
+
+func TestSMTPDriverEncryption(t *testing.T) {
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+	}
+	cases := []struct {
+		encryption SMTPEncryption
+		serverTLS  bool // implicit tls on the server
+		startTLS   bool // the server advertises STARTTLS
+		sentTLS    bool
+		err        error
+	}{
+		{SMTPEncryptionImplicitTLS, true, false, true, nil},
+		{SMTPEncryptionNone, false, true, false, nil},
+		{SMTPEncryptionSTARTTLS, false, true, true, nil},
+		{SMTPEncryptionSTARTTLS, false, false, false, nil},
+		{SMTPEncryptionSTARTTLSRequired, false, true, true, nil},
+		{SMTPEncryptionSTARTTLSRequired, false, false, false, ErrSTARTTLSNotSupported},
+	}
+	for i, c := range cases {
+		server := newTestSMTPServer(t, func(s *testSMTPServer) {
+			s.implicitTLS = c.serverTLS
+			if c.startTLS {
+				s.extensions = append(s.extensions, "STARTTLS")
+			}
+		})
+		sDriver := initiateSMTP(server.config(c.encryption))
+		err := sDriver.SendMessage(context.Background(), msg)
+		if c.err != nil {
+			var sendErr *SendError
+			if !errors.Is(err, c.err) || !errors.As(err, &sendErr) || sendErr.Stage != StageTLS || len(server.sentMails()) != 0 {
+				t.Errorf("failed testing smtp encryption, case %d", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed testing smtp encryption, case %d: %v", i, err)
+			continue
+		}
+		mails := server.sentMails()
+		if len(mails) != 1 || mails[0].tls != c.sentTLS || strings.Join(mails[0].rcpts, ",") != "to@mail.com" {
+			t.Errorf("failed testing smtp encryption, case %d", i)
+		}
+	}
+}
+
+// testSMTPServer is a minimal smtp server that keeps the emails it receives
+type testSMTPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	extensions  []string
+	// the reply to a RCPT command, an empty reply accepts the recipient
+	rcptReply func(rcpt string) string
+	// the emails accepted on one connection before it's closed with a 421 reply, 0 for no limit
+	maxMails int
+
+	mu          sync.Mutex
+	mails       []testSMTPMail
+	commands    []string
+	connections int
+	// the mechanism and the decoded client responses of every authentication
+	auths []string
+}
+
+type testSMTPMail struct {
+	from  string
+	rcpts []string
+	data  string
+	tls   bool
+}
+
+func newTestSMTPServer(t *testing.T, configure func(s *testSMTPServer)) *testSMTPServer {
+	t.Helper()
+	s := &testSMTPServer{tlsConfig: testTLSConfig(t)}
+	if configure != nil {
+		configure(s)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.implicitTLS {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// the config of the smtp driver connecting to the server
+func (s *testSMTPServer) config(encryption SMTPEncryption) *SMTPConfig {
+	return &SMTPConfig{
+		Host:       "127.0.0.1",
+		Port:       s.listener.Addr().(*net.TCPAddr).Port,
+		TLSConfig:  tls.Config{InsecureSkipVerify: true},
+		Encryption: encryption,
+	}
+}
+
+func (s *testSMTPServer) sentMails() []testSMTPMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testSMTPMail(nil), s.mails...)
+}
+
+func (s *testSMTPServer) openedConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+func (s *testSMTPServer) receivedCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+	_, isTLS := conn.(*tls.Conn)
+	tp := textproto.NewConn(conn)
+	var current *testSMTPMail
+	var accepted int
+	tp.PrintfLine("220 localhost ESMTP test server")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			replies := []string{"localhost"}
+			for _, v := range s.extensions {
+				if v == "STARTTLS" && isTLS {
+					continue
+				}
+				replies = append(replies, v)
+			}
+			for i, v := range replies {
+				if i == len(replies)-1 {
+					tp.PrintfLine("250 %s", v)
+				} else {
+					tp.PrintfLine("250-%s", v)
+				}
+			}
+		case "HELO", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "STARTTLS":
+			tp.PrintfLine("220 2.0.0 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, isTLS, current = tlsConn, true, nil
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			if !s.authenticate(tp, arg) {
+				tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+				continue
+			}
+			tp.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			if s.maxMails > 0 && accepted >= s.maxMails {
+				tp.PrintfLine("421 4.7.0 Too many messages, closing connection")
+				return
+			}
+			current = &testSMTPMail{from: testSMTPPath(arg), tls: isTLS}
+			tp.PrintfLine("250 2.1.0 OK")
+		case "RCPT":
+			rcpt := testSMTPPath(arg)
+			if s.rcptReply != nil {
+				if reply := s.rcptReply(rcpt); reply != "" {
+					tp.PrintfLine("%s", reply)
+					continue
+				}
+			}
+			current.rcpts = append(current.rcpts, rcpt)
+			tp.PrintfLine("250 2.1.5 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.data = string(data)
+			s.mu.Lock()
+			s.mails = append(s.mails, *current)
+			s.mu.Unlock()
+			current = nil
+			accepted++
+			tp.PrintfLine("250 2.0.0 OK queued")
+		case "RSET":
+			current = nil
+			tp.PrintfLine("250 2.0.0 OK")
+		case "QUIT":
+			tp.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			tp.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+// run the authentication exchange, the credentials are recorded and always accepted
+func (s *testSMTPServer) authenticate(tp *textproto.Conn, arg string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var responses []string
+	decode := func(v string) string {
+		decoded, _ := base64.StdEncoding.DecodeString(v)
+		return string(decoded)
+	}
+	challenge := func(c string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(c)))
+		line, _ := tp.ReadLine()
+		return decode(line)
+	}
+	switch mechanism {
+	case "PLAIN", "XOAUTH2":
+		responses = append(responses, decode(initial))
+	case "LOGIN":
+		responses = append(responses, challenge("Username:"), challenge("Password:"))
+	case "CRAM-MD5":
+		responses = append(responses, challenge("<1896.697170952@127.0.0.1>"))
+	default:
+		return false
+	}
+	s.mu.Lock()
+	s.auths = append(s.auths, mechanism+" "+strings.Join(responses, " "))
+	s.mu.Unlock()
+	return true
+}
+
+func (s *testSMTPServer) receivedAuths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.auths...)
+}
+
+// the address of a MAIL FROM:<address> or RCPT TO:<address> command
+func testSMTPPath(arg string) string {
+	start := strings.Index(arg, "<")
+	end := strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
+
+// a tls config with a self signed certificate for 127.0.0.1
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSMTPDriverPartialFailure(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		server := newTestSMTPServer(t, func(s *testSMTPServer) {
+			if pipelining {
+				s.extensions = append(s.extensions, "PIPELINING")
+			}
+			s.rcptReply = func(rcpt string) string {
+				switch rcpt {
+				case "unknown@mail.com":
+					return "550 5.1.1 Recipient address rejected"
+				case "full@mail.com":
+					return "452 4.2.2 Mailbox full"
+				}
+				return ""
+			}
+		})
+		sDriver := initiateSMTP(server.config(SMTPEncryptionNone))
+		msg := &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            []mail.Address{{Address: "to@mail.com"}, {Address: "unknown@mail.com"}},
+			BCC:           []mail.Address{{Address: "bcc@mail.com"}, {Address: "full@mail.com"}},
+			PlainTextBody: "this is plain text body",
+		}
+		err := sDriver.SendMessage(context.Background(), msg)
+		var partialErr *PartialFailureError
+		if !errors.As(err, &partialErr) {
+			t.Fatalf("failed testing partial failure, pipelining %v", pipelining)
+		}
+		if strings.Join(partialErr.Sent, ",") != "to@mail.com,bcc@mail.com" || len(partialErr.Failed) != 2 {
+			t.Errorf("failed testing partial failure, pipelining %v", pipelining)
+		}
+		if partialErr.Failed[0].Address != "unknown@mail.com" || partialErr.Failed[0].Err.SMTPCode != 550 || partialErr.Failed[0].Err.EnhancedCode != "5.1.1" {
+			t.Errorf("failed testing partial failure, pipelining %v", pipelining)
+		}
+		if partialErr.Failed[1].Address != "full@mail.com" || !partialErr.Failed[1].Err.Temporary() {
+			t.Errorf("failed testing partial failure, pipelining %v", pipelining)
+		}
+		mails := server.sentMails()
+		if len(mails) != 1 || strings.Join(mails[0].rcpts, ",") != "to@mail.com,bcc@mail.com" {
+			t.Errorf("failed testing partial failure, pipelining %v", pipelining)
+		}
+
+		// when all the recipients are refused nothing is sent
+		msg.To, msg.BCC = []mail.Address{{Address: "unknown@mail.com"}}, nil
+		err = sDriver.SendMessage(context.Background(), msg)
+		if !errors.As(err, &partialErr) || len(partialErr.Sent) != 0 || len(partialErr.Failed) != 1 || len(server.sentMails()) != 1 {
+			t.Errorf("failed testing partial failure, pipelining %v", pipelining)
+		}
+	}
+}
+
+func TestSMTPDriverPartialFailureRetry(t *testing.T) {
+	// the mailbox is full on the first attempt only
+	var full sync.Once
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.rcptReply = func(rcpt string) string {
+			reply := ""
+			if rcpt == "full@mail.com" {
+				full.Do(func() { reply = "452 4.2.2 Mailbox full" })
+			}
+			return reply
+		}
+	})
+	mailer := NewMailerWithSMTP(server.config(SMTPEncryptionNone)).SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond})
+	err := mailer.SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		BCC:           []mail.Address{{Address: "full@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	})
+	if err != nil {
+		t.Fatal("failed testing partial failure retry", err)
+	}
+	// the retry is only sent to the refused recipient
+	mails := server.sentMails()
+	if len(mails) != 2 || strings.Join(mails[0].rcpts, ",") != "to@mail.com" || strings.Join(mails[1].rcpts, ",") != "full@mail.com" {
+		t.Error("failed testing partial failure retry")
+	}
+}
+
+func TestSMTPDriverMailParams(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		server := newTestSMTPServer(t, func(s *testSMTPServer) {
+			s.extensions = []string{"8BITMIME", "SMTPUTF8"}
+			if pipelining {
+				s.extensions = append(s.extensions, "PIPELINING")
+			}
+		})
+		sDriver := initiateSMTP(server.config(SMTPEncryptionNone))
+		// a 7bit message with ascii addresses needs no parameter
+		msg := &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            []mail.Address{{Address: "to@mail.com"}},
+			PlainTextBody: "مرحبا",
+		}
+		err := sDriver.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatal("failed testing smtp mail params", err)
+		}
+		// the non-ascii addresses are written in the headers, the message is 8bit
+		msg.To = []mail.Address{{Address: "用户@例子.广告"}}
+		err = sDriver.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatal("failed testing smtp mail params", err)
+		}
+		var mailCommands []string
+		for _, v := range server.receivedCommands() {
+			if strings.HasPrefix(v, "MAIL") {
+				mailCommands = append(mailCommands, v)
+			}
+		}
+		if strings.Join(mailCommands, ",") != "MAIL FROM:<from@mail.com>,MAIL FROM:<from@mail.com> BODY=8BITMIME SMTPUTF8" {
+			t.Errorf("failed testing smtp mail params, pipelining %v", pipelining)
+		}
+		mails := server.sentMails()
+		if len(mails) != 2 || mails[1].rcpts[0] != "用户@例子.广告" || !strings.Contains(mails[1].data, "To: <用户@例子.广告>") {
+			t.Errorf("failed testing smtp mail params, pipelining %v", pipelining)
+		}
+	}
+
+	// the sending fails before the envelope when the server can't take the message
+	server := newTestSMTPServer(t, func(s *testSMTPServer) { s.extensions = []string{"8BITMIME"} })
+	err := initiateSMTP(server.config(SMTPEncryptionNone)).SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "用户@例子.广告"}},
+		PlainTextBody: "this is plain text body",
+	})
+	var sendErr *SendError
+	if !errors.Is(err, ErrSMTPUTF8NotSupported) || !errors.As(err, &sendErr) || sendErr.Stage != StageMail || len(server.sentMails()) != 0 {
+		t.Error("failed testing smtp mail params")
+	}
+	server = newTestSMTPServer(t, nil)
+	err = initiateSMTP(server.config(SMTPEncryptionNone)).SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "用户@例子.广告"}},
+		PlainTextBody: "this is plain text body",
+	})
+	if !errors.Is(err, Err8BITMIMENotSupported) {
+		t.Error("failed testing smtp mail params")
+	}
+}
+
+func TestSMTPDriverReturnPath(t *testing.T) {
+	server := newTestSMTPServer(t, nil)
+	err := initiateSMTP(server.config(SMTPEncryptionNone)).SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		ReplyTo:       []mail.Address{{Address: "support@mail.com"}},
+		ReturnPath:    "bounces@mail.com",
+		PlainTextBody: "this is plain text body",
+	})
+	if err != nil {
+		t.Fatal("failed testing return path", err)
+	}
+	// the bounces go to the envelope sender, the headers keep the sender
+	mails := server.sentMails()
+	if len(mails) != 1 || mails[0].from != "bounces@mail.com" {
+		t.Fatal("failed testing return path")
+	}
+	if !strings.Contains(mails[0].data, "From: <from@mail.com>\n") || !strings.Contains(mails[0].data, "Reply-To: <support@mail.com>\n") || strings.Contains(mails[0].data, "Return-Path") {
+		t.Error("failed testing return path")
+	}
+}
+
+// a reader of size bytes of content, it calls read before its first read and fails with err at the end
+type streamedReader struct {
+	size  int
+	read  func()
+	err   error
+	begun bool
+}
+
+func (r *streamedReader) Read(p []byte) (int, error) {
+	if !r.begun {
+		r.begun = true
+		r.read()
+	}
+	if r.size == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > r.size {
+		n = r.size
+	}
+	for i := range p[:n] {
+		p[i] = 'a'
+	}
+	r.size -= n
+	return n, nil
+}
+
+func TestSMTPDriverStreaming(t *testing.T) {
+	server := newTestSMTPServer(t, nil)
+	sDriver := initiateSMTP(server.config(SMTPEncryptionNone))
+	var dataSent bool
+	reader := &streamedReader{size: 1 << 20, read: func() {
+		commands := server.receivedCommands()
+		dataSent = len(commands) > 0 && commands[len(commands)-1] == "DATA"
+	}}
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		PlainTextBody: "this is plain text body",
+		Attachments:   []Attachment{{Name: "large.txt", Reader: reader}},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing smtp streaming", err)
+	}
+	// the reader is read once the server waits for the message
+	if !dataSent {
+		t.Error("failed testing smtp streaming")
+	}
+	mails := server.sentMails()
+	if len(mails) != 1 || !strings.Contains(mails[0].data, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), 57))) {
+		t.Fatal("failed testing smtp streaming")
+	}
+
+	// a reader failing in the middle of the message drops the message
+	msg.Attachments = []Attachment{{Name: "broken.txt", Reader: &streamedReader{size: 1 << 16, read: func() {}, err: errors.New("this is a test error")}}}
+	err = sDriver.SendMessage(context.Background(), msg)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageBuild || len(server.sentMails()) != 1 {
+		t.Error("failed testing smtp streaming", err)
+	}
+}
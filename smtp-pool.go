@@ -0,0 +1,356 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSMTPIdleTimeout = 30 * time.Second
+
+// smtpConn is an open and authenticated connection to the smtp server
+type smtpConn struct {
+	conn       net.Conn
+	client     *smtp.Client
+	pipelining bool // the server advertises PIPELINING
+	eightBit   bool // the server advertises 8BITMIME
+	smtpUTF8   bool // the server advertises SMTPUTF8
+	usedAt     time.Time
+}
+
+// dial the server, secure the connection and authenticate as the config asks
+func openSMTPConn(ctx context.Context, conf *SMTPConfig) (*smtpConn, error) {
+	conn, err := smtpDial(ctx, conf)
+	if err != nil {
+		return nil, smtpFail(ctx, StageDial, err)
+	}
+	stopWatching := watchConnContext(ctx, conn)
+	defer stopWatching()
+	client, err := smtp.NewClient(conn, conf.Host)
+	if err != nil {
+		conn.Close()
+		return nil, smtpFail(ctx, StageDial, err)
+	}
+	c := &smtpConn{conn: conn, client: client, usedAt: time.Now()}
+	err = smtpStartTLS(client, conf)
+	if err != nil {
+		conn.Close()
+		return nil, smtpFail(ctx, StageTLS, err)
+	}
+	auth, err := smtpAuth(ctx, client, conf)
+	if err != nil {
+		conn.Close()
+		return nil, smtpFail(ctx, StageAuth, err)
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			conn.Close()
+			return nil, smtpFail(ctx, StageAuth, err)
+		}
+	}
+	c.pipelining, _ = client.Extension("PIPELINING")
+	c.eightBit, _ = client.Extension("8BITMIME")
+	c.smtpUTF8, _ = client.Extension("SMTPUTF8")
+	return c, nil
+}
+
+// the parameters of the MAIL command, BODY=8BITMIME when the message isn't 7bit and
+// SMTPUTF8 when an address isn't ascii, the sending fails when the server supports neither
+func (c *smtpConn) mailParams(from string, rcpts []string, message *smtpMessage) (string, error) {
+	var params string
+	if message.eightBit {
+		if !c.eightBit {
+			return "", Err8BITMIMENotSupported
+		}
+		params += " BODY=8BITMIME"
+	}
+	utf8Addresses := !isASCII(from)
+	for _, v := range rcpts {
+		utf8Addresses = utf8Addresses || !isASCII(v)
+	}
+	if utf8Addresses {
+		if !c.smtpUTF8 {
+			return "", ErrSMTPUTF8NotSupported
+		}
+		params += " SMTPUTF8"
+	}
+	return params, nil
+}
+
+// send one email over the connection and return the server's reply to it, the email is
+// still sent when some of the recipients are refused and a *PartialFailureError reports them
+func (c *smtpConn) send(ctx context.Context, from string, rcpts []string, message *smtpMessage) (string, error) {
+	stopWatching := watchConnContext(ctx, c.conn)
+	defer stopWatching()
+	c.usedAt = time.Now()
+	for _, v := range append([]string{from}, rcpts...) {
+		if strings.ContainsAny(v, "\r\n") {
+			return "", smtpFail(ctx, StageMail, errors.New("smtp: A line must not contain CR or LF"))
+		}
+	}
+	params, err := c.mailParams(from, rcpts, message)
+	if err != nil {
+		return "", smtpFail(ctx, StageMail, err)
+	}
+	var replies []error
+	if c.pipelining {
+		replies, err = c.pipelineEnvelope(ctx, from, params, rcpts)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		err = c.client.Text.PrintfLine("MAIL FROM:<%s>%s", from, params)
+		if err == nil {
+			_, _, err = c.client.Text.ReadResponse(250)
+		}
+		if err != nil {
+			return "", smtpFail(ctx, StageMail, err)
+		}
+		for _, emailAddress := range rcpts {
+			replies = append(replies, c.client.Rcpt(emailAddress))
+		}
+	}
+	var accepted []string
+	var refused []RecipientError
+	for i, v := range replies {
+		if v == nil {
+			accepted = append(accepted, rcpts[i])
+			continue
+		}
+		// only a refusal of the recipient lets the transaction go on
+		var tpErr *textproto.Error
+		if !errors.As(v, &tpErr) || tpErr.Code == 421 || ctx.Err() != nil {
+			return "", smtpFail(ctx, StageRcpt, v)
+		}
+		refused = append(refused, RecipientError{Address: rcpts[i], Err: newSMTPError(StageRcpt, v)})
+	}
+	if len(accepted) == 0 {
+		return "", &PartialFailureError{Failed: refused}
+	}
+	reply, err := c.data(ctx, message)
+	if err != nil {
+		return "", err
+	}
+	if len(refused) > 0 {
+		return reply, &PartialFailureError{Sent: accepted, Failed: refused}
+	}
+	return reply, nil
+}
+
+// send the DATA command and the message, smtp.Client.Data is not used as it drops the server's reply
+func (c *smtpConn) data(ctx context.Context, message *smtpMessage) (string, error) {
+	text := c.client.Text
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return "", smtpFail(ctx, StageData, err)
+	}
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(354)
+	text.EndResponse(id)
+	if err != nil {
+		return "", smtpFail(ctx, StageData, err)
+	}
+	writer := text.DotWriter()
+	conn := &errWriter{w: writer}
+	err = message.writeTo(conn)
+	if conn.err != nil {
+		return "", smtpFail(ctx, StageData, conn.err)
+	}
+	if err != nil {
+		// an attachment couldn't be read, the connection is closed before the final dot so the server drops the message
+		c.conn.Close()
+		return "", &SendError{Stage: StageBuild, Err: err}
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", smtpFail(ctx, StageData, err)
+	}
+	code, reply, err := text.ReadResponse(250)
+	if err != nil {
+		return "", smtpFail(ctx, StageData, err)
+	}
+	return fmt.Sprintf("%d %s", code, reply), nil
+}
+
+// send the MAIL and all the RCPT commands at once then read their replies, the replies
+// are all read even after a failure so the connection stays in sync with the server,
+// the reply of every RCPT is returned in order
+func (c *smtpConn) pipelineEnvelope(ctx context.Context, from string, params string, rcpts []string) ([]error, error) {
+	text := c.client.Text
+	fmt.Fprintf(text.W, "MAIL FROM:<%s>%s\r\n", from, params)
+	for _, v := range rcpts {
+		fmt.Fprintf(text.W, "RCPT TO:<%s>\r\n", v)
+	}
+	err := text.W.Flush()
+	if err != nil {
+		return nil, smtpFail(ctx, StageMail, err)
+	}
+	_, _, mailErr := text.ReadResponse(250)
+	var replies []error
+	for range rcpts {
+		_, _, err = text.ReadResponse(25)
+		replies = append(replies, err)
+	}
+	if mailErr != nil {
+		return nil, smtpFail(ctx, StageMail, mailErr)
+	}
+	return replies, nil
+}
+
+// start a new transaction on the connection
+func (c *smtpConn) reset(ctx context.Context) error {
+	stopWatching := watchConnContext(ctx, c.conn)
+	defer stopWatching()
+	return c.client.Reset()
+}
+
+// say goodbye to the server and close the connection
+func (c *smtpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.client.Quit()
+	c.conn.Close()
+}
+
+// smtpPool keeps the connections to the smtp server open between the emails
+type smtpPool struct {
+	config      *SMTPConfig
+	idleTimeout time.Duration
+	slots       chan struct{} // limits the connections in use to the pool size
+
+	mu     sync.Mutex
+	idle   []*smtpConn
+	timer  *time.Timer
+	closed bool
+}
+
+func newSMTPPool(config *SMTPConfig) *smtpPool {
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSMTPIdleTimeout
+	}
+	return &smtpPool{
+		config:      config,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, config.PoolSize),
+	}
+}
+
+// send the email over a pooled connection, when the server closes the connection
+// with a 421 reply the email is sent again over a new connection
+func (p *smtpPool) send(ctx context.Context, from string, rcpts []string, message *smtpMessage) (string, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return "", &SendError{Driver: DriverSMTP, Stage: StageDial, Err: ctx.Err()}
+	}
+	defer func() { <-p.slots }()
+	for attempt := 1; ; attempt++ {
+		c, err := p.get(ctx)
+		if err != nil {
+			return "", err
+		}
+		reply, err := c.send(ctx, from, rcpts, message)
+		if err == nil {
+			p.put(c)
+			return reply, nil
+		}
+		var tpErr *textproto.Error
+		isReply := errors.As(err, &tpErr) && ctx.Err() == nil
+		if isReply && tpErr.Code == 421 && attempt == 1 && message.canWrite() {
+			c.close()
+			continue
+		}
+		// the server refused the email but the connection can still be used
+		if isReply && tpErr.Code != 421 && c.reset(ctx) == nil {
+			p.put(c)
+		} else {
+			c.conn.Close()
+		}
+		return reply, err
+	}
+}
+
+// an idle connection ready for a new email, or a new connection when there is none
+func (p *smtpPool) get(ctx context.Context) (*smtpConn, error) {
+	for {
+		p.mu.Lock()
+		var c *smtpConn
+		if n := len(p.idle); n > 0 {
+			c = p.idle[n-1]
+			p.idle = p.idle[:n-1]
+		}
+		p.mu.Unlock()
+		if c == nil {
+			return openSMTPConn(ctx, p.config)
+		}
+		if time.Since(c.usedAt) < p.idleTimeout && c.reset(ctx) == nil {
+			return c, nil
+		}
+		// expired, or closed by the server
+		c.conn.Close()
+	}
+}
+
+// keep the connection for the next emails
+func (p *smtpPool) put(c *smtpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		go c.close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.idleTimeout, p.closeExpired)
+	}
+}
+
+// close the connections that were idle for longer than the idle timeout
+func (p *smtpPool) closeExpired() {
+	p.mu.Lock()
+	var expired, active []*smtpConn
+	for _, v := range p.idle {
+		if time.Since(v.usedAt) >= p.idleTimeout {
+			expired = append(expired, v)
+		} else {
+			active = append(active, v)
+		}
+	}
+	p.idle = active
+	p.timer = nil
+	if len(active) > 0 && !p.closed {
+		// the connections are sorted by the last use, the first one expires first
+		p.timer = time.AfterFunc(p.idleTimeout-time.Since(active[0].usedAt), p.closeExpired)
+	}
+	p.mu.Unlock()
+	for _, v := range expired {
+		v.close()
+	}
+}
+
+// close the idle connections, the connections in use are closed once their email is sent
+func (p *smtpPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+	for _, v := range idle {
+		v.close()
+	}
+}
@@ -0,0 +1,158 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSMTPPool(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		server := newTestSMTPServer(t, func(s *testSMTPServer) {
+			if pipelining {
+				s.extensions = append(s.extensions, "PIPELINING")
+			}
+			s.rcptReply = func(rcpt string) string {
+				if strings.HasPrefix(rcpt, "rejected") {
+					return "550 5.1.1 Recipient address rejected"
+				}
+				return ""
+			}
+		})
+		config := server.config(SMTPEncryptionNone)
+		config.PoolSize = 2
+		sDriver := initiateSMTP(config)
+		msg := &Message{
+			From:          mail.Address{Address: "from@mail.com"},
+			To:            []mail.Address{{Address: "to1@mail.com"}, {Address: "to2@mail.com"}},
+			BCC:           []mail.Address{{Address: "bcc1@mail.com"}, {Address: "bcc2@mail.com"}},
+			PlainTextBody: "this is plain text body",
+		}
+		for i := 0; i < 3; i++ {
+			err := sDriver.SendMessage(context.Background(), msg)
+			if err != nil {
+				t.Fatal("failed testing smtp pool", err)
+			}
+		}
+		// a single connection is reused for all the emails, with RSET between them
+		mails := server.sentMails()
+		if len(mails) != 3 || server.openedConnections() != 1 || strings.Join(mails[0].rcpts, ",") != "to1@mail.com,to2@mail.com,bcc1@mail.com,bcc2@mail.com" {
+			t.Errorf("failed testing smtp pool, pipelining %v", pipelining)
+		}
+		var resets int
+		for _, v := range server.receivedCommands() {
+			if v == "RSET" {
+				resets++
+			}
+		}
+		if resets != 2 {
+			t.Errorf("failed testing smtp pool, pipelining %v", pipelining)
+		}
+
+		// a refused recipient is reported and the connection stays usable
+		err := sDriver.SendMessage(context.Background(), &Message{
+			From: mail.Address{Address: "from@mail.com"},
+			To:   []mail.Address{{Address: "rejected@mail.com"}},
+		})
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) || sendErr.Stage != StageRcpt || sendErr.SMTPCode != 550 {
+			t.Errorf("failed testing smtp pool, pipelining %v", pipelining)
+		}
+		err = sDriver.SendMessage(context.Background(), msg)
+		if err != nil || len(server.sentMails()) != 4 || server.openedConnections() != 1 {
+			t.Errorf("failed testing smtp pool, pipelining %v", pipelining)
+		}
+		sDriver.Close()
+		time.Sleep(50 * time.Millisecond)
+		commands := server.receivedCommands()
+		if commands[len(commands)-1] != "QUIT" {
+			t.Errorf("failed testing smtp pool, pipelining %v", pipelining)
+		}
+	}
+}
+
+func TestSMTPPoolReconnect(t *testing.T) {
+	// the server closes the connection with a 421 reply after two emails
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.maxMails = 2
+	})
+	config := server.config(SMTPEncryptionNone)
+	config.PoolSize = 1
+	sDriver := initiateSMTP(config)
+	defer sDriver.Close()
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	}
+	for i := 0; i < 5; i++ {
+		err := sDriver.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatal("failed testing smtp pool reconnect", err)
+		}
+	}
+	if len(server.sentMails()) != 5 || server.openedConnections() != 3 {
+		t.Error("failed testing smtp pool reconnect")
+	}
+}
+
+func TestSMTPPoolIdleTimeout(t *testing.T) {
+	server := newTestSMTPServer(t, nil)
+	config := server.config(SMTPEncryptionNone)
+	config.PoolSize = 1
+	config.IdleTimeout = 50 * time.Millisecond
+	sDriver := initiateSMTP(config)
+	defer sDriver.Close()
+	msg := &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		PlainTextBody: "this is plain text body",
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatal("failed testing smtp pool idle timeout", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// the idle connection was closed
+	commands := server.receivedCommands()
+	if commands[len(commands)-1] != "QUIT" {
+		t.Error("failed testing smtp pool idle timeout")
+	}
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err != nil || server.openedConnections() != 2 {
+		t.Error("failed testing smtp pool idle timeout")
+	}
+}
+
+func TestSMTPPoolConcurrency(t *testing.T) {
+	server := newTestSMTPServer(t, func(s *testSMTPServer) {
+		s.extensions = append(s.extensions, "PIPELINING")
+	})
+	config := server.config(SMTPEncryptionNone)
+	config.PoolSize = 3
+	mailer := NewMailerWithSMTP(config)
+	defer mailer.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mailer.SendMessage(context.Background(), &Message{
+				From:          mail.Address{Address: "from@mail.com"},
+				To:            []mail.Address{{Address: "to@mail.com"}},
+				PlainTextBody: "this is plain text body",
+			})
+			if err != nil {
+				t.Error("failed testing smtp pool concurrency", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(server.sentMails()) != 30 || server.openedConnections() > 3 {
+		t.Error("failed testing smtp pool concurrency")
+	}
+}
@@ -5,10 +5,12 @@
 package mailing
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"encoding/base64"
+	"net/http"
 	"net/mail"
 	"strings"
+	"time"
 
 	"github.com/SparkPost/gosparkpost"
 )
@@ -20,157 +22,209 @@ type SparkPostConfig struct {
 }
 
 type SparkPostDriver struct {
-	config         *SparkPostConfig
-	messageBuilder *messageBuilder
-	from           mail.Address
-	toList         []mail.Address
-	ccList         []mail.Address
-	bccList        []mail.Address
-	subject        string
-	htmlBody       string
-	plainTextBody  string
-	attachments    []Attachment
-	initiateSend   func(from string, rcpts []string, message []byte, conf Driver) error
+	config       *SparkPostConfig
+	httpClient   *http.Client // optional, defaults to http.DefaultClient
+	initiateSend func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error)
 }
 
-var initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
+var initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
 	spDriv := d.(*SparkPostDriver)
-	conf := spDriv.config
-	cfg := &gosparkpost.Config{
-		BaseUrl:    conf.BaseUrl,
-		ApiKey:     conf.ApiKey,
-		ApiVersion: conf.ApiVersion,
+	client, err := spDriv.client()
+	if err != nil {
+		return "", err
 	}
-	var client gosparkpost.Client
-	err := client.Init(cfg)
+	content, err := newSparkPostContent(msg)
 	if err != nil {
-		return errors.New(fmt.Sprintf("SparkPost client init failed: %s\n", err))
+		return "", err
+	}
+	var recipients []string
+	for _, v := range rcpts {
+		recipients = append(recipients, v.String())
+	}
+	// Create transmission
+	tx := &gosparkpost.Transmission{
+		Recipients: recipients,
+		Content:    content,
+		ReturnPath: msg.ReturnPath,
+	}
+	if msg.schedule != nil {
+		startTime := gosparkpost.RFC3339(msg.schedule.at)
+		tx.Options = &gosparkpost.TxOptions{StartTime: &startTime}
 	}
+	return spDriv.transmit(ctx, client, tx)
+}
 
+// the content of the transmissions of the message
+func newSparkPostContent(msg *Message) (gosparkpost.Content, error) {
 	// create the content
 	content := gosparkpost.Content{
-		From:    from,
-		Subject: spDriv.subject,
+		From:    msg.From.String(),
+		Subject: msg.Subject,
 	}
-	// the body
-	if spDriv.htmlBody != "" {
-		content.HTML = spDriv.htmlBody
-	} else {
-		content.Text = spDriv.plainTextBody
+	if len(msg.ReplyTo) > 0 {
+		content.ReplyTo = formatAddressList(msg.ReplyTo)
+	}
+	// the body, both versions are sent when set
+	content.HTML = msg.HTMLBody
+	content.Text = msg.PlainTextBody
+	// attachments and inline images, sparkpost references inline images by their name
+	for _, v := range msg.Attachments {
+		fileContent, err := v.readAll()
+		if err != nil {
+			return gosparkpost.Content{}, &SendError{Driver: DriverSparkPost, Stage: StageBuild, Err: err}
+		}
+		if v.ContentID != "" {
+			content.InlineImages = append(content.InlineImages, gosparkpost.InlineImage{
+				MIMEType: v.detectContentType(fileContent),
+				Filename: v.ContentID,
+				B64Data:  base64.StdEncoding.EncodeToString(fileContent),
+			})
+		} else {
+			content.Attachments = append(content.Attachments, gosparkpost.Attachment{
+				MIMEType: v.detectContentType(fileContent),
+				Filename: v.Name,
+				B64Data:  base64.StdEncoding.EncodeToString(fileContent),
+			})
+		}
 	}
 	// headers
-	var headers map[string]string
-	// from
-	headers["From"] = spDriv.from.String()
+	headers := map[string]string{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
 	// the cc
-	if len(spDriv.messageBuilder.ccList) > 0 {
-		headers["Cc"] = strings.Join(spDriv.messageBuilder.ccList, ",")
+	if len(msg.CC) > 0 {
+		var ccList []string
+		for _, v := range msg.CC {
+			ccList = append(ccList, v.String())
+		}
+		headers["Cc"] = strings.Join(ccList, ",")
 	}
 	// add the headers
 	if len(headers) > 0 {
 		content.Headers = headers
 	}
-	// Create transmission
-	tx := &gosparkpost.Transmission{
-		Recipients: rcpts,
-		Content:    content,
-	}
-	_, _, err = client.Send(tx)
+	return content, nil
+}
+
+// send the transmission and return its id
+func (s *SparkPostDriver) transmit(ctx context.Context, client *gosparkpost.Client, tx *gosparkpost.Transmission) (string, error) {
+	id, res, err := client.SendContext(ctx, tx)
 	if err != nil {
-		return err
+		if res != nil && res.HTTP != nil && !gosparkpost.Is2XX(res.HTTP.StatusCode) {
+			sendErr := newHTTPError(DriverSparkPost, res.HTTP.StatusCode, string(res.Body), err)
+			sendErr.RetryAfter = parseRetryAfter(res.HTTP.Header.Get("Retry-After"), time.Now())
+			return "", sendErr
+		}
+		return "", &SendError{Driver: DriverSparkPost, Stage: StageHTTP, Err: err}
 	}
 
-	return nil
+	return id, nil
 }
 
 func initiateSparkPost(config *SparkPostConfig) *SparkPostDriver {
 	s := &SparkPostDriver{
-		config:         config,
-		messageBuilder: newMessageBuilder(),
-		htmlBody:       "",
-		plainTextBody:  "",
-		initiateSend:   initiateSend,
+		config:       config,
+		initiateSend: initiateSend,
 	}
 
 	return s
 }
 
-func (s *SparkPostDriver) SetFrom(from mail.Address) error {
-	s.from = from
-	return nil
+// Name of the driver as reported in the errors
+func (s *SparkPostDriver) Name() string {
+	return DriverSparkPost
 }
 
-func (s *SparkPostDriver) SetTo(toList []mail.Address) error {
-	s.toList = toList
-	return nil
+func (s *SparkPostDriver) SendMessage(ctx context.Context, msg *Message) error {
+	// the message is sent once for "to" and "cc" and once for every bcc
+	msg, err := msg.bufferAttachments()
+	if err != nil {
+		return &SendError{Driver: DriverSparkPost, Stage: StageBuild, Err: err}
+	}
+	return sendPerBCC(ctx, DriverSparkPost, msg, func(rcpts []mail.Address) (string, error) {
+		return s.initiateSend(ctx, msg, rcpts, s)
+	})
 }
 
-func (s *SparkPostDriver) SetCC(ccList []mail.Address) error {
-	s.ccList = ccList
-	return nil
-}
-func (s *SparkPostDriver) SetBCC(bccList []mail.Address) error {
-	s.bccList = bccList
-	return nil
-}
-func (s *SparkPostDriver) SetSubject(Subject string) error {
-	s.subject = Subject
-	return nil
-}
-func (s *SparkPostDriver) SetHTMLBody(body string) error {
-	s.htmlBody = body
-	return nil
+// the api client of the driver's configuration
+func (s *SparkPostDriver) client() (*gosparkpost.Client, error) {
+	conf := s.config
+	cfg := &gosparkpost.Config{
+		BaseUrl:    conf.BaseUrl,
+		ApiKey:     conf.ApiKey,
+		ApiVersion: conf.ApiVersion,
+	}
+	client := &gosparkpost.Client{Client: s.httpClient}
+	err := client.Init(cfg)
+	if err != nil {
+		return nil, &SendError{Driver: DriverSparkPost, Stage: StageSend, Err: err}
+	}
+	return client, nil
 }
-func (s *SparkPostDriver) SetPlainTextBody(body string) error {
-	s.plainTextBody = body
-	return nil
+
+// sparkpost holds the transmissions up to 31 days
+func (s *SparkPostDriver) maxScheduleDelay() time.Duration {
+	return 31 * 24 * time.Hour
 }
-func (s *SparkPostDriver) SetAttachments(attachments []Attachment) error {
-	s.attachments = attachments
-	return nil
+
+// the transmissions are sent with the start_time option
+func (s *SparkPostDriver) schedule(ctx context.Context, msg *Message, at time.Time) (*Message, error) {
+	msg = msg.Clone()
+	msg.schedule = &messageSchedule{at: at}
+	return msg, nil
 }
 
-func (s *SparkPostDriver) Send() error {
-	// prepare the message
-	s.messageBuilder.setSubject(s.subject)
-	if s.htmlBody != "" {
-		s.messageBuilder.setHTMLBody(s.htmlBody)
-	} else {
-		s.messageBuilder.setPlainTextBody(s.plainTextBody)
-	}
-	s.messageBuilder.setFrom(s.from)
-	s.messageBuilder.setToList(s.toList)
-	s.messageBuilder.setCCList(s.ccList)
-	s.messageBuilder.setAttachments(s.attachments)
-	message := s.messageBuilder.build()
-
-	// "to" and "cc" message sending
-	var rcpts []string
-	for _, v := range s.toList {
-		rcpts = append(rcpts, v.String())
-	}
-	for _, v := range s.ccList {
-		rcpts = append(rcpts, v.String())
-	}
-	from := s.from.String()
-	err := s.initiateSend(from, rcpts, message, s)
+// delete the scheduled transmissions of the message
+func (s *SparkPostDriver) cancelSchedule(ctx context.Context, msg *Message, result *SendResult) error {
+	client, err := s.client()
 	if err != nil {
-		return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+		return err
 	}
-
-	// send to bcc
-	for _, v := range s.bccList {
-		err = s.initiateSend(from, []string{v.String()}, message, s)
+	deleted := make(map[string]bool)
+	for _, v := range result.Accepted() {
+		if v.MessageID == "" || deleted[v.MessageID] {
+			continue
+		}
+		res, err := client.TransmissionDeleteContext(ctx, &gosparkpost.Transmission{ID: v.MessageID})
 		if err != nil {
-			return errors.New(fmt.Sprintf("error calling s.initiateSend(): %v", err.Error()))
+			if res != nil && res.HTTP != nil && !gosparkpost.Is2XX(res.HTTP.StatusCode) {
+				return newHTTPError(DriverSparkPost, res.HTTP.StatusCode, string(res.Body), err)
+			}
+			return &SendError{Driver: DriverSparkPost, Stage: StageHTTP, Err: err}
 		}
+		deleted[v.MessageID] = true
 	}
-	s.resetDriverProps()
 	return nil
 }
 
-func (s *SparkPostDriver) resetDriverProps() {
-	s.subject = ""
-	s.htmlBody = ""
-	s.plainTextBody = ""
+// sparkpost takes many more recipients per transmission, they are sent 1000 at a time to keep the requests small
+func (s *SparkPostDriver) maxBatchSize() int {
+	return 1000
+}
+
+// send a transmission with the substitution data of every recipient, the placeholders are
+// written {{name}} so sparkpost escapes the values in the html body, like the other drivers
+func (s *SparkPostDriver) sendBatch(ctx context.Context, msg *Message, recipients []Recipient) (string, error) {
+	client, err := s.client()
+	if err != nil {
+		return "", err
+	}
+	msg, names := rewritePlaceholders(msg, func(name string, html bool) string { return "{{" + name + "}}" })
+	content, err := newSparkPostContent(msg)
+	if err != nil {
+		return "", err
+	}
+	var txRecipients []gosparkpost.Recipient
+	for _, v := range recipients {
+		txRecipients = append(txRecipients, gosparkpost.Recipient{
+			Address:          gosparkpost.Address{Email: v.Address.Address, Name: v.Address.Name},
+			SubstitutionData: placeholderValues(names, v),
+		})
+	}
+	return s.transmit(ctx, client, &gosparkpost.Transmission{
+		Recipients: txRecipients,
+		Content:    content,
+		ReturnPath: msg.ReturnPath,
+	})
 }
@@ -1,15 +1,14 @@
 package mailing
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
-	"os"
-	"path/filepath"
-	"strings"
 	"testing"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 func TestSparkPostDriverSend(t *testing.T) {
@@ -18,108 +17,161 @@ func TestSparkPostDriverSend(t *testing.T) {
 		ApiKey:     "test-api-key",
 		ApiVersion: 1,
 	})
-	tmpFilePath := filepath.Join(t.TempDir(), uuid.NewString())
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		file, err := os.Create(tmpFilePath)
-		if err != nil {
-			t.Error("faild test send")
-		}
-		file.Write(message)
-		file.Close()
-		return nil
+	var sentMessages []*Message
+	var sentRcpts [][]mail.Address
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		sentMessages = append(sentMessages, msg)
+		sentRcpts = append(sentRcpts, rcpts)
+		return "", nil
 	}
 
-	sDriver.SetFrom(mail.Address{
-		Name:    "test from name",
-		Address: "from@mail.com",
-	})
-	sDriver.SetTo([]mail.Address{
-		{Name: "test from name1", Address: "from1@mail.com"},
-		{Name: "test from name2", Address: "from2@mail.com"},
-	})
-	sDriver.SetCC([]mail.Address{
-		{Name: "test cc name1", Address: "cc1@mail.com"},
-		{Name: "test cc name2", Address: "cc2@mail.com"},
-	})
-	sDriver.SetBCC([]mail.Address{
-		{Name: "test bcc name1", Address: "bcc1@mail.com"},
-		{Name: "test bcc name2", Address: "bcc2@mail.com"},
-	})
-	sDriver.SetSubject("this is the subject")
-	sDriver.SetPlainTextBody("this is plain text body")
-	sDriver.SetHTMLBody("this is html body")
-	sDriver.SetAttachments([]Attachment{
-		{
-			Name: "attachment name1",
-			Path: "./testingdata/attachment1.md",
+	msg := &Message{
+		From: mail.Address{
+			Name:    "test from name",
+			Address: "from@mail.com",
 		},
-		{
-			Name: "attachment name2",
-			Path: "./testingdata/attachment2.md",
+		To: []mail.Address{
+			{Name: "test from name1", Address: "from1@mail.com"},
+			{Name: "test from name2", Address: "from2@mail.com"},
 		},
-	})
-	err := sDriver.Send()
+		CC: []mail.Address{
+			{Name: "test cc name1", Address: "cc1@mail.com"},
+			{Name: "test cc name2", Address: "cc2@mail.com"},
+		},
+		BCC: []mail.Address{
+			{Name: "test bcc name1", Address: "bcc1@mail.com"},
+			{Name: "test bcc name2", Address: "bcc2@mail.com"},
+		},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      "this is html body",
+		Attachments: []Attachment{
+			{
+				Name: "attachment name1",
+				Path: "./testingdata/attachment1.md",
+			},
+			{
+				Name: "attachment name2",
+				Path: "./testingdata/attachment2.md",
+			},
+		},
+	}
+	err := sDriver.SendMessage(context.Background(), msg)
 	if err != nil {
 		t.Error("failed testing send")
 	}
-	file, _ := os.Open(tmpFilePath)
-	mBytes, _ := ioutil.ReadAll(file)
-	file.Close()
-	os.Truncate(tmpFilePath, 0)
-	m := string(mBytes)
-
-	if !strings.Contains(m, `From: "test from name" <from@mail.com>`) {
-		t.Error("Failed test send")
-	}
-	if !strings.Contains(m, `To: "test from name1" <from1@mail.com>;"test from name2" <from2@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts) != 3 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `Cc: "test cc name1" <cc1@mail.com>;"test cc name2" <cc2@mail.com>`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[0]) != 4 || sentRcpts[0][0].Address != "from1@mail.com" || sentRcpts[0][3].Address != "cc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Subject: this is the subject`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[1]) != 1 || sentRcpts[1][0].Address != "bcc1@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Type: text/html; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	if len(sentRcpts[2]) != 1 || sentRcpts[2][0].Address != "bcc2@mail.com" {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `this is html body`) {
-		t.Error("Failed test send")
+	for _, v := range sentMessages {
+		if v != msg {
+			t.Error("failed testing send")
+		}
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name1"`) {
-		t.Error("Failed test send")
+
+	sDriver.initiateSend = func(ctx context.Context, msg *Message, rcpts []mail.Address, d Driver) (string, error) {
+		return "", errors.New("this is a test error")
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAx`) {
-		t.Error("Failed test send")
+	err = sDriver.SendMessage(context.Background(), msg)
+	if err == nil {
+		t.Error("failed testing send")
 	}
-	if !strings.Contains(m, `Content-Disposition: attachment; filename="attachment name2"`) {
-		t.Error("Failed test send")
+}
+
+func TestSparkPostDriverSendContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	sDriver := initiateSparkPost(&SparkPostConfig{
+		BaseUrl:    server.URL,
+		ApiKey:     "test-api-key",
+		ApiVersion: 1,
+	})
+	sDriver.httpClient = server.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := sDriver.SendMessage(ctx, &Message{
+		From: mail.Address{Address: "from@mail.com"},
+		To:   []mail.Address{{Address: "to@mail.com"}},
+	})
+	if err == nil {
+		t.Error("failed testing send context")
 	}
-	if !strings.Contains(m, `dGhpcyBpcyBhIHRlc3QgZmlsZSBmb3IgZW1haWwgYXR0YWNobWVudCAy`) {
-		t.Error("Failed test send")
+	if time.Since(start) > 2*time.Second {
+		t.Error("failed testing send context")
 	}
+}
 
-	sDriver.SetHTMLBody("")
-	sDriver.SetPlainTextBody("this is plain text body")
-	err = sDriver.Send()
+func TestSparkPostDriverSendToServer(t *testing.T) {
+	var transmissions []map[string]interface{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/transmissions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var transmission map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&transmission)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		transmissions = append(transmissions, transmission)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":{"total_rejected_recipients":0,"total_accepted_recipients":1,"id":"11668787484950529"}}`))
+	}))
+	defer server.Close()
+	sDriver := initiateSparkPost(&SparkPostConfig{
+		BaseUrl:    server.URL,
+		ApiKey:     "test-api-key",
+		ApiVersion: 1,
+	})
+	sDriver.httpClient = server.Client()
+	err := sDriver.SendMessage(context.Background(), &Message{
+		From:          mail.Address{Address: "from@mail.com"},
+		To:            []mail.Address{{Address: "to@mail.com"}},
+		Subject:       "this is the subject",
+		PlainTextBody: "this is plain text body",
+		HTMLBody:      `this is html body <img src="cid:logo">`,
+		ReplyTo:       []mail.Address{{Address: "support@mail.com"}},
+		ReturnPath:    "bounces@mail.com",
+		Headers:       map[string]string{"X-Entity-Ref-ID": "123"},
+		Attachments: []Attachment{
+			{Name: "logo.png", Path: "./testingdata/logo.png", ContentID: "logo"},
+		},
+	})
 	if err != nil {
-		t.Error("failed testing send")
+		t.Fatal("failed testing send", err)
 	}
-	file, _ = os.Open(tmpFilePath)
-	mBytes, _ = ioutil.ReadAll(file)
-	m = string(mBytes)
-	if !strings.Contains(m, `Content-Type: text/plain; charset="UTF-8"`) {
-		t.Error("Failed test send")
+	if len(transmissions) != 1 {
+		t.Fatal("failed testing send")
 	}
-	if !strings.Contains(m, `this is plain text body`) {
-		t.Error("Failed test send")
+	content := transmissions[0]["content"].(map[string]interface{})
+	headers, _ := content["headers"].(map[string]interface{})
+	if transmissions[0]["return_path"] != "bounces@mail.com" || content["reply_to"] != "<support@mail.com>" || headers["X-Entity-Ref-ID"] != "123" {
+		t.Error("failed testing send")
 	}
-
-	sDriver.initiateSend = func(from string, rcpts []string, message []byte, d Driver) error {
-		return errors.New("this is a test error")
+	if content["text"] != "this is plain text body" || content["html"] != `this is html body <img src="cid:logo">` {
+		t.Error("failed testing send")
 	}
-	err = sDriver.Send()
-	if err == nil {
+	inlineImages, _ := content["inline_images"].([]interface{})
+	if len(inlineImages) != 1 {
+		t.Fatal("failed testing send")
+	}
+	inlineImage := inlineImages[0].(map[string]interface{})
+	if inlineImage["name"] != "logo" || inlineImage["type"] != "image/png" || inlineImage["data"] == "" {
 		t.Error("failed testing send")
 	}
 }
@@ -0,0 +1,273 @@
+// Copyright 2023 Harran Ali <harran.m@gmail.com>. All rights reserved.
+// Use of this source code is governed by MIT-style
+// license that can be found in the LICENSE file.
+
+package mailing
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+// the file suffixes of the templates
+const (
+	templateHTMLSuffix    = ".html.tmpl"
+	templateTextSuffix    = ".txt.tmpl"
+	templateSubjectSuffix = ".subject.tmpl"
+)
+
+// Templates is a registry of email templates loaded from a file system, like an embed.FS.
+//
+// An email template named "welcome" is made of the files welcome.html.tmpl (html/template),
+// welcome.txt.tmpl (text/template) and welcome.subject.tmpl (text/template), they are all optional
+// but the email needs a body. The subject can also be defined in the html or the text template
+// with {{define "subject"}}. The files in the layouts and partials directories are shared by all
+// the templates, so a template can define its blocks and execute a layout with {{template "base" .}}
+type Templates struct {
+	templates map[string]*emailTemplate
+}
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// RenderedTemplate is an email rendered from a template
+type RenderedTemplate struct {
+	Subject       string
+	HTMLBody      string
+	PlainTextBody string // generated from the html body when there is no text template
+}
+
+// NewTemplates loads and parses all the templates of the file system, the templates in subdirectories
+// are named after their path, ex: the template of orders/shipped.html.tmpl is "orders/shipped"
+func NewTemplates(fsys fs.FS) (*Templates, error) {
+	var shared, files []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".tmpl") {
+			return err
+		}
+		if strings.HasPrefix(p, "layouts/") || strings.HasPrefix(p, "partials/") {
+			shared = append(shared, p)
+		} else {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sharedHTML, sharedText, err := parseSharedTemplates(fsys, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{templates: make(map[string]*emailTemplate)}
+	subjects := make(map[string]*texttemplate.Template) // the subjects defined in the html templates
+	for _, file := range files {
+		var err error
+		switch {
+		case strings.HasSuffix(file, templateHTMLSuffix):
+			tmpl := t.template(strings.TrimSuffix(file, templateHTMLSuffix))
+			tmpl.html, err = sharedHTML.Clone()
+			if err == nil {
+				tmpl.html, err = tmpl.html.ParseFS(fsys, file)
+			}
+			if err == nil {
+				tmpl.html = tmpl.html.Lookup(path.Base(file))
+				// the subject is a header, so it's parsed as text to not be html escaped
+				var text *texttemplate.Template
+				text, err = texttemplate.ParseFS(fsys, file)
+				if err == nil && text.Lookup("subject") != nil {
+					subjects[strings.TrimSuffix(file, templateHTMLSuffix)] = text.Lookup("subject")
+				}
+			}
+		case strings.HasSuffix(file, templateTextSuffix):
+			tmpl := t.template(strings.TrimSuffix(file, templateTextSuffix))
+			tmpl.text, err = sharedText.Clone()
+			if err == nil {
+				tmpl.text, err = tmpl.text.ParseFS(fsys, file)
+			}
+			if err == nil {
+				tmpl.text = tmpl.text.Lookup(path.Base(file))
+			}
+		case strings.HasSuffix(file, templateSubjectSuffix):
+			tmpl := t.template(strings.TrimSuffix(file, templateSubjectSuffix))
+			tmpl.subject, err = texttemplate.ParseFS(fsys, file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mailing: failed parsing the template %s: %w", file, err)
+		}
+	}
+	// the subject file comes first, then a subject defined in the text or the html template
+	for name, tmpl := range t.templates {
+		if tmpl.html == nil && tmpl.text == nil {
+			return nil, fmt.Errorf("mailing: the template %q has no html or text body", name)
+		}
+		if tmpl.subject == nil && tmpl.text != nil {
+			tmpl.subject = tmpl.text.Lookup("subject")
+		}
+		if tmpl.subject == nil {
+			tmpl.subject = subjects[name]
+		}
+	}
+	return t, nil
+}
+
+// the html and text sets of the layouts and the partials, cloned by every template
+func parseSharedTemplates(fsys fs.FS, files []string) (*htmltemplate.Template, *texttemplate.Template, error) {
+	html := htmltemplate.New("")
+	text := texttemplate.New("")
+	for _, file := range files {
+		var err error
+		switch {
+		case strings.HasSuffix(file, templateHTMLSuffix):
+			html, err = html.ParseFS(fsys, file)
+		case strings.HasSuffix(file, templateTextSuffix):
+			text, err = text.ParseFS(fsys, file)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("mailing: failed parsing the template %s: %w", file, err)
+		}
+	}
+	return html, text, nil
+}
+
+func (t *Templates) template(name string) *emailTemplate {
+	if t.templates[name] == nil {
+		t.templates[name] = &emailTemplate{}
+	}
+	return t.templates[name]
+}
+
+// Render the subject and the bodies of the named template with the data
+func (t *Templates) Render(name string, data interface{}) (*RenderedTemplate, error) {
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("mailing: no template named %q", name)
+	}
+	rendered := &RenderedTemplate{}
+	var buf bytes.Buffer
+	if tmpl.html != nil {
+		err := tmpl.html.Execute(&buf, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered.HTMLBody = buf.String()
+	}
+	if tmpl.text != nil {
+		buf.Reset()
+		err := tmpl.text.Execute(&buf, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered.PlainTextBody = buf.String()
+	} else {
+		rendered.PlainTextBody = htmlToText(rendered.HTMLBody)
+	}
+
+	if tmpl.subject != nil {
+		buf.Reset()
+		err := tmpl.subject.Execute(&buf, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	}
+	return rendered, nil
+}
+
+var (
+	htmlHrefPattern    = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	whitespacesPattern = regexp.MustCompile(`[ \t\r\n]+`)
+	blankLinesPattern  = regexp.MustCompile(`\n{3,}`)
+	// the elements whose content isn't shown
+	htmlHiddenElements = map[string]bool{"head": true, "title": true, "style": true, "script": true}
+	// the elements shown as paragraphs
+	htmlBlockElements = map[string]bool{
+		"p": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"ul": true, "ol": true, "table": true, "blockquote": true, "section": true, "article": true,
+		"header": true, "footer": true, "hr": true,
+	}
+)
+
+// the plain text version of the html body: the tags are removed, the blocks and the line breaks start
+// new lines, the links are followed by their address, and the head, style and script contents are dropped
+func htmlToText(body string) string {
+	var text strings.Builder
+	var hiddenUntil, href string
+	var linkStart int
+	for len(body) > 0 {
+		start := strings.IndexByte(body, '<')
+		if start < 0 {
+			start = len(body)
+		}
+		if hiddenUntil == "" {
+			text.WriteString(whitespacesPattern.ReplaceAllString(html.UnescapeString(body[:start]), " "))
+		}
+		body = body[start:]
+		if strings.HasPrefix(body, "<!--") {
+			end := strings.Index(body, "-->")
+			if end < 0 {
+				break
+			}
+			body = body[end+3:]
+			continue
+		}
+		end := strings.IndexByte(body, '>')
+		if end < 0 {
+			break
+		}
+		tag := body[1:end]
+		body = body[end+1:]
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if i := strings.IndexAny(name, " \t\r\n/"); i >= 0 {
+			name = name[:i]
+		}
+		if hiddenUntil != "" {
+			if closing && name == hiddenUntil {
+				hiddenUntil = ""
+			}
+			continue
+		}
+		switch {
+		case htmlHiddenElements[name] && !closing:
+			hiddenUntil = name
+		case htmlBlockElements[name]:
+			text.WriteString("\n\n")
+		case name == "br" || name == "tr":
+			text.WriteString("\n")
+		case name == "li" && !closing:
+			text.WriteString("\n- ")
+		case name == "td" || name == "th":
+			text.WriteString(" ")
+		case name == "a" && !closing:
+			href, linkStart = "", text.Len()
+			if match := htmlHrefPattern.FindStringSubmatch(tag); match != nil {
+				href = html.UnescapeString(match[1] + match[2] + match[3])
+			}
+		case name == "a" && closing:
+			// the address is shown unless the link shows it already
+			linkText := strings.TrimSpace(text.String()[linkStart:])
+			if href != "" && !strings.HasPrefix(href, "#") && href != linkText && href != "mailto:"+linkText {
+				text.WriteString(" (" + href + ")")
+			}
+			href = ""
+		}
+	}
+
+	lines := strings.Split(text.String(), "\n")
+	for i, v := range lines {
+		lines[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
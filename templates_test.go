@@ -0,0 +1,109 @@
+package mailing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplatesRender(t *testing.T) {
+	templates, err := NewTemplates(os.DirFS("./testingdata/templates"))
+	if err != nil {
+		t.Fatal("failed testing templates render", err)
+	}
+	// the subject defined in the html template isn't html escaped, the body is
+	rendered, err := templates.Render("welcome", map[string]string{"Name": "<Jo>"})
+	if err != nil {
+		t.Fatal("failed testing templates render", err)
+	}
+	if rendered.Subject != "Welcome <Jo> & friends" {
+		t.Error("failed testing templates render")
+	}
+	if !strings.Contains(rendered.HTMLBody, "<h1>Hello &lt;Jo&gt;</h1>") || !strings.Contains(rendered.HTMLBody, "<title>Welcome</title>") || !strings.Contains(rendered.HTMLBody, `<a href="https://example.com">Example</a>`) {
+		t.Error("failed testing templates render")
+	}
+	if rendered.PlainTextBody != "Hello <Jo>\n\nThanks, the Example team\n" {
+		t.Error("failed testing templates render")
+	}
+
+	// the text is generated from the html when there is no text template
+	rendered, err = templates.Render("orders/shipped", map[string]interface{}{"Name": "Jo", "Order": 42, "Items": []string{"a book", "a pen"}})
+	if err != nil {
+		t.Fatal("failed testing templates render", err)
+	}
+	if rendered.Subject != "Your order #42 has shipped" {
+		t.Error("failed testing templates render")
+	}
+	expected := "Hi Jo,\n\nYour order #42 is on its way:\n\n- a book\n- a pen\n\nTrack it here (https://example.com/track?id=42&ref=email).\nQuestions? help@example.com\n\nThanks, the Example (https://example.com) team"
+	if rendered.PlainTextBody != expected {
+		t.Errorf("failed testing templates render, got:\n%s", rendered.PlainTextBody)
+	}
+
+	_, err = templates.Render("missing", nil)
+	if err == nil {
+		t.Error("failed testing templates render")
+	}
+	_, err = templates.Render("welcome", 42)
+	if err == nil {
+		t.Error("failed testing templates render")
+	}
+}
+
+func TestNewTemplatesErrors(t *testing.T) {
+	_, err := NewTemplates(fstest.MapFS{"broken.html.tmpl": {Data: []byte("{{if}}")}})
+	if err == nil || !strings.Contains(err.Error(), "broken.html.tmpl") {
+		t.Error("failed testing new templates errors")
+	}
+	_, err = NewTemplates(fstest.MapFS{"subject-only.subject.tmpl": {Data: []byte("the subject")}})
+	if err == nil {
+		t.Error("failed testing new templates errors")
+	}
+	// a text template alone has no html body
+	templates, err := NewTemplates(fstest.MapFS{"text.txt.tmpl": {Data: []byte(`{{define "subject"}}Hi {{.}}{{end}}Hello {{.}}`)}})
+	if err != nil {
+		t.Fatal("failed testing new templates errors", err)
+	}
+	rendered, err := templates.Render("text", "Jo")
+	if err != nil || rendered.Subject != "Hi Jo" || rendered.PlainTextBody != "Hello Jo" || rendered.HTMLBody != "" {
+		t.Error("failed testing new templates errors")
+	}
+}
+
+func TestMailerSetTemplate(t *testing.T) {
+	templates, err := NewTemplates(os.DirFS("./testingdata/templates"))
+	if err != nil {
+		t.Fatal("failed testing set template", err)
+	}
+	driver := &testDriver{}
+	mailer := NewMailer(driver).SetTemplates(templates)
+	err = mailer.
+		SetFrom(EmailAddress{Address: "from@mail.com"}).
+		SetTo([]EmailAddress{{Address: "to@mail.com"}}).
+		SetTemplate("welcome", map[string]string{"Name": "Jo"}).
+		Send()
+	if err != nil {
+		t.Fatal("failed testing set template", err)
+	}
+	msg := driver.messages[0]
+	if msg.Subject != "Welcome Jo & friends" || !strings.Contains(msg.HTMLBody, "<h1>Hello Jo</h1>") || !strings.HasPrefix(msg.PlainTextBody, "Hello Jo") {
+		t.Error("failed testing set template")
+	}
+
+	// the rendering error is returned when sending, and isn't kept for the next email
+	result, err := mailer.SetTo([]EmailAddress{{Address: "to@mail.com"}}).SetTemplate("missing", nil).SendWithResult(context.Background())
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageBuild || len(driver.messages) != 1 || len(result.Failed()) != 1 {
+		t.Error("failed testing set template")
+	}
+	err = mailer.SetTo([]EmailAddress{{Address: "to@mail.com"}}).SetSubject("the subject").SetPlainTextBody("the body").Send()
+	if err != nil || len(driver.messages) != 2 {
+		t.Error("failed testing set template")
+	}
+	err = NewMailer(driver).SetTemplate("welcome", nil).Send()
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageBuild {
+		t.Error("failed testing set template")
+	}
+}